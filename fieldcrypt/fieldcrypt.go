@@ -0,0 +1,251 @@
+// Package fieldcrypt encrypts individual values of a JSON document with a
+// KMS data key (envelope encryption), and decrypts them again for
+// downstream consumers of uploaded objects.
+//
+// Each selected value is replaced by a string of the form "enc:v1:<base64>"
+// holding the AES-GCM sealed JSON encoding of the original value, bound to
+// its JSON Pointer. The KMS-encrypted data key travels separately, in the
+// S3 object metadata under MetadataKey.
+package fieldcrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// MetadataKey is the S3 user metadata key holding the encrypted data key.
+const MetadataKey = "field-encryption-key"
+
+// prefix marks an encrypted value.
+const prefix = "enc:v1:"
+
+// KMSAPI is the subset of the KMS client used for envelope encryption.
+type KMSAPI interface {
+	GenerateDataKey(ctx context.Context, params *kms.GenerateDataKeyInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error)
+	Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+// Encrypt encrypts the values at the given JSON Pointers under a fresh data
+// key from keyID. Pointers that do not exist in the document are skipped.
+// It returns the rewritten document and the base64 encrypted data key to
+// store under MetadataKey.
+func Encrypt(ctx context.Context, client KMSAPI, keyID string, document []byte, pointers []string) ([]byte, string, error) {
+	doc, err := decode(document)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	dataKey, err := client.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(keyID),
+		KeySpec: types.DataKeySpecAes256,
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to generate data key: %v", err)
+	}
+
+	aead, err := newAEAD(dataKey.Plaintext)
+	clear(dataKey.Plaintext)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, pointer := range pointers {
+		tokens, err := parsePointer(pointer)
+		if err != nil {
+			return nil, "", err
+		}
+
+		doc, err = replace(doc, tokens, func(value interface{}) (interface{}, error) {
+			return seal(aead, pointer, value)
+		})
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return nil, "", err
+	}
+	return out, base64.StdEncoding.EncodeToString(dataKey.CiphertextBlob), nil
+}
+
+// Decrypt restores every encrypted value in the document using the data key
+// stored under MetadataKey in the object's metadata.
+func Decrypt(ctx context.Context, client KMSAPI, document []byte, encryptedKey string) ([]byte, error) {
+	doc, err := decode(document)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(encryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted data key: %v", err)
+	}
+
+	dataKey, err := client.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: blob})
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt data key: %v", err)
+	}
+
+	aead, err := newAEAD(dataKey.Plaintext)
+	clear(dataKey.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err = open(aead, doc, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(doc)
+}
+
+// decode parses JSON with numbers as json.Number, so rewriting a document
+// never rounds numbers a float64 can't hold.
+func decode(data []byte) (interface{}, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the JSON encoding of value, using the pointer as additional
+// data so an encrypted value cannot be moved elsewhere in the document.
+func seal(aead cipher.AEAD, pointer string, value interface{}) (interface{}, error) {
+	plain, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := aead.Seal(nonce, nonce, plain, []byte(pointer))
+	return prefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open walks the document decrypting encrypted values in place.
+func open(aead cipher.AEAD, value interface{}, tokens []string) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			opened, err := open(aead, child, append(tokens, key))
+			if err != nil {
+				return nil, err
+			}
+			v[key] = opened
+		}
+	case []interface{}:
+		for i, child := range v {
+			opened, err := open(aead, child, append(tokens, strconv.Itoa(i)))
+			if err != nil {
+				return nil, err
+			}
+			v[i] = opened
+		}
+	case string:
+		if !strings.HasPrefix(v, prefix) {
+			return v, nil
+		}
+
+		pointer := formatPointer(tokens)
+		sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(v, prefix))
+		if err != nil || len(sealed) < aead.NonceSize() {
+			return nil, fmt.Errorf("malformed encrypted value at %q", pointer)
+		}
+
+		plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(pointer))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decrypt value at %q: %v", pointer, err)
+		}
+
+		return decode(plain)
+	}
+
+	return value, nil
+}
+
+// replace applies fn to the value the tokens point at, if it exists.
+func replace(value interface{}, tokens []string, fn func(interface{}) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 0 {
+		return fn(value)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		child, ok := v[tokens[0]]
+		if !ok {
+			return value, nil
+		}
+		replaced, err := replace(child, tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		v[tokens[0]] = replaced
+	case []interface{}:
+		i, err := strconv.Atoi(tokens[0])
+		if err != nil || i < 0 || i >= len(v) {
+			return value, nil
+		}
+		replaced, err := replace(v[i], tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		v[i] = replaced
+	}
+
+	return value, nil
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into its reference tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, errors.New("cannot encrypt the whole document")
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+func formatPointer(tokens []string) string {
+	var b strings.Builder
+	for _, token := range tokens {
+		b.WriteString("/")
+		b.WriteString(strings.NewReplacer("~", "~0", "/", "~1").Replace(token))
+	}
+	return b.String()
+}
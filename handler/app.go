@@ -0,0 +1,230 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bootsdigitalhealth/go-aws/secret"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/auth"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/storage"
+	goredis "github.com/go-redis/redis"
+)
+
+// SecretSource reads a JSON secret as a map of strings.
+type SecretSource interface {
+	SecretMap(id string) (map[string]string, error)
+}
+
+// Clock tells the time object keys are built from.
+type Clock interface {
+	Now() time.Time
+}
+
+// IDGenerator makes request IDs for requests API Gateway did not give one.
+type IDGenerator interface {
+	NewID() string
+}
+
+// App holds the dependencies of the upload Handler, so it can run against
+// fakes instead of Redis, Secrets Manager and S3. NewLambdaApp fills every
+// field with the real implementation; a nil AWS client or Redis turns off the
+// features that need it, and a nil Getenv reads the process environment.
+type App struct {
+	Sessions    auth.SessionStore
+	NewUploader func(tenant, bucket string) (storage.Uploader, error)
+	Secrets     SecretSource
+	Clock       Clock
+	IDs         IDGenerator
+	Flags       FlagProvider
+
+	// Redis holds the function's own state: concurrency slots, quotas,
+	// deduplication records and the like. Sessions are read through
+	// Sessions, not this client.
+	Redis *goredis.Client
+
+	// The AWS clients are created on first use, so a cold start only pays
+	// for the ones its requests need.
+	KMS           func() (KMSAPI, error)
+	SQS           func() (SQSAPI, error)
+	DynamoDB      func() (DynamoDBAPI, error)
+	StepFunctions func() (SFNAPI, error)
+
+	// SecondaryUploader is the DR bucket uploads are copied to; it returns
+	// a nil Uploader when dual-write is off.
+	SecondaryUploader func() (storage.Uploader, error)
+
+	// KillSwitches reads the routes currently switched off. It is called on
+	// every request so switches can be flipped without a deploy.
+	KillSwitches func() (KillSwitches, error)
+
+	// Getenv reads the function's configuration, and is handed on to the
+	// storage, validation, auth and response packages for theirs. Only the
+	// process-wide settings Run reads itself, and the AWS SDK's and OTLP
+	// exporters' own variables, come from the process environment.
+	Getenv func(key string) string
+
+	// configuration parsed from Getenv on first use
+	categories        lazy[map[string]*uploadCategory]
+	concurrencyLimits lazy[map[string]int]
+	storageQuotas     lazy[map[string]int64]
+	stageBudgets      lazy[map[string]time.Duration]
+	bucketRoutes      lazy[map[string]string]
+	tenantBuckets     lazy[map[string]*tenantBucket]
+	logger            lazy[*slog.Logger]
+
+	// uploaders are kept so S3 connections and assumed role credentials
+	// stay warm between requests
+	uploadersMu     sync.Mutex
+	bucketUploaders map[string]*storage.S3Uploader
+	tenantUploaders map[string]*storage.S3Uploader
+
+	// configErr is set when the deployment is misconfigured
+	configErr error
+}
+
+// NewLambdaApp binds the real AWS, Redis and Secrets Manager backed
+// implementations, configured from the process environment.
+func NewLambdaApp() (*App, error) {
+	app := newAWSApp()
+	if err := checkRequiredEnv(app.getenv); err != nil {
+		return nil, err
+	}
+
+	sessions, err := auth.NewSessionStore(app.getenv)
+	if err != nil {
+		return nil, err
+	}
+	flags, err := newFlagProvider(app.getenv, app.Redis)
+	if err != nil {
+		return nil, err
+	}
+
+	app.Sessions = sessions
+	app.NewUploader = func(tenant, bucket string) (storage.Uploader, error) {
+		uploader, err := app.uploaderForTenant(tenant, bucket)
+		if err != nil {
+			return nil, err
+		}
+		return uploader, nil
+	}
+	app.Secrets = secretCacheSource{}
+	app.Flags = flags
+	return app, nil
+}
+
+// newAWSApp binds what every handler mode shares: the AWS clients, the app
+// Redis and the process environment.
+func newAWSApp() *App {
+	app := &App{
+		Clock:  systemClock{},
+		IDs:    nanoIDs{},
+		Getenv: os.Getenv,
+		KMS: func() (KMSAPI, error) {
+			return getKMSClient()
+		},
+		SQS: func() (SQSAPI, error) {
+			return getSQSClient()
+		},
+		DynamoDB: func() (DynamoDBAPI, error) {
+			return getDynamoDBClient()
+		},
+		StepFunctions: func() (SFNAPI, error) {
+			return getSFNClient()
+		},
+	}
+	app.Redis = newAppRedis(app.getenv)
+	app.SecondaryUploader = sync.OnceValues(app.newSecondaryUploader)
+	app.KillSwitches = app.loadKillSwitches
+	return app
+}
+
+// getenv reads a configuration value through Getenv.
+func (a *App) getenv(key string) string {
+	if a.Getenv == nil {
+		return os.Getenv(key)
+	}
+	return a.Getenv(key)
+}
+
+// lazy is configuration parsed once, on first use.
+type lazy[T any] struct {
+	once  sync.Once
+	value T
+	err   error
+}
+
+func (l *lazy[T]) get(load func() (T, error)) (T, error) {
+	l.once.Do(func() {
+		l.value, l.err = load()
+	})
+	return l.value, l.err
+}
+
+// asS3Uploader returns the S3 uploader behind u, for the features that use
+// the S3 API directly.
+func asS3Uploader(u storage.Uploader) (*storage.S3Uploader, error) {
+	s3Uploader, ok := u.(*storage.S3Uploader)
+	if !ok {
+		return nil, errors.New("this feature needs an S3 uploader")
+	}
+	return s3Uploader, nil
+}
+
+// bucketOf is the bucket u writes to, or "" for uploaders that aren't S3.
+func bucketOf(u storage.Uploader) string {
+	if s3Uploader, ok := u.(*storage.S3Uploader); ok {
+		return s3Uploader.Bucket
+	}
+	return ""
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// nanoIDs uses the current time in nanoseconds as the ID.
+type nanoIDs struct{}
+
+func (nanoIDs) NewID() string {
+	return fmt.Sprintf("%d", time.Now().UnixNano())
+}
+
+var (
+	// secretCache backs secretCacheSource, created on first use.
+	secretCacheMu sync.Mutex
+	secretCache   *secret.Cache
+)
+
+// secretCacheSource reads secrets through the go-aws secret cache.
+type secretCacheSource struct{}
+
+func (secretCacheSource) SecretMap(id string) (map[string]string, error) {
+	secretCacheMu.Lock()
+	if secretCache == nil {
+		cache, err := secret.New()
+		if err != nil {
+			secretCacheMu.Unlock()
+			return nil, err
+		}
+		secretCache = cache
+	}
+	cache := secretCache
+	secretCacheMu.Unlock()
+
+	values, err := cache.GetSecretStringAsMap(id)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make(map[string]string, len(values))
+	for key, value := range values {
+		secrets[key] = fmt.Sprint(value)
+	}
+	return secrets, nil
+}
@@ -0,0 +1,33 @@
+package handler
+
+import (
+	"crypto/tls"
+	"strconv"
+
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/auth"
+	goredis "github.com/go-redis/redis"
+)
+
+// newAppRedis returns the Redis client used for this function's own state
+// (concurrency gauges, caches and the like), or nil when APP_REDIS_ADDR is
+// not configured. Sessions are still read through go-db's sessions client.
+func newAppRedis(getenv func(string) string) *goredis.Client {
+	addr := getenv("APP_REDIS_ADDR")
+	if addr == "" {
+		return nil
+	}
+
+	options := &goredis.Options{
+		Addr:         addr,
+		ReadTimeout:  auth.CommandTimeout(getenv),
+		WriteTimeout: auth.CommandTimeout(getenv),
+	}
+	if db, err := strconv.Atoi(getenv("APP_REDIS_DB")); err == nil {
+		options.DB = db
+	}
+	if useTLS, _ := strconv.ParseBool(getenv("APP_REDIS_TLS")); useTLS {
+		options.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	return goredis.NewClient(options)
+}
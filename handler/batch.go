@@ -0,0 +1,187 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/httpapi"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/storage"
+)
+
+// defaultBatchMaxDocuments caps a batch when BATCH_MAX_DOCUMENTS is not set.
+const defaultBatchMaxDocuments = 100
+
+// batchResult reports the outcome of every document in a batch, in the
+// order they were sent.
+type batchResult struct {
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Results   []batchItemResult `json:"results"`
+}
+
+// batchItemResult is the key a document was stored under, and the
+// post-processing execution started for it if any, or why it was not
+// stored.
+type batchItemResult struct {
+	Index        int                `json:"index"`
+	Status       int                `json:"status"`
+	Key          string             `json:"key,omitempty"`
+	ExecutionARN string             `json:"execution_arn,omitempty"`
+	Error        *httpapi.ErrorBody `json:"error,omitempty"`
+}
+
+// isBatchRoute reports whether the request is for POST /uploads/batch.
+func isBatchRoute(request events.APIGatewayProxyRequest) bool {
+	return request.HTTPMethod == http.MethodPost && request.Resource == "/uploads/batch"
+}
+
+// requestCategory is the upload category the request names: the category
+// query parameter for batches, the path parameter otherwise.
+func requestCategory(request events.APIGatewayProxyRequest) string {
+	if isBatchRoute(request) {
+		return request.QueryStringParameters["category"]
+	}
+	return request.PathParameters["category"]
+}
+
+// batchMaxDocuments is BATCH_MAX_DOCUMENTS or the default.
+func (a *App) batchMaxDocuments() int {
+	if limit, err := strconv.Atoi(a.getenv("BATCH_MAX_DOCUMENTS")); err == nil && limit > 0 {
+		return limit
+	}
+	return defaultBatchMaxDocuments
+}
+
+// batchDocuments splits a batch body into its documents. The body is either
+// a JSON array of documents or NDJSON, one document per line.
+func (a *App) batchDocuments(request events.APIGatewayProxyRequest) ([]string, error) {
+	body := request.Body
+	if request.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 body: %v", err)
+		}
+		body = string(decoded)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(httpapi.RequestHeader(request, "Content-Type"))
+	if mediaType != "application/x-ndjson" && strings.HasPrefix(strings.TrimSpace(body), "[") {
+		var raw []json.RawMessage
+		if err := json.Unmarshal([]byte(body), &raw); err != nil {
+			return nil, fmt.Errorf("invalid batch: %v", err)
+		}
+		documents := make([]string, len(raw))
+		for i, document := range raw {
+			documents[i] = string(document)
+		}
+		return documents, nil
+	}
+
+	var documents []string
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	scanner.Buffer(nil, a.maxPayloadBytes()+1)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			documents = append(documents, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("invalid batch: %v", err)
+	}
+	return documents, nil
+}
+
+// batchResponse validates and uploads each document of a batch on its own,
+// a bounded number at a time, and answers 207 with a result per document so
+// one bad document doesn't fail the rest.
+func (a *App) batchResponse(ctx context.Context, request events.APIGatewayProxyRequest, uploader storage.Uploader, category *uploadCategory, tenant, requestID string, userID int64) (events.APIGatewayProxyResponse, error) {
+	documents, err := a.batchDocuments(request)
+	if err != nil {
+		return httpapi.ErrorResponse(http.StatusBadRequest, err)
+	}
+	if len(documents) == 0 {
+		return httpapi.ErrorResponse(http.StatusBadRequest, errors.New("batch has no documents"))
+	}
+	if len(documents) > a.batchMaxDocuments() {
+		return httpapi.ErrorResponse(http.StatusRequestEntityTooLarge, fmt.Errorf("batch exceeds %d documents", a.batchMaxDocuments()))
+	}
+
+	// Documents are worked on BATCH_CONCURRENCY at a time, each for at most
+	// BATCH_ITEM_TIMEOUT_MS
+	results := make([]batchItemResult, len(documents))
+	options := a.uploadOptionsFor(ctx, userID)
+	err = a.newWorkerPool("batch", "BATCH").run(ctx, len(documents), func(ctx context.Context, i int) error {
+		results[i] = a.storeBatchItem(ctx, uploadDocument{
+			uploader:      uploader,
+			category:      category,
+			schemaVersion: httpapi.RequestHeader(request, "X-Schema-Version"),
+			tenant:        tenant,
+			requestID:     requestID,
+			userID:        userID,
+			appVersion:    httpapi.RequestHeader(request, "X-App-Version"),
+			payload:       documents[i],
+			keySuffix:     fmt.Sprintf("_%d", i),
+			options:       options,
+		})
+		if results[i].Error != nil {
+			return errors.New(results[i].Error.Message)
+		}
+		return nil
+	})
+
+	// Documents the invocation ran out of time to start are reported too
+	var failures poolErrors
+	errors.As(err, &failures)
+	for i := range results {
+		results[i].Index = i
+		if results[i].Status == 0 {
+			failure := failed(http.StatusGatewayTimeout, failures.errFor(i))
+			results[i].Status, results[i].Error = failure.status, failure.body()
+		}
+	}
+
+	result := batchResult{Results: results}
+	for _, item := range results {
+		if item.Error != nil {
+			result.Failed++
+		} else {
+			result.Succeeded++
+		}
+	}
+	a.emitMetrics(map[string]string{"Category": category.Name, "Tenant": a.metricTenant(tenant)},
+		metric{Name: "BatchDocuments", Value: float64(len(documents)), Unit: "Count"},
+		metric{Name: "BatchFailures", Value: float64(result.Failed), Unit: "Count"},
+	)
+
+	return httpapi.JSONResponse(http.StatusMultiStatus, result)
+}
+
+func (a *App) storeBatchItem(ctx context.Context, doc uploadDocument) batchItemResult {
+	if len(doc.payload) > a.maxPayloadBytes() {
+		failure := failed(http.StatusRequestEntityTooLarge, fmt.Errorf("document exceeds %d bytes", a.maxPayloadBytes()))
+		return batchItemResult{Status: failure.status, Error: failure.body()}
+	}
+
+	stored, failure := a.storeDocument(ctx, doc, nil)
+	if failure != nil && failure.key == "" {
+		return batchItemResult{Status: failure.status, Error: failure.body()}
+	}
+
+	// Copy to the DR bucket; the batch's goroutine waits for it
+	a.replicateToSecondary(stored.key, stored.object, stored.metadata)()
+
+	if failure != nil {
+		return batchItemResult{Status: failure.status, Key: stored.key, Error: failure.body()}
+	}
+
+	return batchItemResult{Status: http.StatusOK, Key: stored.key, ExecutionARN: stored.executionARN}
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/httpapi"
+)
+
+// defaultMaxPayloadBytes sits just under the 6MB synchronous Lambda payload
+// limit, leaving room for the rest of the API Gateway event.
+const defaultMaxPayloadBytes = 5 * 1024 * 1024
+
+// acceptedContentTypes are the request body formats the upload route takes.
+var acceptedContentTypes = []string{"application/json", "application/x-www-form-urlencoded", "text/csv"}
+
+// capabilities describes the limits and features active for a caller.
+type capabilities struct {
+	MaxPayloadBytes      int                           `json:"max_payload_bytes"`
+	AcceptedContentTypes []string                      `json:"accepted_content_types"`
+	Categories           map[string]categoryCapability `json:"categories"`
+	RateLimits           rateLimitCapability           `json:"rate_limits"`
+}
+
+type categoryCapability struct {
+	SchemaVersion  string   `json:"schema_version,omitempty"`
+	SchemaVersions []string `json:"schema_versions,omitempty"`
+}
+
+type rateLimitCapability struct {
+	MaxConcurrentRequests int `json:"max_concurrent_requests,omitempty"`
+}
+
+// maxPayloadBytes is the largest body the upload route accepts.
+func (a *App) maxPayloadBytes() int {
+	if limit, err := strconv.Atoi(a.getenv("MAX_PAYLOAD_BYTES")); err == nil && limit > 0 {
+		return limit
+	}
+	return defaultMaxPayloadBytes
+}
+
+// capabilitiesResponse lets client apps discover server limits at runtime
+// rather than hardcoding them.
+func (a *App) capabilitiesResponse(tenant string) (events.APIGatewayProxyResponse, error) {
+	allowed, err := a.loadCategories()
+	if err != nil {
+		return httpapi.ErrorResponse(http.StatusInternalServerError, err)
+	}
+	limits, err := a.loadConcurrencyLimits()
+	if err != nil {
+		return httpapi.ErrorResponse(http.StatusInternalServerError, err)
+	}
+
+	caps := capabilities{
+		MaxPayloadBytes:      a.maxPayloadBytes(),
+		AcceptedContentTypes: acceptedContentTypes,
+		Categories:           map[string]categoryCapability{},
+	}
+
+	for name, category := range allowed {
+		if !a.payloadTypeAllowed(category) {
+			continue
+		}
+		capability := categoryCapability{SchemaVersions: category.schemaVersions()}
+		if category.Schema != nil {
+			capability.SchemaVersion = category.Schema.Version
+		}
+		caps.Categories[name] = capability
+	}
+
+	limit, ok := limits[tenant]
+	if !ok {
+		limit = limits["*"]
+	}
+	caps.RateLimits.MaxConcurrentRequests = limit
+
+	return httpapi.JSONResponse(http.StatusOK, caps)
+}
@@ -0,0 +1,236 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/validation"
+)
+
+// defaultCategory is used when a request arrives without a {category} path
+// parameter, preserving the original actions/ key layout.
+var defaultCategory = &uploadCategory{Name: "activityType", Prefix: "actions"}
+
+// uploadCategory maps a {category} path parameter to the key prefix its
+// uploads are stored under and the schema their payload must satisfy.
+// Versions holds older schema versions clients may still upload against,
+// EncryptedFields lists JSON Pointers encrypted before the object is stored,
+// OutputFormat is "json" (the default), "parquet" or "avro" and Pipeline
+// lists the stages its uploads go through, replacing defaultPipeline. A
+// pipeline leaving out harden, validate or redact is only accepted with
+// AllowUnvalidatedPipeline, which should only be set after review.
+type uploadCategory struct {
+	Name            string                    `json:"-"`
+	Prefix          string                    `json:"prefix"`
+	Schema          *payloadSchema            `json:"schema,omitempty"`
+	Versions        map[string]*payloadSchema `json:"versions,omitempty"`
+	EncryptedFields []string                  `json:"encrypted_fields,omitempty"`
+	OutputFormat    string                    `json:"output_format,omitempty"`
+	Pipeline        []string                  `json:"pipeline,omitempty"`
+
+	AllowUnvalidatedPipeline bool `json:"allow_unvalidated_pipeline,omitempty"`
+}
+
+// payloadSchema is a small subset of JSON Schema: the top-level type, the
+// fields an object must contain and the JSON type of individual fields.
+// Deprecated versions are still accepted but clients are warned.
+type payloadSchema struct {
+	Version    string            `json:"version,omitempty"`
+	Deprecated bool              `json:"deprecated,omitempty"`
+	Type       string            `json:"type"`
+	Required   []string          `json:"required,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+// loadCategories parses the UPLOAD_CATEGORIES allow-list, a JSON object of
+// category name to uploadCategory, e.g.
+//
+//	{"sleep": {"prefix": "sleep", "schema": {"type": "object", "required": ["start"]}}}
+func (a *App) loadCategories() (map[string]*uploadCategory, error) {
+	return a.categories.get(func() (map[string]*uploadCategory, error) {
+		categories := map[string]*uploadCategory{}
+
+		raw := a.getenv("UPLOAD_CATEGORIES")
+		if raw == "" {
+			return categories, nil
+		}
+
+		if err := json.Unmarshal([]byte(raw), &categories); err != nil {
+			return nil, fmt.Errorf("invalid UPLOAD_CATEGORIES: %v", err)
+		}
+
+		for name, category := range categories {
+			if category == nil || category.Prefix == "" {
+				return nil, fmt.Errorf("invalid UPLOAD_CATEGORIES: category %q has no prefix", name)
+			}
+			if len(category.Pipeline) > 0 {
+				if err := checkPipeline(category.Pipeline, category.AllowUnvalidatedPipeline); err != nil {
+					return nil, fmt.Errorf("invalid UPLOAD_CATEGORIES: category %q: %v", name, err)
+				}
+				if category.AllowUnvalidatedPipeline {
+					log.Printf("Category %q may skip validation stages: %v", name, category.Pipeline)
+				}
+			}
+			category.Name = name
+		}
+		return categories, nil
+	})
+}
+
+// lookupCategory resolves the {category} path parameter against the
+// allow-list. A nil category with a nil error means the category is unknown.
+func (a *App) lookupCategory(name string) (*uploadCategory, error) {
+	if name == "" {
+		return defaultCategory, nil
+	}
+
+	allowed, err := a.loadCategories()
+	if err != nil {
+		return nil, err
+	}
+
+	return allowed[name], nil
+}
+
+// keyPrefix is where the category's uploads for tenant are stored:
+// {prefix}/{system code}, or just the prefix for the default tenant.
+func (c *uploadCategory) keyPrefix(tenant string) string {
+	if tenant == "" || tenant == defaultTenant {
+		return c.Prefix
+	}
+	return c.Prefix + "/" + tenant
+}
+
+// schemaFor returns the schema a client asked for with X-Schema-Version,
+// defaulting to the current one. It returns false for unknown versions.
+func (c *uploadCategory) schemaFor(version string) (*payloadSchema, bool) {
+	if version == "" || (c.Schema != nil && c.Schema.Version == version) {
+		return c.Schema, true
+	}
+
+	schema, ok := c.Versions[version]
+	return schema, ok && schema != nil
+}
+
+// schemaVersions lists every schema version the category accepts.
+func (c *uploadCategory) schemaVersions() []string {
+	var versions []string
+	if c.Schema != nil && c.Schema.Version != "" {
+		versions = append(versions, c.Schema.Version)
+	}
+	for version := range c.Versions {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// validate checks the payload against the schema, reporting every problem
+// found. A nil schema accepts anything validateJSON accepts.
+func (s *payloadSchema) validate(jsonData string) validation.Errors {
+	if s == nil {
+		return nil
+	}
+
+	var temp interface{}
+	if err := json.Unmarshal([]byte(jsonData), &temp); err != nil {
+		return validation.Errors{{Rule: "syntax", Message: fmt.Sprintf("invalid JSON format: %v", err)}}
+	}
+	return s.validateValue(temp)
+}
+
+// validateValue is validate for a payload already unmarshalled into
+// interface{}.
+func (s *payloadSchema) validateValue(temp interface{}) validation.Errors {
+	if s == nil {
+		return nil
+	}
+
+	if s.Type != "" && jsonType(temp) != s.Type {
+		return validation.Errors{{
+			Rule:    "type",
+			Value:   validation.Value(temp),
+			Message: fmt.Sprintf("payload must be a JSON %s", s.Type),
+		}}
+	}
+
+	if len(s.Required) == 0 && len(s.Properties) == 0 {
+		return nil
+	}
+
+	object, ok := temp.(map[string]interface{})
+	if !ok {
+		return validation.Errors{{
+			Rule:    "type",
+			Value:   validation.Value(temp),
+			Message: "payload must be a JSON object",
+		}}
+	}
+
+	var errs validation.Errors
+	for _, field := range s.Required {
+		if _, ok := object[field]; !ok {
+			errs = append(errs, validation.Error{
+				Pointer: validation.Pointer(field),
+				Rule:    "required",
+				Message: fmt.Sprintf("missing required field %q", field),
+			})
+		}
+	}
+
+	fields := make([]string, 0, len(s.Properties))
+	for field := range s.Properties {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		value, ok := object[field]
+		if !ok {
+			continue
+		}
+		if want, got := s.Properties[field], jsonType(value); got != want {
+			errs = append(errs, validation.Error{
+				Pointer: validation.Pointer(field),
+				Rule:    "type",
+				Value:   validation.Value(value),
+				Message: fmt.Sprintf("field %q must be a JSON %s, got %s", field, want, got),
+			})
+		}
+	}
+
+	return errs
+}
+
+// jsonType names the JSON type of a value produced by json.Unmarshal.
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	default:
+		return "null"
+	}
+}
+
+// warnDeprecatedSchema flags an upload against a deprecated schema version
+// with Deprecation and Warning headers and records it as a metric.
+func (a *App) warnDeprecatedSchema(response *events.APIGatewayProxyResponse, category *uploadCategory, schema *payloadSchema) {
+	response.Headers["Deprecation"] = "true"
+	response.Headers["Warning"] = fmt.Sprintf(`299 - "schema version %s of category %s is deprecated"`, schema.Version, category.Name)
+
+	a.emitMetrics(map[string]string{
+		"Category":      category.Name,
+		"SchemaVersion": schema.Version,
+	}, metric{Name: "DeprecatedSchemaUploads", Value: 1, Unit: "Count"})
+}
@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/auth"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/httpapi"
+	goredis "github.com/go-redis/redis"
+)
+
+// defaultTenant is used for callers that do not send an X-System-Code header.
+const defaultTenant = "default"
+
+// defaultConcurrencyLease is how long an in-flight request is counted against
+// its tenant when it never releases its slot (e.g. the Lambda timed out).
+const defaultConcurrencyLease = 60 * time.Second
+
+// acquireScript atomically drops expired leases, adds this request and rolls
+// the addition back if the tenant is over its cap.
+var acquireScript = goredis.NewScript(`
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+redis.call("ZADD", KEYS[1], ARGV[2], ARGV[3])
+redis.call("PEXPIRE", KEYS[1], ARGV[4])
+if redis.call("ZCARD", KEYS[1]) > tonumber(ARGV[5]) then
+	redis.call("ZREM", KEYS[1], ARGV[3])
+	return 0
+end
+return 1
+`)
+
+// tenantFromRequest is the client application the request claims to come
+// from. Clients set X-System-Code themselves, so it is only fit for logs and
+// traces; anything that routes, limits or bills uses sessionTenant.
+func tenantFromRequest(request events.APIGatewayProxyRequest) string {
+	if systemCode := httpapi.RequestHeader(request, "X-System-Code"); systemCode != "" {
+		return systemCode
+	}
+	return defaultTenant
+}
+
+// sessionTenant is the client application an authenticated request is
+// stored for. A session's own system code is trusted first, and X-System-Code
+// must agree with it so a client can't claim another tenant's buckets,
+// limits or quota. The Redis sessions written by go-db don't record a system
+// code yet, so for those sessions the header still decides, as it did before.
+func sessionTenant(request events.APIGatewayProxyRequest, session auth.Session) (string, error) {
+	claimed := httpapi.RequestHeader(request, "X-System-Code")
+	if session.SystemCode == "" {
+		if claimed != "" {
+			return claimed, nil
+		}
+		return defaultTenant, nil
+	}
+	if claimed != "" && claimed != session.SystemCode {
+		return "", fmt.Errorf("session does not belong to system code %q", claimed)
+	}
+	return session.SystemCode, nil
+}
+
+// loadConcurrencyLimits parses TENANT_CONCURRENCY_LIMITS, a JSON object of
+// system code to the maximum number of in-flight requests. The "*" entry, if
+// present, applies to tenants without their own cap.
+func (a *App) loadConcurrencyLimits() (map[string]int, error) {
+	return a.concurrencyLimits.get(func() (map[string]int, error) {
+		limits := map[string]int{}
+
+		raw := a.getenv("TENANT_CONCURRENCY_LIMITS")
+		if raw == "" {
+			return limits, nil
+		}
+
+		if err := json.Unmarshal([]byte(raw), &limits); err != nil {
+			return nil, fmt.Errorf("invalid TENANT_CONCURRENCY_LIMITS: %v", err)
+		}
+		return limits, nil
+	})
+}
+
+func (a *App) concurrencyLease() time.Duration {
+	if seconds, err := strconv.Atoi(a.getenv("TENANT_CONCURRENCY_LEASE_SECONDS")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultConcurrencyLease
+}
+
+// acquireConcurrencySlot counts the request against its tenant's cap, taken
+// once the request is authenticated so only real clients of a tenant use up
+// its slots. It returns false when the tenant is at capacity; otherwise the
+// returned release func must be called once the request has finished.
+// Limiting fails open when Redis is unavailable so it can never take uploads
+// down.
+func (a *App) acquireConcurrencySlot(tenant, requestID string) (func(), bool, error) {
+	noop := func() {}
+
+	limits, err := a.loadConcurrencyLimits()
+	if err != nil {
+		return noop, false, err
+	}
+
+	limit, ok := limits[tenant]
+	if !ok {
+		limit, ok = limits["*"]
+	}
+	client := a.Redis
+	if !ok || client == nil {
+		return noop, true, nil
+	}
+
+	key := "concurrency:" + tenant
+	now := time.Now()
+	lease := a.concurrencyLease()
+
+	acquired, err := acquireScript.Run(client, []string{key},
+		now.Add(-lease).UnixMilli(), now.UnixMilli(), requestID, lease.Milliseconds(), limit).Int()
+	if err != nil {
+		log.Printf("Skipping concurrency limit for %s: %v", tenant, err)
+		return noop, true, nil
+	}
+	if acquired == 0 {
+		return noop, false, nil
+	}
+
+	release := func() {
+		if err := client.ZRem(key, requestID).Err(); err != nil {
+			log.Printf("Unable to release concurrency slot for %s: %v", tenant, err)
+		}
+	}
+
+	return release, true, nil
+}
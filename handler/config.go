@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/httpapi"
+)
+
+// envRequirement is an environment variable the function cannot run
+// without, when the feature needing it is in use.
+type envRequirement struct {
+	name     string
+	required func(getenv func(string) string) bool
+}
+
+var requiredEnv = []envRequirement{
+	{"BUCKET_NAME", func(getenv func(string) string) bool {
+		return getenv("BUCKET_ROUTES") == "" && getenv("BUCKET_ROUTES_SECRET") == ""
+	}},
+	{"REDIS_SECRET", func(getenv func(string) string) bool {
+		devAuth, _ := strconv.ParseBool(getenv("DEV_AUTH_ENABLED"))
+		return !devAuth
+	}},
+	{"SCAN_QUEUE_URL", func(getenv func(string) string) bool { return getenv("SCANNER_MODE") == "quarantine" }},
+	{"APP_REDIS_ADDR", func(getenv func(string) string) bool { return getenv("DEDUP_MODE") == "redis" }},
+}
+
+// checkRequiredEnv names every required environment variable that is not
+// set, so a misconfigured deploy fails on its first request instead of deep
+// inside an AWS call.
+func checkRequiredEnv(getenv func(string) string) error {
+	var missing []string
+	for _, requirement := range requiredEnv {
+		if requirement.required(getenv) && getenv(requirement.name) == "" {
+			missing = append(missing, requirement.name)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required environment variables: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// misconfiguredApp answers every request with a 500 naming the
+// configuration problem found at cold start.
+func misconfiguredApp(err error) *App {
+	return &App{IDs: nanoIDs{}, configErr: err}
+}
+
+// misconfiguredResponse reports the configuration problem and counts the
+// request, so misconfigured deployments stand out from ordinary errors.
+func (a *App) misconfiguredResponse() (events.APIGatewayProxyResponse, error) {
+	a.emitMetrics(nil, metric{Name: "MisconfiguredInvocations", Value: 1, Unit: "Count"})
+	return httpapi.ErrorResponse(http.StatusInternalServerError, httpapi.WithCode(httpapi.CodeMisconfigured, a.configErr))
+}
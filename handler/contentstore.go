@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/storage"
+)
+
+// contentPointer links an upload by a user at a point in time to the
+// content-addressed object holding its payload.
+type contentPointer struct {
+	ContentKey string    `json:"content_key"`
+	SHA256     string    `json:"sha256"`
+	UserID     int64     `json:"user_id"`
+	Category   string    `json:"category"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// contentAddressedLayout reports whether STORAGE_LAYOUT=content is set, which
+// stores each unique payload once per tenant under content/ and writes a
+// small pointer object at the usual dated key, for workloads with heavy
+// duplication.
+func (a *App) contentAddressedLayout() bool {
+	return a.getenv("STORAGE_LAYOUT") == "content"
+}
+
+// contentKey is content/{tenant}/{sha256[:2]}/{sha256}.{extension} for the
+// object. Content is only shared within a tenant, so tenants neither own
+// each other's objects in the quota ledger nor learn whether another tenant
+// has stored a payload.
+func contentKey(tenant string, object storedObject) (string, string) {
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+	sum := sha256.Sum256([]byte(object.data))
+	hash := hex.EncodeToString(sum[:])
+	return fmt.Sprintf("content/%s/%s/%s.%s", tenant, hash[:2], hash, object.extension), hash
+}
+
+// storeContentAddressed uploads the object under its content key unless an
+// identical payload is already stored, then writes the pointer record as JSON
+// next to where the object would otherwise have gone. It returns the content
+// key. options apply to the content object only.
+func storeContentAddressed(ctx context.Context, uploader storage.Uploader, tenant, fileName string, pointer contentPointer, object storedObject, metadata map[string]string, options storage.ObjectOptions) (string, error) {
+	key, hash := contentKey(tenant, object)
+
+	exists, err := uploader.ObjectExists(key)
+	if err != nil {
+		return "", fmt.Errorf("unable to check for stored content: %v", err)
+	}
+	if !exists {
+		if err := uploadObject(ctx, uploader, key, object, metadata, options); err != nil {
+			return "", err
+		}
+	}
+
+	pointer.ContentKey = key
+	pointer.SHA256 = hash
+	data, err := json.Marshal(pointer)
+	if err != nil {
+		return "", err
+	}
+
+	pointerKey := strings.TrimSuffix(fileName, "."+object.extension) + ".json"
+	if err := uploader.UploadJSON(ctx, pointerKey, string(data)); err != nil {
+		return "", fmt.Errorf("unable to write content pointer: %v", err)
+	}
+
+	return key, nil
+}
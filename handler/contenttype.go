@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"strings"
+)
+
+// originalContentTypeMetadataKey records the format a converted payload was
+// sent in.
+const originalContentTypeMetadataKey = "original-content-type"
+
+var errUnsupportedContentType = errors.New("unsupported content type")
+
+// canonicalJSON converts form and CSV bodies sent by older devices into a
+// JSON document, returning it with the media type it was converted from.
+// JSON bodies, and bodies without a Content-Type, are returned unchanged
+// with an empty media type.
+func canonicalJSON(body, contentType string, base64Encoded bool) (string, string, error) {
+	if contentType == "" {
+		return body, "", nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %v", errUnsupportedContentType, err)
+	}
+
+	if mediaType == "application/json" {
+		return body, "", nil
+	}
+
+	if base64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid base64 body: %v", err)
+		}
+		body = string(decoded)
+	}
+
+	var document interface{}
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		document, err = formToJSON(body)
+	case "text/csv":
+		document, err = csvToJSON(body)
+	default:
+		return "", "", fmt.Errorf("%w %q", errUnsupportedContentType, mediaType)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	converted, err := json.Marshal(document)
+	if err != nil {
+		return "", "", err
+	}
+
+	return string(converted), mediaType, nil
+}
+
+// formToJSON turns a form body into an object, with repeated fields as
+// arrays of strings.
+func formToJSON(body string) (interface{}, error) {
+	values, err := url.ParseQuery(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid form body: %v", err)
+	}
+
+	document := make(map[string]interface{}, len(values))
+	for field, value := range values {
+		if len(value) == 1 {
+			document[field] = value[0]
+		} else {
+			document[field] = value
+		}
+	}
+	return document, nil
+}
+
+// csvToJSON turns a CSV body with a header row into an array of objects.
+func csvToJSON(body string) (interface{}, error) {
+	records, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV body: %v", err)
+	}
+	if len(records) == 0 {
+		return nil, errors.New("invalid CSV body: missing header row")
+	}
+
+	header := records[0]
+	rows := make([]map[string]string, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]string, len(header))
+		for i, column := range header {
+			row[column] = record[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
@@ -0,0 +1,295 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamotypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/storage"
+	goredis "github.com/go-redis/redis"
+)
+
+const (
+	// defaultDedupTTL is how long an upload is remembered for deduplication.
+	defaultDedupTTL = 24 * time.Hour
+
+	// dedupObjectKeyMetadata holds the deduplicated object's key on the
+	// marker objects written in s3 mode.
+	dedupObjectKeyMetadata = "object-key"
+
+	// dedupClaimTTL is how long a claim taken before storing a payload
+	// blocks identical uploads if the request never finalizes or releases
+	// it, e.g. because the Lambda timed out.
+	dedupClaimTTL = 5 * time.Minute
+)
+
+// dedupStore remembers which object key a payload was stored under.
+type dedupStore interface {
+	lookup(id string) (string, bool, error)
+	remember(id, key string) error
+}
+
+// dedupClaimer is a dedupStore that can reserve a payload before it is
+// stored, so two identical requests racing past lookup cannot both upload
+// it. remember finalizes a claim with the stored key.
+type dedupClaimer interface {
+	dedupStore
+	// claim reserves id for the request identified by token. When another
+	// request holds it, claimed is false and key is the object already
+	// stored for it, or "" if that upload is still in progress.
+	claim(id, token string) (key string, claimed bool, err error)
+	// release gives up a claim that was never finalized.
+	release(id, token string) error
+}
+
+// dedupResult is returned instead of uploading a byte-identical payload again.
+type dedupResult struct {
+	Key          string `json:"key"`
+	Deduplicated bool   `json:"deduplicated"`
+}
+
+// dedupID identifies a payload by the SHA-256 of its body, scoped to the
+// category and user so identical documents from different users are kept.
+func dedupID(category, user, body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return fmt.Sprintf("%s/%s/%s", category, user, hex.EncodeToString(sum[:]))
+}
+
+func (a *App) dedupTTL() time.Duration {
+	if seconds, err := strconv.Atoi(a.getenv("DEDUP_TTL_SECONDS")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultDedupTTL
+}
+
+// dedupStoreFor returns the store selected by DEDUP_MODE ("redis", "s3" or
+// "dynamodb"), or nil when deduplication is off.
+func (a *App) dedupStoreFor(uploader storage.Uploader) (dedupStore, error) {
+	switch mode := a.getenv("DEDUP_MODE"); mode {
+	case "":
+		return nil, nil
+	case "redis":
+		client := a.Redis
+		if client == nil {
+			return nil, errors.New("DEDUP_MODE=redis requires APP_REDIS_ADDR")
+		}
+		return &redisDedupStore{client: client, ttl: a.dedupTTL()}, nil
+	case "s3":
+		s3Uploader, err := asS3Uploader(uploader)
+		if err != nil {
+			return nil, err
+		}
+		return &s3DedupStore{uploader: s3Uploader}, nil
+	case "dynamodb":
+		table := a.getenv("DEDUP_TABLE")
+		if table == "" {
+			return nil, errors.New("DEDUP_MODE=dynamodb requires DEDUP_TABLE")
+		}
+		client, err := a.dynamoDBClient()
+		if err != nil {
+			return nil, err
+		}
+		return &dynamoDedupStore{client: client, table: table, ttl: a.dedupTTL()}, nil
+	default:
+		return nil, fmt.Errorf("invalid DEDUP_MODE %q", mode)
+	}
+}
+
+// redisDedupStore keeps content hashes in Redis with a TTL.
+type redisDedupStore struct {
+	client *goredis.Client
+	ttl    time.Duration
+}
+
+func (r *redisDedupStore) lookup(id string) (string, bool, error) {
+	key, err := r.client.Get("dedup:" + id).Result()
+	if err == goredis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return key, true, nil
+}
+
+func (r *redisDedupStore) remember(id, key string) error {
+	return r.client.Set("dedup:"+id, key, r.ttl).Err()
+}
+
+// s3DedupStore keeps an empty marker object per content hash under dedup/,
+// carrying the stored object's key in its metadata.
+type s3DedupStore struct {
+	uploader *storage.S3Uploader
+}
+
+func (s *s3DedupStore) lookup(id string) (string, bool, error) {
+	output, err := s.uploader.Client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(s.uploader.Bucket),
+		Key:    aws.String("dedup/" + id),
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	key, ok := output.Metadata[dedupObjectKeyMetadata]
+	return key, ok, nil
+}
+
+func (s *s3DedupStore) remember(id, key string) error {
+	return s.uploader.UploadObject("dedup/"+id, "", "application/octet-stream", map[string]string{
+		dedupObjectKeyMetadata: key,
+	})
+}
+
+var (
+	dynamoDBOnce   sync.Once
+	dynamoDBClient *dynamodb.Client
+	dynamoDBErr    error
+)
+
+// DynamoDBAPI is the part of the DynamoDB client used to keep
+// deduplication records.
+type DynamoDBAPI interface {
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+}
+
+func getDynamoDBClient() (*dynamodb.Client, error) {
+	dynamoDBOnce.Do(func() {
+		cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion("eu-west-2"))
+		if err != nil {
+			dynamoDBErr = fmt.Errorf("unable to load AWS config: %v", err)
+			return
+		}
+		dynamoDBClient = dynamodb.NewFromConfig(cfg)
+	})
+
+	return dynamoDBClient, dynamoDBErr
+}
+
+func (a *App) dynamoDBClient() (DynamoDBAPI, error) {
+	if a.DynamoDB == nil {
+		return nil, errors.New("no DynamoDB client is configured")
+	}
+	return a.DynamoDB()
+}
+
+// dynamoDedupStore keeps content hashes in a DynamoDB table keyed on "id",
+// which survives Redis flushes and needs no ElastiCache. The table's TTL
+// attribute should be "expires_at"; since DynamoDB deletes expired items
+// lazily, lookup ignores them itself.
+type dynamoDedupStore struct {
+	client DynamoDBAPI
+	table  string
+	ttl    time.Duration
+}
+
+func (d *dynamoDedupStore) lookup(id string) (string, bool, error) {
+	output, err := d.client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName:      aws.String(d.table),
+		Key:            map[string]dynamotypes.AttributeValue{"id": &dynamotypes.AttributeValueMemberS{Value: id}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return "", false, err
+	}
+
+	key, ok := output.Item["object_key"].(*dynamotypes.AttributeValueMemberS)
+	if !ok {
+		return "", false, nil
+	}
+	if expiresAt, ok := output.Item["expires_at"].(*dynamotypes.AttributeValueMemberN); ok {
+		if seconds, err := strconv.ParseInt(expiresAt.Value, 10, 64); err == nil && seconds <= time.Now().Unix() {
+			return "", false, nil
+		}
+	}
+	return key.Value, true, nil
+}
+
+// claim writes a pending item for the payload with a conditional PutItem,
+// which fails if a live item, pending or finalized, is already there.
+func (d *dynamoDedupStore) claim(id, token string) (string, bool, error) {
+	now := time.Now()
+	_, err := d.client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(d.table),
+		Item: map[string]dynamotypes.AttributeValue{
+			"id":         &dynamotypes.AttributeValueMemberS{Value: id},
+			"claim":      &dynamotypes.AttributeValueMemberS{Value: token},
+			"expires_at": &dynamotypes.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(dedupClaimTTL).Unix(), 10)},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(id) OR expires_at <= :now"),
+		ExpressionAttributeValues: map[string]dynamotypes.AttributeValue{
+			":now": &dynamotypes.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	})
+
+	var exists *dynamotypes.ConditionalCheckFailedException
+	if errors.As(err, &exists) {
+		key, _, err := d.lookup(id)
+		return key, false, err
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return "", true, nil
+}
+
+// remember finalizes the claim with the stored key and the full TTL. If
+// another request's record replaced an expired claim in the meantime, that
+// record is kept so concurrent retries agree on one object.
+func (d *dynamoDedupStore) remember(id, key string) error {
+	now := time.Now()
+	_, err := d.client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(d.table),
+		Item: map[string]dynamotypes.AttributeValue{
+			"id":         &dynamotypes.AttributeValueMemberS{Value: id},
+			"object_key": &dynamotypes.AttributeValueMemberS{Value: key},
+			"expires_at": &dynamotypes.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(d.ttl).Unix(), 10)},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(object_key) OR expires_at <= :now"),
+		ExpressionAttributeValues: map[string]dynamotypes.AttributeValue{
+			":now": &dynamotypes.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	})
+
+	var exists *dynamotypes.ConditionalCheckFailedException
+	if errors.As(err, &exists) {
+		return nil
+	}
+	return err
+}
+
+// release deletes the pending item, as long as it is still this request's
+// claim, so a retry of a failed upload is not turned away.
+func (d *dynamoDedupStore) release(id, token string) error {
+	_, err := d.client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName:           aws.String(d.table),
+		Key:                 map[string]dynamotypes.AttributeValue{"id": &dynamotypes.AttributeValueMemberS{Value: id}},
+		ConditionExpression: aws.String("claim = :token AND attribute_not_exists(object_key)"),
+		ExpressionAttributeValues: map[string]dynamotypes.AttributeValue{
+			":token": &dynamotypes.AttributeValueMemberS{Value: token},
+		},
+	})
+
+	var gone *dynamotypes.ConditionalCheckFailedException
+	if errors.As(err, &gone) {
+		return nil
+	}
+	return err
+}
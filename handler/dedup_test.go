@@ -0,0 +1,231 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamotypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeDynamoDB is an in-memory table keyed on "id" that evaluates the
+// condition expressions dynamoDedupStore uses.
+type fakeDynamoDB struct {
+	mu    sync.Mutex
+	items map[string]map[string]dynamotypes.AttributeValue
+}
+
+func newFakeDynamoDB() *fakeDynamoDB {
+	return &fakeDynamoDB{items: map[string]map[string]dynamotypes.AttributeValue{}}
+}
+
+func stringAttribute(item map[string]dynamotypes.AttributeValue, name string) (string, bool) {
+	value, ok := item[name].(*dynamotypes.AttributeValueMemberS)
+	if !ok {
+		return "", false
+	}
+	return value.Value, true
+}
+
+func numberAttribute(item map[string]dynamotypes.AttributeValue, name string) int64 {
+	value, ok := item[name].(*dynamotypes.AttributeValueMemberN)
+	if !ok {
+		return 0
+	}
+	n, _ := strconv.ParseInt(value.Value, 10, 64)
+	return n
+}
+
+func (f *fakeDynamoDB) check(condition string, item map[string]dynamotypes.AttributeValue, values map[string]dynamotypes.AttributeValue) (bool, error) {
+	expired := item != nil && numberAttribute(item, "expires_at") <= numberAttribute(values, ":now")
+	_, hasKey := stringAttribute(item, "object_key")
+	switch condition {
+	case "":
+		return true, nil
+	case "attribute_not_exists(id) OR expires_at <= :now":
+		return item == nil || expired, nil
+	case "attribute_not_exists(object_key) OR expires_at <= :now":
+		return !hasKey || expired, nil
+	case "claim = :token AND attribute_not_exists(object_key)":
+		claim, _ := stringAttribute(item, "claim")
+		token, _ := stringAttribute(values, ":token")
+		return item != nil && claim == token && !hasKey, nil
+	default:
+		return false, fmt.Errorf("fakeDynamoDB does not understand %q", condition)
+	}
+}
+
+func (f *fakeDynamoDB) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id, _ := stringAttribute(params.Key, "id")
+	return &dynamodb.GetItemOutput{Item: f.items[id]}, nil
+}
+
+func (f *fakeDynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id, _ := stringAttribute(params.Item, "id")
+	ok, err := f.check(aws.ToString(params.ConditionExpression), f.items[id], params.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, &dynamotypes.ConditionalCheckFailedException{}
+	}
+	f.items[id] = params.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id, _ := stringAttribute(params.Key, "id")
+	ok, err := f.check(aws.ToString(params.ConditionExpression), f.items[id], params.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, &dynamotypes.ConditionalCheckFailedException{}
+	}
+	delete(f.items, id)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// expire moves the item's expiry into the past, as if its TTL had run out
+// before DynamoDB got round to deleting it.
+func (f *fakeDynamoDB) expire(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.items[id]["expires_at"] = &dynamotypes.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10)}
+}
+
+func TestDynamoDedupClaim(t *testing.T) {
+	const id = "sleep/7/abc"
+
+	tests := []struct {
+		name string
+		// setup runs against the store and table before the claim.
+		setup       func(t *testing.T, store *dynamoDedupStore, table *fakeDynamoDB)
+		wantClaimed bool
+		wantKey     string
+	}{
+		{
+			name:        "unclaimed",
+			setup:       func(t *testing.T, store *dynamoDedupStore, table *fakeDynamoDB) {},
+			wantClaimed: true,
+		},
+		{
+			name: "claimed by an upload in progress",
+			setup: func(t *testing.T, store *dynamoDedupStore, table *fakeDynamoDB) {
+				mustClaim(t, store, id, "first")
+			},
+		},
+		{
+			name: "already stored",
+			setup: func(t *testing.T, store *dynamoDedupStore, table *fakeDynamoDB) {
+				mustClaim(t, store, id, "first")
+				if err := store.remember(id, "sleep/2026/1/2/first.json"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantKey: "sleep/2026/1/2/first.json",
+		},
+		{
+			name: "released by its owner",
+			setup: func(t *testing.T, store *dynamoDedupStore, table *fakeDynamoDB) {
+				mustClaim(t, store, id, "first")
+				if err := store.release(id, "first"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantClaimed: true,
+		},
+		{
+			name: "released by another request",
+			setup: func(t *testing.T, store *dynamoDedupStore, table *fakeDynamoDB) {
+				mustClaim(t, store, id, "first")
+				if err := store.release(id, "second"); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "released after it was stored",
+			setup: func(t *testing.T, store *dynamoDedupStore, table *fakeDynamoDB) {
+				mustClaim(t, store, id, "first")
+				if err := store.remember(id, "sleep/2026/1/2/first.json"); err != nil {
+					t.Fatal(err)
+				}
+				if err := store.release(id, "first"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantKey: "sleep/2026/1/2/first.json",
+		},
+		{
+			name: "abandoned claim expired",
+			setup: func(t *testing.T, store *dynamoDedupStore, table *fakeDynamoDB) {
+				mustClaim(t, store, id, "first")
+				table.expire(id)
+			},
+			wantClaimed: true,
+		},
+		{
+			name: "stored record expired",
+			setup: func(t *testing.T, store *dynamoDedupStore, table *fakeDynamoDB) {
+				mustClaim(t, store, id, "first")
+				if err := store.remember(id, "sleep/2026/1/2/first.json"); err != nil {
+					t.Fatal(err)
+				}
+				table.expire(id)
+			},
+			wantClaimed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := newFakeDynamoDB()
+			store := &dynamoDedupStore{client: table, table: "dedup", ttl: time.Hour}
+			tt.setup(t, store, table)
+
+			key, claimed, err := store.claim(id, "second")
+			if err != nil {
+				t.Fatalf("claim() error = %v", err)
+			}
+			if claimed != tt.wantClaimed || key != tt.wantKey {
+				t.Errorf("claim() = %q, %v, want %q, %v", key, claimed, tt.wantKey, tt.wantClaimed)
+			}
+		})
+	}
+}
+
+func mustClaim(t *testing.T, store *dynamoDedupStore, id, token string) {
+	t.Helper()
+	if _, claimed, err := store.claim(id, token); err != nil || !claimed {
+		t.Fatalf("claim(%q) = %v, %v, want a claim", token, claimed, err)
+	}
+}
+
+func TestDynamoDedupRememberKeepsTheFirstKey(t *testing.T) {
+	const id = "sleep/7/abc"
+	store := &dynamoDedupStore{client: newFakeDynamoDB(), table: "dedup", ttl: time.Hour}
+
+	mustClaim(t, store, id, "first")
+	for _, key := range []string{"sleep/first.json", "sleep/second.json"} {
+		if err := store.remember(id, key); err != nil {
+			t.Fatalf("remember(%q) error = %v", key, err)
+		}
+	}
+
+	key, found, err := store.lookup(id)
+	if err != nil || !found || key != "sleep/first.json" {
+		t.Errorf("lookup() = %q, %v, %v, want sleep/first.json", key, found, err)
+	}
+}
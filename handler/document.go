@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/httpapi"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/storage"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/validation"
+)
+
+// uploadDocument is one JSON document on its way to S3, with what the
+// request says about where it goes.
+type uploadDocument struct {
+	uploader      storage.Uploader
+	category      *uploadCategory
+	schemaVersion string
+	tenant        string
+	requestID     string
+	userID        int64
+	payload       string
+
+	// appVersion is what the request says about the client, for the
+	// enrich stage.
+	appVersion string
+
+	// contentType and base64Encoded describe the payload as sent, for
+	// the decode stage.
+	contentType   string
+	base64Encoded bool
+
+	// keySuffix tells apart documents from the same user stored in the
+	// same second, as in a batch.
+	keySuffix string
+
+	// name, when set, stores the document at the user's stable key for it
+	// rather than a dated one, provided condition holds.
+	name      string
+	condition storage.Precondition
+
+	// options are the request's feature-flagged behaviours, evaluated
+	// once for all of its documents.
+	options uploadOptions
+}
+
+// storedDocument records what was written for a document, and where.
+type storedDocument struct {
+	// key is the object holding the document, its content key under the
+	// content-addressed layout.
+	key string
+	// fileName is the upload's dated key.
+	fileName   string
+	body       string
+	object     storedObject
+	metadata   map[string]string
+	schema     *payloadSchema
+	uploadedAt time.Time
+	// etag is the new ETag of a named document.
+	etag string
+	// executionARN is the post-processing execution started for it, if any.
+	executionARN string
+}
+
+// errPayloadInvalid stands in for a failure's validation errors.
+var errPayloadInvalid = errors.New("payload failed validation")
+
+// uploadFailure is why a document was not stored.
+type uploadFailure struct {
+	status        int
+	err           error
+	errs          validation.Errors
+	quarantineKey string
+	// etag is the named document's current ETag when a condition failed.
+	etag string
+	// key is where the document was stored when a step after the upload
+	// failed.
+	key string
+}
+
+func failed(status int, err error) *uploadFailure {
+	return &uploadFailure{status: status, err: err}
+}
+
+func invalid(status int, errs validation.Errors, quarantineKey string) *uploadFailure {
+	return &uploadFailure{status: status, err: errPayloadInvalid, errs: errs, quarantineKey: quarantineKey}
+}
+
+// workflowFailed is the failure for a document stored at key whose
+// post-processing could not be started. The object is kept, so the client
+// is told where it is rather than asked to upload it again.
+func workflowFailed(key string, err error) *uploadFailure {
+	return &uploadFailure{status: http.StatusBadGateway, err: httpapi.WithCode(httpapi.CodeWorkflowFailed, err), key: key}
+}
+
+func (f *uploadFailure) response() (events.APIGatewayProxyResponse, error) {
+	if f.errs != nil {
+		return httpapi.QuarantinedErrorResponse(f.status, f.errs, f.quarantineKey)
+	}
+	response, err := httpapi.StoredErrorResponse(f.status, f.err, f.key)
+	if f.etag != "" {
+		response.Headers["ETag"] = f.etag
+	}
+	return response, err
+}
+
+// body is the failure as it appears in an error envelope.
+func (f *uploadFailure) body() *httpapi.ErrorBody {
+	if f.errs != nil {
+		return &httpapi.ErrorBody{Code: httpapi.CodePayloadInvalid, Message: f.err.Error(), Errors: f.errs, QuarantineKey: f.quarantineKey}
+	}
+	return &httpapi.ErrorBody{Code: httpapi.CodeFor(f.status, f.err), Message: f.err.Error(), Key: f.key}
+}
+
+// storeDocument runs one document through its category's pipeline. timer
+// may be nil when stage timings are not wanted. A failure with a key comes
+// with what was stored.
+func (a *App) storeDocument(ctx context.Context, doc uploadDocument, timer *stageTimer) (storedDocument, *uploadFailure) {
+	state := &pipelineDocument{uploadDocument: doc, timer: timer}
+	if failure := a.runPipeline(ctx, state); failure != nil {
+		if failure.key == "" {
+			return storedDocument{}, failure
+		}
+		return state.stored, failure
+	}
+	return state.stored, nil
+}
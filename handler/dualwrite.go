@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/storage"
+)
+
+// defaultSecondaryWriteTimeout is how long a request waits for the DR copy
+// before returning without it.
+const defaultSecondaryWriteTimeout = 2 * time.Second
+
+// newSecondaryUploader returns the uploader for SECONDARY_BUCKET_NAME in
+// SECONDARY_REGION, or nil when dual-write is not configured.
+func (a *App) newSecondaryUploader() (storage.Uploader, error) {
+	bucket := a.getenv("SECONDARY_BUCKET_NAME")
+	if bucket == "" {
+		return nil, nil
+	}
+
+	region := a.getenv("SECONDARY_REGION")
+	if region == "" {
+		return nil, fmt.Errorf("SECONDARY_REGION must be set with SECONDARY_BUCKET_NAME")
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load AWS config: %v", err)
+	}
+	return &storage.S3Uploader{Client: s3.NewFromConfig(cfg, storage.S3Options(a.getenv)), Bucket: bucket, Getenv: a.getenv}, nil
+}
+
+// secondaryUploader returns the DR uploader, nil when the App has none.
+func (a *App) secondaryUploader() (storage.Uploader, error) {
+	if a.SecondaryUploader == nil {
+		return nil, nil
+	}
+	return a.SecondaryUploader()
+}
+
+func (a *App) secondaryWriteTimeout() time.Duration {
+	if ms, err := strconv.Atoi(a.getenv("SECONDARY_WRITE_TIMEOUT_MS")); err == nil && ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return defaultSecondaryWriteTimeout
+}
+
+// replicateToSecondary starts copying an uploaded object to the secondary
+// bucket in the background. Failures are reported as metrics and never fail
+// the request. The returned func waits, for at most
+// SECONDARY_WRITE_TIMEOUT_MS, for the copy to finish; it must be called
+// before the handler returns since Lambda freezes the sandbox afterwards.
+func (a *App) replicateToSecondary(key string, object storedObject, metadata map[string]string) func() {
+	uploader, err := a.secondaryUploader()
+	if err != nil {
+		log.Printf("Skipping secondary write of %s: %v", key, err)
+		a.emitMetrics(nil, metric{Name: "SecondaryWriteFailures", Value: 1, Unit: "Count"})
+		return func() {}
+	}
+	if uploader == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		defer close(done)
+
+		start := time.Now()
+		if err := uploader.UploadObject(key, object.data, object.contentType, metadata); err != nil {
+			log.Printf("Secondary write of %s failed: %v", key, err)
+			a.emitMetrics(nil, metric{Name: "SecondaryWriteFailures", Value: 1, Unit: "Count"})
+			return
+		}
+		a.emitMetrics(nil, metric{Name: "SecondaryWriteLatency", Value: float64(time.Since(start).Milliseconds()), Unit: "Milliseconds"})
+	}()
+
+	return func() {
+		select {
+		case <-done:
+		case <-time.After(a.secondaryWriteTimeout()):
+			log.Printf("Secondary write of %s did not finish in time", key)
+			a.emitMetrics(nil, metric{Name: "SecondaryWriteTimeouts", Value: 1, Unit: "Count"})
+		}
+	}
+}
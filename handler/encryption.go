@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/fieldcrypt"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/receipt"
+)
+
+var (
+	kmsOnce   sync.Once
+	kmsClient *kms.Client
+	kmsErr    error
+)
+
+// KMSAPI is the part of the KMS client used to encrypt fields and sign
+// upload receipts.
+type KMSAPI interface {
+	fieldcrypt.KMSAPI
+	receipt.KMSAPI
+}
+
+func getKMSClient() (*kms.Client, error) {
+	kmsOnce.Do(func() {
+		cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion("eu-west-2"))
+		if err != nil {
+			kmsErr = fmt.Errorf("unable to load AWS config: %v", err)
+			return
+		}
+		kmsClient = kms.NewFromConfig(cfg)
+	})
+
+	return kmsClient, kmsErr
+}
+
+func (a *App) kmsClient() (KMSAPI, error) {
+	if a.KMS == nil {
+		return nil, errors.New("no KMS client is configured")
+	}
+	return a.KMS()
+}
+
+// encryptFields encrypts the category's encrypted_fields with a KMS data key
+// from FIELD_ENCRYPTION_KMS_KEY_ID, returning the rewritten body and the
+// object metadata carrying the encrypted data key.
+func (a *App) encryptFields(ctx context.Context, category *uploadCategory, body string) (string, map[string]string, error) {
+	if len(category.EncryptedFields) == 0 {
+		return body, nil, nil
+	}
+
+	keyID := a.getenv("FIELD_ENCRYPTION_KMS_KEY_ID")
+	if keyID == "" {
+		return "", nil, errors.New("FIELD_ENCRYPTION_KMS_KEY_ID is not set")
+	}
+
+	client, err := a.kmsClient()
+	if err != nil {
+		return "", nil, err
+	}
+
+	encrypted, encryptedKey, err := fieldcrypt.Encrypt(ctx, client, keyID, []byte(body), category.EncryptedFields)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to encrypt fields: %v", err)
+	}
+
+	return string(encrypted), map[string]string{fieldcrypt.MetadataKey: encryptedKey}, nil
+}
@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// enrichmentField is the top-level field server-trusted metadata is stored
+// under in the document.
+const enrichmentField = "_meta"
+
+// ENRICHMENT_MODE values.
+const (
+	enrichmentBody     = "body"
+	enrichmentMetadata = "metadata"
+)
+
+// enrichment is what the server vouches for about an upload, for analytics
+// that can't trust the client's own account of it. The client's IP address
+// is left out: it is personal data that PII redaction doesn't cover.
+type enrichment struct {
+	UserID     int64     `json:"user_id"`
+	ReceivedAt time.Time `json:"received_at"`
+	RequestID  string    `json:"request_id"`
+	AppVersion string    `json:"app_version,omitempty"`
+	SystemCode string    `json:"system_code,omitempty"`
+}
+
+// enrichmentMode is ENRICHMENT_MODE: "body" stores the enrichment as _meta
+// in the document, "metadata" as object metadata, and anything else turns
+// enrichment off.
+func (a *App) enrichmentMode() string {
+	switch mode := a.getenv("ENRICHMENT_MODE"); mode {
+	case enrichmentBody, enrichmentMetadata:
+		return mode
+	default:
+		return ""
+	}
+}
+
+// enrichStage adds server-trusted metadata to the document. Whatever the
+// client sent as _meta is dropped first, so it can never pass for ours.
+// Documents that aren't objects can't hold _meta and are enriched through
+// object metadata instead.
+func enrichStage(ctx context.Context, a *App, doc *pipelineDocument) *uploadFailure {
+	mode := a.enrichmentMode()
+	if mode == "" {
+		return nil
+	}
+
+	meta := enrichment{
+		UserID:     doc.userID,
+		ReceivedAt: a.Clock.Now().UTC(),
+		RequestID:  doc.requestID,
+		AppVersion: doc.appVersion,
+	}
+	if doc.tenant != defaultTenant {
+		meta.SystemCode = doc.tenant
+	}
+
+	// The parsed payload is enough to tell whether the document needs
+	// rewriting; only a rewrite decodes it again, keeping each field's raw
+	// JSON so numbers are not rounded through float64
+	parsed, err := doc.parsedPayload()
+	object, isObject := parsed.(map[string]interface{})
+	if err != nil || !isObject {
+		doc.setEnrichmentMetadata(meta)
+		return nil
+	}
+	_, clientSent := object[enrichmentField]
+	if mode == enrichmentMetadata {
+		doc.setEnrichmentMetadata(meta)
+		if !clientSent {
+			return nil
+		}
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(doc.payload), &fields); err != nil {
+		return failed(http.StatusInternalServerError, err)
+	}
+	delete(fields, enrichmentField)
+	if mode == enrichmentBody {
+		encoded, err := json.Marshal(meta)
+		if err != nil {
+			return failed(http.StatusInternalServerError, err)
+		}
+		fields[enrichmentField] = encoded
+	}
+
+	enriched, err := json.Marshal(fields)
+	if err != nil {
+		return failed(http.StatusInternalServerError, err)
+	}
+	doc.setPayload(string(enriched))
+	return nil
+}
+
+func (doc *pipelineDocument) setEnrichmentMetadata(meta enrichment) {
+	doc.setMetadata("meta-user-id", strconv.FormatInt(meta.UserID, 10))
+	doc.setMetadata("meta-received-at", meta.ReceivedAt.Format(time.RFC3339))
+	doc.setMetadata("meta-request-id", meta.RequestID)
+	if meta.AppVersion != "" {
+		doc.setMetadata("meta-app-version", meta.AppVersion)
+	}
+	if meta.SystemCode != "" {
+		doc.setMetadata("meta-system-code", meta.SystemCode)
+	}
+}
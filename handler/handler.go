@@ -0,0 +1,329 @@
+// Package handler answers the upload function's API Gateway, S3 event and
+// scheduled invocations. It is importable so other code can embed the
+// Handler and run it against in-memory dependencies; see App.
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/auth"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/httpapi"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// serveLocal is set by builds with the localdev tag.
+var serveLocal func(*App) error
+
+// Handler answers upload requests from API Gateway.
+func (a *App) Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+
+	log.Printf("Handling request: %s\n", request.Resource)
+
+	requestID := request.RequestContext.RequestID
+	if requestID == "" {
+		requestID = a.IDs.NewID()
+	}
+
+	ctx, span := tracer().Start(ctx, request.HTTPMethod+" "+request.Resource, trace.WithAttributes(
+		attribute.String("request_id", requestID),
+		attribute.String("Tenant", tenantFromRequest(request)),
+	))
+	defer flushTelemetry(ctx)
+	defer span.End()
+
+	started := time.Now()
+	response, err := a.handle(ctx, request, requestID)
+	a.logRequest(ctx, request, response, requestID, started)
+	span.SetAttributes(attribute.Int("http.status_code", response.StatusCode))
+	if response.StatusCode >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(response.StatusCode))
+	}
+
+	return httpapi.Compress(a.getenv, request, httpapi.WithRequestID(response, requestID)), err
+}
+
+func (a *App) handle(ctx context.Context, request events.APIGatewayProxyRequest, requestID string) (events.APIGatewayProxyResponse, error) {
+	if a.configErr != nil {
+		return a.misconfiguredResponse()
+	}
+
+	// answer routes the function doesn't serve before anything else
+	if !a.resourceAllowed(request) {
+		return httpapi.ErrorResponse(http.StatusNotFound, fmt.Errorf("unknown resource %q", request.Resource))
+	}
+
+	// report dependency health to synthetic monitors, without auth
+	if request.HTTPMethod == http.MethodGet && request.Resource == "/health" {
+		return a.healthResponse(ctx)
+	}
+
+	// answer scheduler warm-up pings routed through API Gateway before auth
+	if len(httpapi.RequestHeader(request, "Authorization")) == 0 && a.isWarmup([]byte(request.Body)) {
+		return a.warmUp(ctx)
+	}
+
+	// turn away everyone but allow-listed callers during maintenance
+	if a.inMaintenance() && !a.maintenanceAllowed(request) {
+		return a.maintenanceResponse()
+	}
+
+	// check whether this route has been switched off
+	switches, err := a.killSwitches()
+	if err != nil {
+		return httpapi.ErrorResponse(http.StatusInternalServerError, err)
+	}
+	if message, disabled := switches.disabled(request.HTTPMethod, request.Resource); disabled {
+		return httpapi.ErrorResponse(http.StatusServiceUnavailable, errors.New(message))
+	}
+
+	// check authorization
+	if len(httpapi.RequestHeader(request, "Authorization")) == 0 {
+		return httpapi.ErrorResponse(http.StatusUnauthorized, httpapi.WithCode(httpapi.CodeAuthMissing, errors.New("authentication token is missing")))
+	}
+
+	// record how long each stage takes against its latency budget
+	timer := newStageTimer(ctx)
+	defer timer.report(a.loadStageBudgets())
+
+	// get session from auth token, includes userID
+	session, err := a.Sessions.GetSession(ctx, httpapi.RequestHeader(request, "Authorization"))
+	if errors.Is(err, auth.ErrInvalidSession) {
+		return httpapi.ErrorResponse(http.StatusUnauthorized, err)
+	}
+	if errors.Is(err, auth.ErrTimeout) {
+		return httpapi.ErrorResponse(http.StatusServiceUnavailable, httpapi.WithCode(httpapi.CodeUpstreamRedis, err))
+	}
+	if err != nil {
+		return httpapi.ErrorResponse(http.StatusInternalServerError, err)
+	}
+	timer.mark("auth")
+
+	log.Printf("Printing UserID: %v", session.UserID)
+
+	// the tenant comes from the session, never from the client alone
+	tenant, err := sessionTenant(request, session)
+	if err != nil {
+		return httpapi.ErrorResponse(http.StatusForbidden, err)
+	}
+
+	// stop one client app from using up all of the function's concurrency
+	release, acquired, err := a.acquireConcurrencySlot(tenant, requestID)
+	if err != nil {
+		return httpapi.ErrorResponse(http.StatusInternalServerError, err)
+	}
+	if !acquired {
+		return httpapi.ErrorResponse(http.StatusTooManyRequests, errors.New("too many concurrent requests for this client"))
+	}
+	defer release()
+
+	if request.HTTPMethod == http.MethodGet && request.Resource == "/capabilities" {
+		return a.capabilitiesResponse(tenant)
+	}
+
+	// batches are held to the limit document by document
+	if !isBatchRoute(request) && len(request.Body) > a.maxPayloadBytes() {
+		return httpapi.ErrorResponse(http.StatusRequestEntityTooLarge, fmt.Errorf("payload exceeds %d bytes", a.maxPayloadBytes()))
+	}
+
+	// Resolve the upload category from the path, if the route has one
+	category, err := a.lookupCategory(requestCategory(request))
+	if err != nil {
+		return httpapi.ErrorResponse(http.StatusInternalServerError, err)
+	}
+	if category == nil {
+		return httpapi.ErrorResponse(http.StatusNotFound, fmt.Errorf("unknown upload category %q", requestCategory(request)))
+	}
+	if !a.payloadTypeAllowed(category) {
+		return httpapi.ErrorResponse(http.StatusBadRequest, fmt.Errorf("%s documents are not accepted by this deployment", category.Name))
+	}
+
+	// Create an uploader for the bucket this upload is routed to
+	bucketName, err := a.resolveBucket(a.Secrets, tenant, category.Name)
+	if err != nil {
+		return httpapi.ErrorResponse(500, err)
+	}
+	uploader, err := a.NewUploader(tenant, bucketName)
+	if err != nil {
+		return httpapi.ErrorResponse(500, err)
+	}
+
+	// Very large files go straight to S3 through presigned multipart uploads
+	if isMultipartRoute(request) {
+		s3Uploader, err := asS3Uploader(uploader)
+		if err != nil {
+			return httpapi.ErrorResponse(http.StatusInternalServerError, err)
+		}
+		return a.multipartResponse(ctx, request, s3Uploader, category, tenant, session.UserID)
+	}
+
+	// Batches validate and upload each document on its own
+	if isBatchRoute(request) {
+		return a.batchResponse(ctx, request, uploader, category, tenant, requestID, session.UserID)
+	}
+
+	// Named documents are overwritten in place, if they are as the client
+	// last saw them
+	var name string
+	var condition storage.Precondition
+	if isDocumentRoute(request) {
+		if name, err = documentName(request); err != nil {
+			return httpapi.ErrorResponse(http.StatusBadRequest, err)
+		}
+		if condition, err = requestPrecondition(request); err != nil {
+			return httpapi.ErrorResponse(http.StatusBadRequest, err)
+		}
+	}
+
+	// Skip re-uploading a document a client retried byte for byte
+	dedup, err := a.dedupStoreFor(uploader)
+	if err != nil {
+		return httpapi.ErrorResponse(http.StatusInternalServerError, err)
+	}
+	if name != "" {
+		// rewriting a named document with the same content is deliberate
+		dedup = nil
+	}
+	contentID := dedupID(category.Name, fmt.Sprint(session.UserID), request.Body)
+	if claimer, ok := dedup.(dedupClaimer); ok {
+		// Claim the payload before storing it so an identical request
+		// racing this one is answered instead of uploading it again
+		existing, claimed, err := claimer.claim(contentID, requestID)
+		switch {
+		case err != nil:
+			log.Printf("Skipping deduplication: %v", err)
+			dedup = nil
+		case !claimed && existing != "":
+			return httpapi.JSONResponse(http.StatusOK, dedupResult{Key: existing, Deduplicated: true})
+		case !claimed:
+			return httpapi.ErrorResponse(http.StatusConflict, errors.New("an identical upload is already in progress"))
+		}
+	} else if dedup != nil {
+		existing, found, err := dedup.lookup(contentID)
+		if err != nil {
+			log.Printf("Skipping deduplication: %v", err)
+		}
+		if found {
+			return httpapi.JSONResponse(http.StatusOK, dedupResult{Key: existing, Deduplicated: true})
+		}
+	}
+
+	// Decode, validate, convert and store the document
+	stored, failure := a.storeDocument(ctx, uploadDocument{
+		uploader:      uploader,
+		category:      category,
+		schemaVersion: httpapi.RequestHeader(request, "X-Schema-Version"),
+		tenant:        tenant,
+		requestID:     requestID,
+		userID:        session.UserID,
+		appVersion:    httpapi.RequestHeader(request, "X-App-Version"),
+		payload:       request.Body,
+		contentType:   httpapi.RequestHeader(request, "Content-Type"),
+		base64Encoded: request.IsBase64Encoded,
+		name:          name,
+		condition:     condition,
+		options:       a.uploadOptionsFor(ctx, session.UserID),
+	}, timer)
+	if failure != nil && failure.key == "" {
+		if claimer, ok := dedup.(dedupClaimer); ok {
+			if err := claimer.release(contentID, requestID); err != nil {
+				log.Printf("Unable to release deduplication claim: %v", err)
+			}
+		}
+		return failure.response()
+	}
+
+	// The document is stored from here on, even if a later step failed
+	if dedup != nil {
+		if err := dedup.remember(contentID, stored.key); err != nil {
+			log.Printf("Unable to record upload for deduplication: %v", err)
+		}
+	}
+
+	// Copy to the DR bucket without holding the response on its outcome
+	waitForReplica := a.replicateToSecondary(stored.key, stored.object, stored.metadata)
+	defer waitForReplica()
+
+	if failure != nil {
+		return failure.response()
+	}
+
+	response := events.APIGatewayProxyResponse{
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body:            stored.body,
+		StatusCode:      200,
+		IsBase64Encoded: true,
+	}
+	if stored.etag != "" {
+		response.Headers["ETag"] = stored.etag
+	}
+	if stored.executionARN != "" {
+		response.Headers[executionHeader] = stored.executionARN
+	}
+
+	// Hand the client tamper-evident proof of what was stored
+	if a.receiptsEnabled() {
+		if token := a.issueReceipt(ctx, uploader, stored.key, stored.fileName, stored.object.data, session.UserID, stored.uploadedAt); token != "" {
+			response.Headers[receiptHeader] = token
+		}
+	}
+
+	// Give client teams runway before a deprecated schema version is rejected
+	if stored.schema != nil && stored.schema.Deprecated {
+		a.warnDeprecatedSchema(&response, category, stored.schema)
+	}
+
+	return response, nil
+}
+
+// Run starts the Lambda runtime loop for the HANDLER_MODE the function is
+// deployed with.
+func Run() {
+	// route log.Printf through the structured logger so LOG_LEVEL applies
+	slog.SetDefault(slog.New(newLogHandler(os.Getenv)))
+
+	switch os.Getenv("HANDLER_MODE") {
+	case "s3events":
+		lambda.Start(newAWSApp().S3EventHandler)
+	case "redisgc":
+		lambda.Start(newAWSApp().RedisGCHandler)
+	default:
+		app, startErr := NewLambdaApp()
+		if startErr != nil {
+			log.Printf("Unable to start: %v", startErr)
+			app = misconfiguredApp(startErr)
+		}
+
+		if err := setupTelemetry(context.Background(), app.getenv); err != nil {
+			log.Printf("Unable to set up OpenTelemetry: %v", err)
+		}
+		if startErr == nil && app.bucketSelfTestEnabled() {
+			app.verifyBucket(context.Background())
+		}
+
+		if localDev, _ := strconv.ParseBool(os.Getenv("LOCAL_DEV")); localDev {
+			if serveLocal == nil {
+				log.Fatal("LOCAL_DEV is set but the local server is not compiled into this build")
+			}
+			log.Fatal(serveLocal(app))
+		}
+
+		// flush buffered work when Lambda shuts the sandbox down
+		lambda.StartWithOptions(app.Invoke, lambda.WithEnableSIGTERM(shutdown))
+	}
+}
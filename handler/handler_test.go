@@ -0,0 +1,234 @@
+package handler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/storage"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/receipt"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/upload/uploadtest"
+)
+
+// fakeKMS signs receipts with a local key. Field encryption is not used by
+// these tests.
+type fakeKMS struct {
+	key *ecdsa.PrivateKey
+}
+
+func newFakeKMS(t *testing.T) *fakeKMS {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeKMS{key: key}
+}
+
+func (f *fakeKMS) Sign(ctx context.Context, params *kms.SignInput, optFns ...func(*kms.Options)) (*kms.SignOutput, error) {
+	signature, err := ecdsa.SignASN1(rand.Reader, f.key, params.Message)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.SignOutput{Signature: signature}, nil
+}
+
+func (f *fakeKMS) GetPublicKey(ctx context.Context, params *kms.GetPublicKeyInput, optFns ...func(*kms.Options)) (*kms.GetPublicKeyOutput, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (f *fakeKMS) GenerateDataKey(ctx context.Context, params *kms.GenerateDataKeyInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (f *fakeKMS) Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	return nil, errors.New("not implemented")
+}
+
+// testDeps are the in-memory dependencies behind a testApp.
+type testDeps struct {
+	primary   *uploadtest.MemoryUploader
+	secondary *uploadtest.MemoryUploader
+	signer    *fakeKMS
+}
+
+// testApp is an App whose every dependency is in memory, configured by env
+// instead of the process environment.
+func testApp(t *testing.T, env map[string]string) (*App, testDeps) {
+	t.Helper()
+	deps := testDeps{
+		primary:   &uploadtest.MemoryUploader{},
+		secondary: &uploadtest.MemoryUploader{},
+		signer:    newFakeKMS(t),
+	}
+
+	app := &App{
+		Sessions: uploadtest.Sessions{
+			"acme-token":    {UserID: 7, SystemCode: "ACME"},
+			"default-token": {UserID: 8},
+		},
+		NewUploader: func(tenant, bucket string) (storage.Uploader, error) {
+			if bucket != "uploads" {
+				return nil, errors.New("unexpected bucket " + bucket)
+			}
+			return deps.primary, nil
+		},
+		Clock: testNow,
+		IDs:   nanoIDs{},
+		KMS: func() (KMSAPI, error) {
+			return deps.signer, nil
+		},
+		SecondaryUploader: func() (storage.Uploader, error) {
+			return deps.secondary, nil
+		},
+		KillSwitches: func() (KillSwitches, error) {
+			return KillSwitches{"POST /{category}": "category uploads are paused"}, nil
+		},
+		Getenv: func(key string) string {
+			return env[key]
+		},
+	}
+	return app, deps
+}
+
+func TestHandler(t *testing.T) {
+	env := map[string]string{
+		"BUCKET_NAME":               "uploads",
+		"UPLOAD_CATEGORIES":         `{"sleep": {"prefix": "sleep", "schema": {"type": "object", "required": ["start"]}}}`,
+		"UPLOAD_RECEIPT_KMS_KEY_ID": "alias/receipts",
+	}
+
+	tests := []struct {
+		name       string
+		request    events.APIGatewayProxyRequest
+		wantStatus int
+		// wantStored is whether an upload lands in both buckets.
+		wantStored bool
+	}{
+		{
+			name: "stores an upload",
+			request: events.APIGatewayProxyRequest{
+				HTTPMethod: http.MethodPost,
+				Resource:   "/",
+				Path:       "/",
+				Headers:    map[string]string{"Authorization": "acme-token", "Content-Type": "application/json"},
+				Body:       `{"steps":1}`,
+			},
+			wantStatus: http.StatusOK,
+			wantStored: true,
+		},
+		{
+			name: "rejects an unknown session",
+			request: events.APIGatewayProxyRequest{
+				HTTPMethod: http.MethodPost,
+				Resource:   "/",
+				Path:       "/",
+				Headers:    map[string]string{"Authorization": "stolen-token"},
+				Body:       `{"steps":1}`,
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "rejects another tenant's system code",
+			request: events.APIGatewayProxyRequest{
+				HTTPMethod: http.MethodPost,
+				Resource:   "/",
+				Path:       "/",
+				Headers:    map[string]string{"Authorization": "acme-token", "X-System-Code": "OTHER"},
+				Body:       `{"steps":1}`,
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "reads headers in any case",
+			request: events.APIGatewayProxyRequest{
+				HTTPMethod: http.MethodPost,
+				Resource:   "/",
+				Path:       "/",
+				Headers:    map[string]string{"authorization": "acme-token", "content-type": "application/json"},
+				Body:       `{"steps":1}`,
+			},
+			wantStatus: http.StatusOK,
+			wantStored: true,
+		},
+		{
+			name: "rejects another tenant's system code in any case",
+			request: events.APIGatewayProxyRequest{
+				HTTPMethod: http.MethodPost,
+				Resource:   "/",
+				Path:       "/",
+				Headers:    map[string]string{"authorization": "acme-token", "x-system-code": "OTHER"},
+				Body:       `{"steps":1}`,
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "honours kill switches",
+			request: events.APIGatewayProxyRequest{
+				HTTPMethod:     http.MethodPost,
+				Resource:       "/{category}",
+				Path:           "/sleep",
+				PathParameters: map[string]string{"category": "sleep"},
+				Headers:        map[string]string{"Authorization": "acme-token"},
+				Body:           `{"start":"2026-01-02T00:00:00Z"}`,
+			},
+			wantStatus: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, deps := testApp(t, env)
+
+			response, err := app.Handler(context.Background(), tt.request)
+			if err != nil {
+				t.Fatalf("Handler() error = %v", err)
+			}
+			if response.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", response.StatusCode, tt.wantStatus, response.Body)
+			}
+
+			if !tt.wantStored {
+				if keys := deps.primary.Keys(); len(keys) != 0 {
+					t.Errorf("stored %v, want nothing", keys)
+				}
+				return
+			}
+
+			// wait for the DR copy started in the background
+			background.Wait()
+
+			key := ""
+			for _, stored := range deps.primary.Keys() {
+				if strings.HasSuffix(stored, ".json") {
+					key = stored
+				}
+			}
+			object, ok := deps.primary.Object(key)
+			if !ok {
+				t.Fatalf("no upload among %v", deps.primary.Keys())
+			}
+			if object.Data != tt.request.Body {
+				t.Errorf("stored %s, want %s", object.Data, tt.request.Body)
+			}
+			if _, ok := deps.secondary.Object(key); !ok {
+				t.Errorf("%s was not copied to the secondary bucket, which has %v", key, deps.secondary.Keys())
+			}
+
+			claims, err := receipt.Verify(response.Headers[receiptHeader], &deps.signer.key.PublicKey)
+			if err != nil {
+				t.Fatalf("invalid receipt: %v", err)
+			}
+			if claims.Key != key || claims.UserID != 7 {
+				t.Errorf("receipt claims %+v, want key %s for user 7", claims, key)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/httpapi"
+)
+
+// healthCheckTimeout bounds each dependency check.
+const healthCheckTimeout = 2 * time.Second
+
+// errHealthSkipped marks a dependency that is not configured or not checked.
+var errHealthSkipped = errors.New("skipped")
+
+// componentHealth is the outcome of checking one dependency. The cause of a
+// failure is only logged: /health is unauthenticated, and error strings
+// carry hostnames, ARNs and bucket names.
+type componentHealth struct {
+	Status    string `json:"status"`
+	LatencyMS int64  `json:"latency_ms"`
+}
+
+// healthReport is the body of GET /health.
+type healthReport struct {
+	Status     string                     `json:"status"`
+	Components map[string]componentHealth `json:"components"`
+}
+
+// readinessChecker is implemented by session stores that depend on a
+// connection worth checking.
+type readinessChecker interface {
+	Ready(ctx context.Context) error
+}
+
+// healthResponse checks every dependency concurrently so synthetic monitors
+// can tell a dependency failure from a bad deploy. It answers 503 if any
+// configured dependency is unreachable.
+func (a *App) healthResponse(ctx context.Context) (events.APIGatewayProxyResponse, error) {
+	checks := map[string]func(context.Context) error{
+		"secrets_manager": a.checkSecrets,
+		"sessions_redis":  a.checkSessions,
+		"app_redis":       a.checkAppRedis,
+		"s3":              a.checkBucket,
+	}
+
+	report := healthReport{Status: "ok", Components: map[string]componentHealth{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(checkCtx)
+			component := componentHealth{Status: "ok", LatencyMS: time.Since(start).Milliseconds()}
+			if errors.Is(err, errHealthSkipped) {
+				component.Status = "skipped"
+			} else if err != nil {
+				log.Printf("Health check of %s failed: %v", name, err)
+				component.Status = "error"
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Components[name] = component
+			if component.Status == "error" {
+				report.Status = "degraded"
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	return httpapi.JSONResponse(status, report)
+}
+
+func (a *App) checkSecrets(ctx context.Context) error {
+	secretID := a.getenv("REDIS_SECRET")
+	if secretID == "" || a.Secrets == nil {
+		return errHealthSkipped
+	}
+	_, err := a.Secrets.SecretMap(secretID)
+	return err
+}
+
+func (a *App) checkSessions(ctx context.Context) error {
+	checker, ok := a.Sessions.(readinessChecker)
+	if !ok {
+		return errHealthSkipped
+	}
+	return checker.Ready(ctx)
+}
+
+func (a *App) checkAppRedis(ctx context.Context) error {
+	client := a.Redis
+	if client == nil {
+		return errHealthSkipped
+	}
+	return client.WithContext(ctx).Ping().Err()
+}
+
+func (a *App) checkBucket(ctx context.Context) error {
+	bucket := a.getenv("BUCKET_NAME")
+	if bucket == "" {
+		return errHealthSkipped
+	}
+
+	uploader, err := a.NewUploader(defaultTenant, bucket)
+	if err != nil {
+		return err
+	}
+	s3Uploader, err := asS3Uploader(uploader)
+	if err != nil {
+		return errHealthSkipped
+	}
+
+	_, err = s3Uploader.Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	return err
+}
@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/storage"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/validation"
+)
+
+// maxInferenceDepth stops schema inference descending into pathologically
+// nested payloads.
+const maxInferenceDepth = 32
+
+// inferredSchema describes the shape of a payload without any of its values.
+type inferredSchema struct {
+	Type       []string                   `json:"type"`
+	Properties map[string]*inferredSchema `json:"properties,omitempty"`
+	Items      *inferredSchema            `json:"items,omitempty"`
+}
+
+// schemaInferenceEnabled reports whether SCHEMA_INFERENCE_REPORTS is on.
+func (a *App) schemaInferenceEnabled() bool {
+	enabled, _ := strconv.ParseBool(a.getenv("SCHEMA_INFERENCE_REPORTS"))
+	return enabled
+}
+
+// inferSchema derives the schema of a value produced by json.Unmarshal.
+func inferSchema(value interface{}, depth int) *inferredSchema {
+	schema := &inferredSchema{Type: []string{jsonType(value)}}
+	if depth >= maxInferenceDepth {
+		return schema
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		schema.Properties = make(map[string]*inferredSchema, len(v))
+		for field, child := range v {
+			schema.Properties[field] = inferSchema(child, depth+1)
+		}
+	case []interface{}:
+		for _, child := range v {
+			schema.Items = schema.Items.merge(inferSchema(child, depth+1))
+		}
+	}
+
+	return schema
+}
+
+// merge combines two inferred schemas, e.g. for the items of an array.
+func (s *inferredSchema) merge(other *inferredSchema) *inferredSchema {
+	if s == nil {
+		return other
+	}
+	if other == nil {
+		return s
+	}
+
+	for _, t := range other.Type {
+		if !containsString(s.Type, t) {
+			s.Type = append(s.Type, t)
+		}
+	}
+	sort.Strings(s.Type)
+
+	for field, child := range other.Properties {
+		if s.Properties == nil {
+			s.Properties = map[string]*inferredSchema{}
+		}
+		s.Properties[field] = s.Properties[field].merge(child)
+	}
+	s.Items = s.Items.merge(other.Items)
+
+	return s
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// storeInferenceReport writes the inferred schema of a payload that failed
+// validation under diagnostics/, along with the violated rules. Offending
+// values are stripped so no payload content ends up in the report.
+func storeInferenceReport(ctx context.Context, uploader storage.Uploader, category *uploadCategory, requestID string, value interface{}, errs validation.Errors) {
+	sanitised := make(validation.Errors, len(errs))
+	for i, e := range errs {
+		e.Value = ""
+		sanitised[i] = e
+	}
+
+	now := time.Now()
+	report, err := json.Marshal(struct {
+		Category       string            `json:"category"`
+		GeneratedAt    time.Time         `json:"generated_at"`
+		Errors         validation.Errors `json:"errors"`
+		InferredSchema *inferredSchema   `json:"inferred_schema"`
+	}{
+		Category:       category.Name,
+		GeneratedAt:    now.UTC(),
+		Errors:         sanitised,
+		InferredSchema: inferSchema(value, 0),
+	})
+	if err != nil {
+		log.Printf("Unable to build schema inference report: %v", err)
+		return
+	}
+
+	key := fmt.Sprintf("diagnostics/schema-inference/%s/%d/%d/%d/%v_%s.json",
+		category.Name, now.Year(), now.Month(), now.Day(), now.Format("15:04:05"), requestID)
+	if err := uploader.UploadJSON(ctx, key, string(report)); err != nil {
+		log.Printf("Unable to store schema inference report: %v", err)
+	}
+}
@@ -0,0 +1,406 @@
+//go:build integration
+
+package handler
+
+// The integration tests run the handler against LocalStack S3 and Secrets
+// Manager and a Redis server, started with testcontainers, so they need
+// Docker:
+//
+//	go test -tags integration ./handler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/bootsdigitalhealth/go-db/redis"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/storage"
+	goredis "github.com/go-redis/redis"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/localstack"
+	tcredis "github.com/testcontainers/testcontainers-go/modules/redis"
+)
+
+const (
+	localStackImage = "localstack/localstack:3.8"
+	redisImage      = "redis:7-alpine"
+
+	// integrationRegion is the region the handler's AWS clients use.
+	integrationRegion = "eu-west-2"
+
+	// sessionsDB is the database of the Redis container holding sessions,
+	// apart from the app Redis in database 0 that each test flushes.
+	sessionsDB = 1
+)
+
+var (
+	// redisAddr is the address of the Redis container, the app Redis of
+	// every integration App and the sessions Redis.
+	redisAddr string
+
+	// secrets is the LocalStack Secrets Manager.
+	secrets *secretsmanager.Client
+)
+
+// client is a holder of a session seeded by TestMain, calling with
+// systemCode as its X-System-Code header.
+type client struct {
+	token      string
+	systemCode string
+}
+
+var (
+	acmeUser    = client{token: "acme-token", systemCode: "ACME"}
+	defaultUser = client{token: "default-token"}
+
+	// otherTenantUser has acmeUser's user ID in another tenant, and
+	// acmeColleague is another user in acmeUser's tenant.
+	otherTenantUser = client{token: "other-token", systemCode: "OTHER"}
+	acmeColleague   = client{token: defaultUser.token, systemCode: "ACME"}
+)
+
+// sessions are the user IDs of the sessions TestMain seeds, by token.
+var sessions = map[string]uint64{
+	acmeUser.token:        7,
+	defaultUser.token:     8,
+	otherTenantUser.token: 7,
+}
+
+func TestMain(m *testing.M) {
+	ctx := context.Background()
+
+	stack, err := localstack.Run(ctx, localStackImage, testcontainers.WithEnv(map[string]string{
+		"SERVICES": "s3,secretsmanager",
+	}))
+	if err != nil {
+		log.Fatalf("Unable to start LocalStack: %v", err)
+	}
+	endpoint, err := stack.PortEndpoint(ctx, "4566/tcp", "http")
+	if err != nil {
+		log.Fatalf("Unable to find the LocalStack endpoint: %v", err)
+	}
+
+	redisServer, err := tcredis.Run(ctx, redisImage)
+	if err != nil {
+		log.Fatalf("Unable to start Redis: %v", err)
+	}
+	redisURL, err := redisServer.ConnectionString(ctx)
+	if err != nil {
+		log.Fatalf("Unable to find the Redis address: %v", err)
+	}
+	redisAddr = strings.TrimPrefix(redisURL, "redis://")
+
+	// the AWS SDK and storage package read these, as they do when the
+	// function is served locally against LocalStack
+	os.Setenv("AWS_ENDPOINT_URL", endpoint)
+	os.Setenv("AWS_REGION", integrationRegion)
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	os.Setenv("S3_USE_PATH_STYLE", "true")
+
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(integrationRegion))
+	if err != nil {
+		log.Fatalf("Unable to load the AWS config: %v", err)
+	}
+	secrets = secretsmanager.NewFromConfig(cfg)
+
+	// the handler connects to the sessions Redis with this secret, as it
+	// does in production
+	host, port, _ := strings.Cut(redisAddr, ":")
+	redisSecret := "lambda-upload-s3/sessions-redis"
+	err = createSecret(redisSecret, map[string]string{
+		"host":        host,
+		"port":        port,
+		"sessions_db": strconv.Itoa(sessionsDB),
+	})
+	if err != nil {
+		log.Fatalf("Unable to create the Redis secret: %v", err)
+	}
+	os.Setenv("REDIS_SECRET", redisSecret)
+
+	if err := seedSessions(); err != nil {
+		log.Fatalf("Unable to seed sessions: %v", err)
+	}
+
+	code := m.Run()
+
+	if err := redisServer.Terminate(ctx); err != nil {
+		log.Printf("Unable to stop Redis: %v", err)
+	}
+	if err := stack.Terminate(ctx); err != nil {
+		log.Printf("Unable to stop LocalStack: %v", err)
+	}
+	os.Exit(code)
+}
+
+// createSecret stores values as a JSON secret in LocalStack.
+func createSecret(name string, values map[string]string) error {
+	raw, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	_, err = secrets.CreateSecret(context.Background(), &secretsmanager.CreateSecretInput{
+		Name:         aws.String(name),
+		SecretString: aws.String(string(raw)),
+	})
+	return err
+}
+
+// testSecret stores values as a JSON secret named after the test.
+func testSecret(t *testing.T, values map[string]string) string {
+	t.Helper()
+	name := "lambda-upload-s3/" + strings.ToLower(strings.ReplaceAll(t.Name(), "/", "-"))
+	if err := createSecret(name, values); err != nil {
+		t.Fatalf("Unable to create secret %s: %v", name, err)
+	}
+	return name
+}
+
+// seedSessions writes sessions to the sessions Redis as go-db's Session
+// records, JSON encoded under their token.
+func seedSessions() error {
+	client := goredis.NewClient(&goredis.Options{Addr: redisAddr, DB: sessionsDB})
+	defer client.Close()
+
+	for token, userID := range sessions {
+		record, err := json.Marshal(redis.Session{UserID: userID})
+		if err != nil {
+			return err
+		}
+		if err := client.Set(token, record, 0).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createBucket makes an empty bucket named after the test and suffix.
+func createBucket(t *testing.T, suffix string) *storage.S3Uploader {
+	t.Helper()
+	name := strings.ToLower(strings.NewReplacer("/", "-", "_", "-").Replace(t.Name())) + "-" + suffix
+	uploader, err := storage.NewS3Uploader(name, os.Getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = uploader.Client.CreateBucket(context.Background(), &s3.CreateBucketInput{
+		Bucket: aws.String(name),
+		CreateBucketConfiguration: &types.CreateBucketConfiguration{
+			LocationConstraint: types.BucketLocationConstraint(integrationRegion),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to create bucket %s: %v", name, err)
+	}
+	return uploader
+}
+
+// listKeys lists every key in the uploader's bucket, sorted.
+func listKeys(t *testing.T, uploader *storage.S3Uploader) []string {
+	t.Helper()
+	output, err := uploader.Client.ListObjectsV2(context.Background(), &s3.ListObjectsV2Input{Bucket: aws.String(uploader.Bucket)})
+	if err != nil {
+		t.Fatalf("Unable to list %s: %v", uploader.Bucket, err)
+	}
+	keys := make([]string, 0, len(output.Contents))
+	for _, object := range output.Contents {
+		keys = append(keys, aws.ToString(object.Key))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// readObject returns the object's body and content type.
+func readObject(t *testing.T, uploader *storage.S3Uploader, key string) (string, string) {
+	t.Helper()
+	output, err := uploader.Client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(uploader.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		t.Fatalf("Unable to read %s: %v", key, err)
+	}
+	defer output.Body.Close()
+	body, err := io.ReadAll(output.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body), aws.ToString(output.ContentType)
+}
+
+// integrationApp is the App NewLambdaApp wires up from env on top of the
+// LocalStack and Redis settings from TestMain.
+func integrationApp(t *testing.T, env map[string]string) *App {
+	t.Helper()
+	t.Setenv("APP_REDIS_ADDR", redisAddr)
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+
+	app, err := NewLambdaApp()
+	if err != nil {
+		t.Fatalf("NewLambdaApp() error = %v", err)
+	}
+	// each test has its own Redis keys, as it has its own buckets
+	if err := app.Redis.FlushDB().Err(); err != nil {
+		t.Fatalf("Unable to flush Redis: %v", err)
+	}
+	return app
+}
+
+// invoke sends request through the full Handler as caller.
+func invoke(t *testing.T, app *App, caller client, request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	t.Helper()
+	request.Headers = map[string]string{"Authorization": caller.token, "Content-Type": "application/json"}
+	if caller.systemCode != "" {
+		request.Headers["X-System-Code"] = caller.systemCode
+	}
+	response, err := app.Handler(context.Background(), request)
+	if err != nil {
+		t.Fatalf("%s %s: Handler() error = %v", request.HTTPMethod, request.Path, err)
+	}
+	return response
+}
+
+// uploadTo is a POST /{category} request with body.
+func uploadTo(category, body string) events.APIGatewayProxyRequest {
+	return events.APIGatewayProxyRequest{
+		HTTPMethod:     http.MethodPost,
+		Resource:       "/{category}",
+		Path:           "/" + category,
+		PathParameters: map[string]string{"category": category},
+		Body:           body,
+	}
+}
+
+const sleepCategories = `{"sleep": {"prefix": "sleep", "schema": {"type": "object", "required": ["start"], "properties": {"start": "string"}}}}`
+
+func TestIntegrationUpload(t *testing.T) {
+	fallback := createBucket(t, "fallback")
+	routed := createBucket(t, "sleep")
+	routes := testSecret(t, map[string]string{"*/sleep": routed.Bucket})
+
+	app := integrationApp(t, map[string]string{
+		"BUCKET_NAME":          fallback.Bucket,
+		"BUCKET_ROUTES_SECRET": routes,
+		"UPLOAD_CATEGORIES":    sleepCategories,
+		"DEDUP_MODE":           "redis",
+	})
+	body := `{"start":"2026-01-02T23:00:00Z"}`
+
+	response := invoke(t, app, client{token: "stolen-token"}, uploadTo("sleep", body))
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unknown session: status = %d, want 401", response.StatusCode)
+	}
+
+	response = invoke(t, app, acmeUser, uploadTo("sleep", `{"end":"2026-01-03T07:00:00Z"}`))
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid document: status = %d, want 400: %s", response.StatusCode, response.Body)
+	}
+	if keys := listKeys(t, routed); len(keys) != 0 {
+		t.Fatalf("invalid document was stored: %v", keys)
+	}
+
+	response = invoke(t, app, acmeUser, uploadTo("sleep", body))
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("upload: status = %d, want 200: %s", response.StatusCode, response.Body)
+	}
+
+	// the route from Secrets Manager wins over BUCKET_NAME
+	if keys := listKeys(t, fallback); len(keys) != 0 {
+		t.Errorf("upload went to the fallback bucket: %v", keys)
+	}
+	keys := listKeys(t, routed)
+	if len(keys) != 1 || !strings.HasPrefix(keys[0], "sleep/ACME/") {
+		t.Fatalf("routed bucket holds %v, want one upload under sleep/ACME/", keys)
+	}
+	stored, contentType := readObject(t, routed, keys[0])
+	if stored != body || contentType != "application/json" {
+		t.Errorf("stored %s (%s), want %s (application/json)", stored, contentType, body)
+	}
+
+	// a retry is answered from the Redis deduplication record
+	response = invoke(t, app, acmeUser, uploadTo("sleep", body))
+	var dedup dedupResult
+	if err := json.Unmarshal([]byte(response.Body), &dedup); err != nil || !dedup.Deduplicated || dedup.Key != keys[0] {
+		t.Errorf("retry: got %d %s, want a deduplicated result for %s", response.StatusCode, response.Body, keys[0])
+	}
+	if after := listKeys(t, routed); len(after) != 1 {
+		t.Errorf("retry stored another object: %v", after)
+	}
+}
+
+func TestIntegrationBatch(t *testing.T) {
+	bucket := createBucket(t, "uploads")
+	app := integrationApp(t, map[string]string{
+		"BUCKET_NAME":       bucket.Bucket,
+		"UPLOAD_CATEGORIES": sleepCategories,
+	})
+
+	response := invoke(t, app, defaultUser, events.APIGatewayProxyRequest{
+		HTTPMethod:            http.MethodPost,
+		Resource:              "/uploads/batch",
+		Path:                  "/uploads/batch",
+		QueryStringParameters: map[string]string{"category": "sleep"},
+		Body:                  `[{"start":"2026-01-02T23:00:00Z"},{"end":"2026-01-03T07:00:00Z"}]`,
+	})
+	if response.StatusCode != http.StatusMultiStatus {
+		t.Fatalf("status = %d, want 207: %s", response.StatusCode, response.Body)
+	}
+
+	var result batchResult
+	if err := json.Unmarshal([]byte(response.Body), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Results) != 2 || result.Results[0].Key == "" || result.Results[1].Status != http.StatusBadRequest {
+		t.Fatalf("results = %+v, want the first stored and the second rejected", result.Results)
+	}
+
+	keys := listKeys(t, bucket)
+	if len(keys) != 1 || keys[0] != result.Results[0].Key {
+		t.Fatalf("bucket holds %v, want only %s", keys, result.Results[0].Key)
+	}
+	if stored, _ := readObject(t, bucket, keys[0]); stored != `{"start":"2026-01-02T23:00:00Z"}` {
+		t.Errorf("stored %s", stored)
+	}
+}
+
+func TestIntegrationNamedDocument(t *testing.T) {
+	bucket := createBucket(t, "uploads")
+	app := integrationApp(t, map[string]string{
+		"BUCKET_NAME":       bucket.Bucket,
+		"UPLOAD_CATEGORIES": sleepCategories,
+	})
+	for i, body := range []string{`{"start":"22:00"}`, `{"start":"23:00"}`} {
+		response := invoke(t, app, defaultUser, events.APIGatewayProxyRequest{
+			HTTPMethod:     http.MethodPut,
+			Resource:       "/{category}/documents/{name}",
+			Path:           "/sleep/documents/settings",
+			PathParameters: map[string]string{"category": "sleep", "name": "settings"},
+			Body:           body,
+		})
+		if response.StatusCode != http.StatusOK || response.Headers["ETag"] == "" {
+			t.Fatalf("write %d: status = %d, ETag = %q: %s", i+1, response.StatusCode, response.Headers["ETag"], response.Body)
+		}
+	}
+
+	key := "sleep/users/8/settings.json"
+	if keys := listKeys(t, bucket); len(keys) != 1 || keys[0] != key {
+		t.Fatalf("bucket holds %v, want only %s", keys, key)
+	}
+	if stored, _ := readObject(t, bucket, key); stored != `{"start":"23:00"}` {
+		t.Errorf("stored %s, want the second write", stored)
+	}
+}
@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// defaultKillSwitchMessage is returned when a kill switch has no message.
+const defaultKillSwitchMessage = "this route is temporarily unavailable"
+
+// appConfigClient talks to the AWS AppConfig Lambda extension, which serves
+// cached configuration on localhost:2772.
+var appConfigClient = &http.Client{Timeout: time.Second}
+
+// KillSwitches maps a route to the maintenance message returned while it is
+// disabled. Routes are either "METHOD /resource" or "/resource", the latter
+// disabling every method, e.g.
+//
+//	{"DELETE /{category}/multipart/{uploadId}": "aborts are disabled during an incident"}
+type KillSwitches map[string]string
+
+// loadKillSwitches reads the kill switches from AppConfig when
+// APPCONFIG_KILL_SWITCHES_PATH is set, falling back to ROUTE_KILL_SWITCHES.
+// Switches are re-read on every request so they can be flipped during an
+// incident without a deploy.
+func (a *App) loadKillSwitches() (KillSwitches, error) {
+	if path := a.getenv("APPCONFIG_KILL_SWITCHES_PATH"); path != "" {
+		switches, err := fetchAppConfigKillSwitches(a.getenv, path)
+		if err == nil {
+			return switches, nil
+		}
+		log.Printf("Falling back to ROUTE_KILL_SWITCHES: %v", err)
+	}
+
+	switches := KillSwitches{}
+	if raw := a.getenv("ROUTE_KILL_SWITCHES"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &switches); err != nil {
+			return nil, fmt.Errorf("invalid ROUTE_KILL_SWITCHES: %v", err)
+		}
+	}
+
+	return switches, nil
+}
+
+func fetchAppConfigKillSwitches(getenv func(string) string, path string) (KillSwitches, error) {
+	switches := KillSwitches{}
+	if err := fetchAppConfig(getenv, path, "kill switches", &switches); err != nil {
+		return nil, err
+	}
+	return switches, nil
+}
+
+// fetchAppConfig reads the JSON configuration profile at path from the
+// AppConfig extension into v. name describes the profile in errors.
+func fetchAppConfig(getenv func(string) string, path, name string, v interface{}) error {
+	port := getenv("AWS_APPCONFIG_EXTENSION_HTTP_PORT")
+	if port == "" {
+		port = "2772"
+	}
+
+	resp, err := appConfigClient.Get(fmt.Sprintf("http://localhost:%s%s", port, path))
+	if err != nil {
+		return fmt.Errorf("unable to fetch %s from AppConfig: %v", name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to fetch %s from AppConfig: status %d", name, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read %s from AppConfig: %v", name, err)
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("invalid %s in AppConfig: %v", name, err)
+	}
+
+	return nil
+}
+
+// disabled reports whether the route is switched off and the message to
+// return to the caller if so.
+func (k KillSwitches) disabled(method, resource string) (string, bool) {
+	message, ok := k[method+" "+resource]
+	if !ok {
+		message, ok = k[resource]
+	}
+	if !ok {
+		return "", false
+	}
+
+	if message == "" {
+		message = defaultKillSwitchMessage
+	}
+	return message, true
+}
+
+// killSwitches reads the routes switched off, none when the App has no
+// KillSwitches.
+func (a *App) killSwitches() (KillSwitches, error) {
+	if a.KillSwitches == nil {
+		return nil, nil
+	}
+	return a.KillSwitches()
+}
@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultUploadReserve is the time the S3 call needs left on the Lambda
+// clock when UPLOAD_MIN_REMAINING_MS is not set.
+const defaultUploadReserve = time.Second
+
+// defaultStageBudgets are used for stages STAGE_BUDGETS_MS does not cover.
+var defaultStageBudgets = map[string]time.Duration{
+	"auth":       300 * time.Millisecond,
+	"validation": 200 * time.Millisecond,
+	"upload":     time.Second,
+}
+
+var errUploadDeadline = errors.New("not enough time left to store the upload")
+
+// loadStageBudgets merges STAGE_BUDGETS_MS, a JSON object of stage name to
+// milliseconds, over the defaults. An invalid value is logged and ignored
+// so a bad budget can never fail an upload.
+func (a *App) loadStageBudgets() map[string]time.Duration {
+	budgets, _ := a.stageBudgets.get(func() (map[string]time.Duration, error) {
+		budgets := map[string]time.Duration{}
+		for stage, budget := range defaultStageBudgets {
+			budgets[stage] = budget
+		}
+
+		raw := a.getenv("STAGE_BUDGETS_MS")
+		if raw == "" {
+			return budgets, nil
+		}
+
+		var ms map[string]int
+		if err := json.Unmarshal([]byte(raw), &ms); err != nil {
+			log.Printf("Ignoring invalid STAGE_BUDGETS_MS: %v", err)
+			return budgets, nil
+		}
+		for stage, budget := range ms {
+			budgets[stage] = time.Duration(budget) * time.Millisecond
+		}
+		return budgets, nil
+	})
+
+	return budgets
+}
+
+// stageTiming is how long one stage of a request took.
+type stageTiming struct {
+	stage   string
+	elapsed time.Duration
+}
+
+// stageTimer records how long each stage of a request takes against its
+// budget, and traces each stage as a span under the request's.
+type stageTimer struct {
+	ctx     context.Context
+	last    time.Time
+	timings []stageTiming
+}
+
+func newStageTimer(ctx context.Context) *stageTimer {
+	return &stageTimer{ctx: ctx, last: time.Now()}
+}
+
+// mark ends the named stage, which started when the previous one ended. A
+// nil timer records nothing.
+func (t *stageTimer) mark(stage string) {
+	if t == nil {
+		return
+	}
+
+	now := time.Now()
+	t.timings = append(t.timings, stageTiming{stage: stage, elapsed: now.Sub(t.last)})
+
+	_, span := tracer().Start(t.ctx, stage, trace.WithTimestamp(t.last))
+	span.End(trace.WithTimestamp(now))
+
+	t.last = now
+}
+
+// report logs a warning with the full breakdown when any stage went over
+// its budget.
+func (t *stageTimer) report(budgets map[string]time.Duration) {
+	over := false
+	breakdown := make([]string, len(t.timings))
+	for i, timing := range t.timings {
+		budget, ok := budgets[timing.stage]
+		if ok && timing.elapsed > budget {
+			over = true
+		}
+		breakdown[i] = fmt.Sprintf("%s=%dms/%dms", timing.stage, timing.elapsed.Milliseconds(), budget.Milliseconds())
+	}
+
+	if over {
+		log.Printf("Request exceeded its latency budget: %s", strings.Join(breakdown, " "))
+	}
+}
+
+// uploadReserve is UPLOAD_MIN_REMAINING_MS or the default.
+func (a *App) uploadReserve() time.Duration {
+	if ms, err := strconv.Atoi(a.getenv("UPLOAD_MIN_REMAINING_MS")); err == nil && ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return defaultUploadReserve
+}
+
+// checkUploadDeadline fails with errUploadDeadline when the invocation
+// would time out before the S3 call could finish, so the client gets a 504
+// rather than a write of unknown outcome.
+func (a *App) checkUploadDeadline(ctx context.Context) error {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < a.uploadReserve() {
+		return errUploadDeadline
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// latestSourceMetadataKey records which upload a latest copy was taken from.
+const latestSourceMetadataKey = "source-key"
+
+// latestEnabled reports whether the category is listed in
+// LATEST_POINTER_CATEGORIES (comma separated category names, e.g.
+// "activityType,sleep"), whose uploads are also copied to a stable
+// per-user key.
+func (a *App) latestEnabled(category *uploadCategory) bool {
+	for _, name := range strings.Split(a.getenv("LATEST_POINTER_CATEGORIES"), ",") {
+		if strings.TrimSpace(name) == category.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// latestKey is {prefix}/{user_id}/latest.{extension}, where consumers find
+// the user's most recent upload without listing the bucket.
+func latestKey(category *uploadCategory, tenant string, userID int64, extension string) string {
+	return fmt.Sprintf("%s/%d/latest.%s", category.keyPrefix(tenant), userID, extension)
+}
+
+// writeLatest overwrites the user's latest copy with the upload stored at
+// sourceKey. The upload itself has already succeeded, so a failure here is
+// logged and counted rather than failing the request.
+func (a *App) writeLatest(doc uploadDocument, sourceKey string, object storedObject, metadata map[string]string) {
+	latestMetadata := map[string]string{latestSourceMetadataKey: sourceKey}
+	for k, v := range metadata {
+		latestMetadata[k] = v
+	}
+
+	key := latestKey(doc.category, doc.tenant, doc.userID, object.extension)
+	if err := doc.uploader.UploadObject(key, object.data, object.contentType, latestMetadata); err != nil {
+		log.Printf("Unable to write %s: %v", key, err)
+		a.emitMetrics(map[string]string{"Category": doc.category.Name}, metric{Name: "LatestPointerFailures", Value: 1, Unit: "Count"})
+	}
+}
@@ -0,0 +1,135 @@
+//go:build localdev
+
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// defaultLocalDevAddr is where the local server listens without LOCAL_DEV_ADDR.
+const defaultLocalDevAddr = "localhost:8080"
+
+// localDevTimeout stands in for the Lambda timeout, so deadline-driven
+// budgets behave as they do when deployed.
+const localDevTimeout = 30 * time.Second
+
+// localRoutes are the API Gateway resources the function is deployed
+// behind, most specific first.
+var localRoutes = knownResources
+
+// The local server only exists in binaries built with -tags localdev. With
+// LOCAL_DEV=true it serves the same handler over plain HTTP on
+// LOCAL_DEV_ADDR, so developers can iterate against LocalStack
+// (AWS_ENDPOINT_URL, S3_USE_PATH_STYLE) and a local Redis without deploying.
+func init() {
+	serveLocal = func(app *App) error {
+		addr := app.getenv("LOCAL_DEV_ADDR")
+		if addr == "" {
+			addr = defaultLocalDevAddr
+		}
+
+		log.Printf("Serving uploads locally on http://%s", addr)
+		return http.ListenAndServe(addr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveLocalRequest(app, w, r)
+		}))
+	}
+}
+
+func serveLocalRequest(app *App, w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resource, pathParameters := matchLocalRoute(r.URL.Path)
+	request := events.APIGatewayProxyRequest{
+		Resource:              resource,
+		Path:                  r.URL.Path,
+		HTTPMethod:            r.Method,
+		Headers:               map[string]string{},
+		MultiValueHeaders:     r.Header,
+		QueryStringParameters: map[string]string{},
+		PathParameters:        pathParameters,
+		Body:                  string(body),
+		RequestContext: events.APIGatewayProxyRequestContext{
+			RequestID: fmt.Sprintf("local-%d", time.Now().UnixNano()),
+		},
+	}
+	for name, values := range r.Header {
+		request.Headers[name] = values[0]
+	}
+	for name, values := range r.URL.Query() {
+		request.QueryStringParameters[name] = values[0]
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), localDevTimeout)
+	defer cancel()
+
+	response, err := app.Handler(ctx, request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	for name, value := range response.Headers {
+		w.Header().Set(name, value)
+	}
+	for name, values := range response.MultiValueHeaders {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(response.StatusCode)
+
+	// API Gateway decodes base64 bodies before answering the client
+	responseBody := []byte(response.Body)
+	if response.IsBase64Encoded {
+		if decoded, err := base64.StdEncoding.DecodeString(response.Body); err == nil {
+			responseBody = decoded
+		}
+	}
+	w.Write(responseBody)
+}
+
+// matchLocalRoute finds the API Gateway resource for a path, along with the
+// path parameters it captures.
+func matchLocalRoute(path string) (string, map[string]string) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+
+	for _, route := range localRoutes {
+		templates := strings.Split(strings.Trim(route, "/"), "/")
+		if len(templates) != len(segments) {
+			continue
+		}
+
+		parameters := map[string]string{}
+		matched := true
+		for i, template := range templates {
+			if strings.HasPrefix(template, "{") && strings.HasSuffix(template, "}") {
+				if segments[i] == "" {
+					matched = false
+					break
+				}
+				parameters[strings.Trim(template, "{}")] = segments[i]
+			} else if template != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return route, parameters
+		}
+	}
+
+	return path, nil
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/httpapi"
+)
+
+// defaultMaintenanceRetryAfter is the Retry-After value, in seconds, sent
+// while in maintenance mode when MAINTENANCE_RETRY_AFTER is not set.
+const defaultMaintenanceRetryAfter = 300
+
+// inMaintenance reports whether MAINTENANCE_MODE is switched on.
+func (a *App) inMaintenance() bool {
+	enabled, _ := strconv.ParseBool(a.getenv("MAINTENANCE_MODE"))
+	return enabled
+}
+
+// maintenanceAllowed reports whether the caller presented one of the API keys
+// in MAINTENANCE_ALLOWED_API_KEYS, which lets internal callers verify the
+// function while normal traffic is turned away.
+func (a *App) maintenanceAllowed(request events.APIGatewayProxyRequest) bool {
+	apiKey := httpapi.RequestHeader(request, "X-Api-Key")
+	if apiKey == "" {
+		return false
+	}
+
+	for _, allowed := range strings.Split(a.getenv("MAINTENANCE_ALLOWED_API_KEYS"), ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed != "" && subtle.ConstantTimeCompare([]byte(apiKey), []byte(allowed)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// maintenanceResponse rejects the request with a 503 and a Retry-After hint.
+func (a *App) maintenanceResponse() (events.APIGatewayProxyResponse, error) {
+	retryAfter := defaultMaintenanceRetryAfter
+	if seconds, err := strconv.Atoi(a.getenv("MAINTENANCE_RETRY_AFTER")); err == nil && seconds > 0 {
+		retryAfter = seconds
+	}
+
+	response, err := httpapi.ErrorResponse(http.StatusServiceUnavailable, errors.New("service is undergoing maintenance"))
+	if response.Headers == nil {
+		response.Headers = map[string]string{}
+	}
+	response.Headers["Retry-After"] = strconv.Itoa(retryAfter)
+
+	return response, err
+}
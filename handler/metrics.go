@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// defaultMetricsNamespace is used when METRICS_NAMESPACE is not set.
+const defaultMetricsNamespace = "LambdaUploadS3"
+
+// otherTenant is the Tenant dimension of tenants nothing is configured for.
+const otherTenant = "other"
+
+// metricTenant is the Tenant dimension for tenant. Each value is a separate
+// custom metric, so only tenants named in TENANT_STORAGE_QUOTAS,
+// TENANT_CONCURRENCY_LIMITS or TENANT_BUCKETS get their own; the rest are
+// reported together as "other".
+func (a *App) metricTenant(tenant string) string {
+	if tenant == defaultTenant {
+		return tenant
+	}
+	if quotas, err := a.loadStorageQuotas(); err == nil {
+		if _, ok := quotas[tenant]; ok {
+			return tenant
+		}
+	}
+	if limits, err := a.loadConcurrencyLimits(); err == nil {
+		if _, ok := limits[tenant]; ok {
+			return tenant
+		}
+	}
+	if buckets, err := a.loadTenantBuckets(); err == nil {
+		if _, ok := buckets[tenant]; ok {
+			return tenant
+		}
+	}
+	return otherTenant
+}
+
+// metric is a single CloudWatch metric value.
+type metric struct {
+	Name  string
+	Value float64
+	Unit  string
+}
+
+// emitMetrics writes the metrics to stdout in CloudWatch Embedded Metric
+// Format, which the Lambda log pipeline turns into CloudWatch metrics without
+// any API calls on the request path.
+func (a *App) emitMetrics(dimensions map[string]string, metrics ...metric) {
+	recordOTelMetrics(dimensions, metrics)
+
+	namespace := a.getenv("METRICS_NAMESPACE")
+	if namespace == "" {
+		namespace = defaultMetricsNamespace
+	}
+
+	dimensionKeys := make([]string, 0, len(dimensions))
+	for key := range dimensions {
+		dimensionKeys = append(dimensionKeys, key)
+	}
+	sort.Strings(dimensionKeys)
+
+	type metricDefinition struct {
+		Name string `json:"Name"`
+		Unit string `json:"Unit,omitempty"`
+	}
+
+	definitions := make([]metricDefinition, len(metrics))
+	document := map[string]interface{}{}
+	for i, m := range metrics {
+		definitions[i] = metricDefinition{Name: m.Name, Unit: m.Unit}
+		document[m.Name] = m.Value
+	}
+	for key, value := range dimensions {
+		document[key] = value
+	}
+
+	document["_aws"] = map[string]interface{}{
+		"Timestamp": time.Now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  namespace,
+			"Dimensions": [][]string{dimensionKeys},
+			"Metrics":    definitions,
+		}},
+	}
+
+	line, err := json.Marshal(document)
+	if err != nil {
+		log.Printf("Unable to encode metrics: %v", err)
+		return
+	}
+	fmt.Fprintln(os.Stdout, string(line))
+}
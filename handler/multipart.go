@@ -0,0 +1,231 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/httpapi"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/storage"
+)
+
+const (
+	// maxMultipartParts is the S3 limit on parts in a multipart upload. The
+	// validate tags on the multipart request bodies repeat it.
+	maxMultipartParts = 10000
+
+	// defaultMultipartURLExpiry is how long presigned part URLs stay valid
+	// when MULTIPART_URL_EXPIRY_SECONDS is not set.
+	defaultMultipartURLExpiry = 15 * time.Minute
+
+	// multipartExtension is the extension of objects uploaded in parts,
+	// which the function never looks inside.
+	multipartExtension = "bin"
+)
+
+// multipartCreateRequest is the body of POST /{category}/multipart.
+type multipartCreateRequest struct {
+	Parts       int    `json:"parts" validate:"min=1,max=10000"`
+	ContentType string `json:"content_type"`
+}
+
+type multipartPartURL struct {
+	PartNumber int32  `json:"part_number"`
+	URL        string `json:"url"`
+}
+
+// multipartCreateResult hands the client a presigned URL for every part.
+type multipartCreateResult struct {
+	Key       string             `json:"key"`
+	UploadID  string             `json:"upload_id"`
+	Parts     []multipartPartURL `json:"parts"`
+	ExpiresAt time.Time          `json:"expires_at"`
+}
+
+// multipartCompleteRequest is the body of
+// POST /{category}/multipart/{uploadId}/complete.
+type multipartCompleteRequest struct {
+	Key   string `json:"key" validate:"required"`
+	Parts []struct {
+		PartNumber int32  `json:"part_number" validate:"min=1,max=10000"`
+		ETag       string `json:"etag" validate:"required"`
+	} `json:"parts" validate:"required,min=1,dive"`
+}
+
+func (a *App) multipartURLExpiry() time.Duration {
+	if seconds, err := strconv.Atoi(a.getenv("MULTIPART_URL_EXPIRY_SECONDS")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultMultipartURLExpiry
+}
+
+// isMultipartRoute reports whether the request is for one of the multipart
+// upload coordination endpoints.
+func isMultipartRoute(request events.APIGatewayProxyRequest) bool {
+	return strings.Contains(request.Resource, "/multipart")
+}
+
+// multipartResponse coordinates multipart uploads of very large files. The
+// function creates, completes and aborts the upload so it keeps control of
+// the key and an audit trail, while the parts go straight from the client
+// to S3 over presigned URLs.
+func (a *App) multipartResponse(ctx context.Context, request events.APIGatewayProxyRequest, uploader *storage.S3Uploader, category *uploadCategory, tenant string, userID int64) (events.APIGatewayProxyResponse, error) {
+	switch {
+	case request.HTTPMethod == http.MethodPost && strings.HasSuffix(request.Resource, "/multipart"):
+		return a.createMultipartUpload(ctx, request, uploader, category, tenant, userID)
+	case request.HTTPMethod == http.MethodPost && strings.HasSuffix(request.Resource, "/complete"):
+		return a.completeMultipartUpload(ctx, request, uploader, category, tenant, userID)
+	case request.HTTPMethod == http.MethodDelete:
+		return a.abortMultipartUpload(ctx, request, uploader, category, tenant, userID)
+	default:
+		return httpapi.ErrorResponse(http.StatusMethodNotAllowed, fmt.Errorf("%s is not supported on %s", request.HTTPMethod, request.Resource))
+	}
+}
+
+// multipartKeyOwned checks a client-supplied key is one this function created
+// for the user in the category, so clients can't touch other objects. The
+// default tenant's prefix is also the start of every other tenant's, so the
+// key must be exactly the year/month/day/file path below the tenant's prefix.
+func multipartKeyOwned(key string, category *uploadCategory, tenant string, userID int64) bool {
+	rest, ok := strings.CutPrefix(key, category.keyPrefix(tenant)+"/")
+	return ok && strings.Count(rest, "/") == 3 &&
+		strings.HasSuffix(rest, fmt.Sprintf("_%d_%s.%s", userID, category.Name, multipartExtension)) &&
+		!strings.Contains(key, "..")
+}
+
+func (a *App) createMultipartUpload(ctx context.Context, request events.APIGatewayProxyRequest, uploader *storage.S3Uploader, category *uploadCategory, tenant string, userID int64) (events.APIGatewayProxyResponse, error) {
+	var create multipartCreateRequest
+	if errs := httpapi.BindAndValidate(request, &create); len(errs) > 0 {
+		return httpapi.ValidationErrorResponse(http.StatusBadRequest, errs)
+	}
+	if create.ContentType == "" {
+		create.ContentType = "application/octet-stream"
+	}
+
+	now := time.Now()
+	key := fmt.Sprintf("%s/%d/%d/%d/%v_%d_%s.%s",
+		category.keyPrefix(tenant), now.Year(), now.Month(), now.Day(), now.Format("15:04:05"), userID, category.Name, multipartExtension)
+
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(uploader.Bucket),
+		Key:         aws.String(a.multipartObjectKey(key)),
+		ContentType: aws.String(create.ContentType),
+		Metadata: map[string]string{
+			storage.ProducerMetadataKey: storage.ProducerName,
+			"user-id":                   strconv.FormatInt(userID, 10),
+		},
+	}
+
+	class, err := storage.StorageClass(a.getenv)
+	if err != nil {
+		return httpapi.ErrorResponse(http.StatusInternalServerError, err)
+	}
+	input.StorageClass = class
+
+	tagging, err := storage.ObjectTagging(a.getenv, tenantTags(tenant))
+	if err != nil {
+		return httpapi.ErrorResponse(http.StatusInternalServerError, err)
+	}
+	if tagging != "" {
+		input.Tagging = aws.String(tagging)
+	}
+
+	output, err := uploader.Client.CreateMultipartUpload(ctx, input)
+	if err != nil {
+		return httpapi.ErrorResponse(http.StatusInternalServerError, httpapi.WithCode(httpapi.CodeUpstreamS3, err))
+	}
+
+	expiry := a.multipartURLExpiry()
+	presigner := s3.NewPresignClient(uploader.Client)
+	result := multipartCreateResult{
+		Key:       key,
+		UploadID:  aws.ToString(output.UploadId),
+		Parts:     make([]multipartPartURL, 0, create.Parts),
+		ExpiresAt: now.Add(expiry).UTC(),
+	}
+	for part := int32(1); part <= int32(create.Parts); part++ {
+		presigned, err := presigner.PresignUploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(uploader.Bucket),
+			Key:        input.Key,
+			UploadId:   output.UploadId,
+			PartNumber: aws.Int32(part),
+		}, s3.WithPresignExpires(expiry))
+		if err != nil {
+			return httpapi.ErrorResponse(http.StatusInternalServerError, err)
+		}
+		result.Parts = append(result.Parts, multipartPartURL{PartNumber: part, URL: presigned.URL})
+	}
+
+	log.Printf("User %d started multipart upload %s of %d parts to %s", userID, result.UploadID, create.Parts, key)
+	a.emitMetrics(map[string]string{"Category": category.Name}, metric{Name: "MultipartUploadsStarted", Value: 1, Unit: "Count"})
+
+	return httpapi.JSONResponse(http.StatusCreated, result)
+}
+
+func (a *App) completeMultipartUpload(ctx context.Context, request events.APIGatewayProxyRequest, uploader *storage.S3Uploader, category *uploadCategory, tenant string, userID int64) (events.APIGatewayProxyResponse, error) {
+	uploadID := request.PathParameters["uploadId"]
+
+	var complete multipartCompleteRequest
+	if errs := httpapi.BindAndValidate(request, &complete); len(errs) > 0 {
+		return httpapi.ValidationErrorResponse(http.StatusBadRequest, errs)
+	}
+	if !multipartKeyOwned(complete.Key, category, tenant, userID) {
+		return httpapi.ErrorResponse(http.StatusForbidden, errors.New("multipart upload does not belong to this user"))
+	}
+
+	parts := make([]types.CompletedPart, len(complete.Parts))
+	for i, part := range complete.Parts {
+		parts[i] = types.CompletedPart{PartNumber: aws.Int32(part.PartNumber), ETag: aws.String(part.ETag)}
+	}
+
+	_, err := uploader.Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(uploader.Bucket),
+		Key:             aws.String(a.multipartObjectKey(complete.Key)),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return httpapi.ErrorResponse(http.StatusBadRequest, fmt.Errorf("unable to complete multipart upload: %v", err))
+	}
+
+	log.Printf("User %d completed multipart upload %s to %s", userID, uploadID, complete.Key)
+	a.emitMetrics(map[string]string{"Category": category.Name}, metric{Name: "MultipartUploadsCompleted", Value: 1, Unit: "Count"})
+
+	// Hold the file back from its destination until it has been scanned
+	if a.scanningEnabled() {
+		return a.releaseScannedUpload(ctx, uploader, category, complete.Key)
+	}
+
+	return httpapi.JSONResponse(http.StatusOK, map[string]string{"key": complete.Key})
+}
+
+func (a *App) abortMultipartUpload(ctx context.Context, request events.APIGatewayProxyRequest, uploader *storage.S3Uploader, category *uploadCategory, tenant string, userID int64) (events.APIGatewayProxyResponse, error) {
+	uploadID := request.PathParameters["uploadId"]
+	key := request.QueryStringParameters["key"]
+	if !multipartKeyOwned(key, category, tenant, userID) {
+		return httpapi.ErrorResponse(http.StatusForbidden, errors.New("multipart upload does not belong to this user"))
+	}
+
+	_, err := uploader.Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(uploader.Bucket),
+		Key:      aws.String(a.multipartObjectKey(key)),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		return httpapi.ErrorResponse(http.StatusInternalServerError, httpapi.WithCode(httpapi.CodeUpstreamS3, err))
+	}
+
+	log.Printf("User %d aborted multipart upload %s to %s", userID, uploadID, key)
+	a.emitMetrics(map[string]string{"Category": category.Name}, metric{Name: "MultipartUploadsAborted", Value: 1, Unit: "Count"})
+
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusNoContent}, nil
+}
@@ -0,0 +1,174 @@
+//go:build integration
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// multipartFixture is the file the multipart tests upload, small enough to
+// go up as a single part.
+const multipartFixture = "id,steps\n1,4000\n2,6500\n"
+
+// multipartApp is an integration App capping every tenant at two requests
+// in flight.
+func multipartApp(t *testing.T, bucket string) *App {
+	t.Helper()
+	return integrationApp(t, map[string]string{
+		"BUCKET_NAME":               bucket,
+		"UPLOAD_CATEGORIES":         sleepCategories,
+		"TENANT_CONCURRENCY_LIMITS": `{"*": 2}`,
+	})
+}
+
+// intruders must not be able to complete or abort acmeUser's uploads.
+var intruders = []struct {
+	name   string
+	caller client
+}{
+	{name: "another tenant", caller: otherTenantUser},
+	{name: "another user", caller: acmeColleague},
+}
+
+// putPart uploads data to a presigned part URL, as a client would, and
+// returns the part's ETag.
+func putPart(t *testing.T, url, data string) string {
+	t.Helper()
+	request, err := http.NewRequest(http.MethodPut, url, strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Unable to upload part: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		t.Fatalf("part upload: status = %d: %s", response.StatusCode, body)
+	}
+	return response.Header.Get("ETag")
+}
+
+// startMultipart creates a multipart upload of one part in the sleep
+// category.
+func startMultipart(t *testing.T, app *App) multipartCreateResult {
+	t.Helper()
+	response := invoke(t, app, acmeUser, events.APIGatewayProxyRequest{
+		HTTPMethod:     http.MethodPost,
+		Resource:       "/{category}/multipart",
+		Path:           "/sleep/multipart",
+		PathParameters: map[string]string{"category": "sleep"},
+		Body:           `{"parts": 1, "content_type": "text/csv"}`,
+	})
+	if response.StatusCode != http.StatusCreated {
+		t.Fatalf("create: status = %d, want 201: %s", response.StatusCode, response.Body)
+	}
+
+	var created multipartCreateResult
+	if err := json.Unmarshal([]byte(response.Body), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.UploadID == "" || len(created.Parts) != 1 || !strings.HasPrefix(created.Key, "sleep/ACME/") {
+		t.Fatalf("create returned %+v, want one presigned part under sleep/ACME/", created)
+	}
+	return created
+}
+
+func TestIntegrationMultipartUpload(t *testing.T) {
+	bucket := createBucket(t, "uploads")
+	app := multipartApp(t, bucket.Bucket)
+
+	created := startMultipart(t, app)
+	etag := putPart(t, created.Parts[0].URL, multipartFixture)
+
+	complete, err := json.Marshal(map[string]interface{}{
+		"key":   created.Key,
+		"parts": []map[string]interface{}{{"part_number": 1, "etag": etag}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	completion := events.APIGatewayProxyRequest{
+		HTTPMethod:     http.MethodPost,
+		Resource:       "/{category}/multipart/{uploadId}/complete",
+		Path:           "/sleep/multipart/" + created.UploadID + "/complete",
+		PathParameters: map[string]string{"category": "sleep", "uploadId": created.UploadID},
+		Body:           string(complete),
+	}
+
+	for _, intruder := range intruders {
+		if response := invoke(t, app, intruder.caller, completion); response.StatusCode != http.StatusForbidden {
+			t.Fatalf("complete by %s: status = %d, want 403: %s", intruder.name, response.StatusCode, response.Body)
+		}
+	}
+	if keys := listKeys(t, bucket); len(keys) != 0 {
+		t.Fatalf("forbidden completions stored %v", keys)
+	}
+
+	response := invoke(t, app, acmeUser, completion)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("complete: status = %d, want 200: %s", response.StatusCode, response.Body)
+	}
+
+	if keys := listKeys(t, bucket); len(keys) != 1 || keys[0] != created.Key {
+		t.Fatalf("bucket holds %v, want only %s", keys, created.Key)
+	}
+	stored, contentType := readObject(t, bucket, created.Key)
+	if stored != multipartFixture || contentType != "text/csv" {
+		t.Errorf("stored %q (%s), want the fixture (text/csv)", stored, contentType)
+	}
+
+	// every request gave its concurrency slot back
+	for _, tenant := range []string{"ACME", "OTHER"} {
+		if members := app.Redis.ZRange("concurrency:"+tenant, 0, -1).Val(); len(members) != 0 {
+			t.Errorf("%s concurrency slots still held: %v", tenant, members)
+		}
+	}
+}
+
+func TestIntegrationMultipartAbort(t *testing.T) {
+	bucket := createBucket(t, "uploads")
+	app := multipartApp(t, bucket.Bucket)
+
+	created := startMultipart(t, app)
+	putPart(t, created.Parts[0].URL, multipartFixture)
+
+	abort := events.APIGatewayProxyRequest{
+		HTTPMethod:            http.MethodDelete,
+		Resource:              "/{category}/multipart/{uploadId}",
+		Path:                  "/sleep/multipart/" + created.UploadID,
+		PathParameters:        map[string]string{"category": "sleep", "uploadId": created.UploadID},
+		QueryStringParameters: map[string]string{"key": created.Key},
+	}
+
+	for _, intruder := range intruders {
+		if response := invoke(t, app, intruder.caller, abort); response.StatusCode != http.StatusForbidden {
+			t.Fatalf("abort by %s: status = %d, want 403: %s", intruder.name, response.StatusCode, response.Body)
+		}
+	}
+
+	if response := invoke(t, app, acmeUser, abort); response.StatusCode != http.StatusNoContent {
+		t.Fatalf("abort: status = %d, want 204: %s", response.StatusCode, response.Body)
+	}
+
+	uploads, err := bucket.Client.ListMultipartUploads(context.Background(), &s3.ListMultipartUploadsInput{Bucket: aws.String(bucket.Bucket)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads.Uploads) != 0 {
+		t.Errorf("%d multipart uploads still open after the abort", len(uploads.Uploads))
+	}
+	if keys := listKeys(t, bucket); len(keys) != 0 {
+		t.Errorf("aborted upload left %v behind", keys)
+	}
+}
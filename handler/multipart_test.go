@@ -0,0 +1,33 @@
+package handler
+
+import "testing"
+
+func TestMultipartKeyOwned(t *testing.T) {
+	category := &uploadCategory{Name: "sleep", Prefix: "sleep"}
+
+	tests := []struct {
+		name   string
+		key    string
+		tenant string
+		userID int64
+		want   bool
+	}{
+		{name: "own key", key: "sleep/ACME/2026/1/2/03:04:05_7_sleep.bin", tenant: "ACME", userID: 7, want: true},
+		{name: "own default tenant key", key: "sleep/2026/1/2/03:04:05_7_sleep.bin", tenant: defaultTenant, userID: 7, want: true},
+		{name: "another tenant", key: "sleep/ACME/2026/1/2/03:04:05_7_sleep.bin", tenant: "OTHER", userID: 7},
+		{name: "another tenant from the default tenant", key: "sleep/ACME/2026/1/2/03:04:05_7_sleep.bin", tenant: defaultTenant, userID: 7},
+		{name: "default tenant key from another tenant", key: "sleep/2026/1/2/03:04:05_7_sleep.bin", tenant: "ACME", userID: 7},
+		{name: "another user", key: "sleep/ACME/2026/1/2/03:04:05_8_sleep.bin", tenant: "ACME", userID: 7},
+		{name: "another category", key: "steps/ACME/2026/1/2/03:04:05_7_sleep.bin", tenant: "ACME", userID: 7},
+		{name: "not a multipart upload", key: "sleep/ACME/2026/1/2/03:04:05_7_sleep.json", tenant: "ACME", userID: 7},
+		{name: "path traversal", key: "sleep/ACME/2026/../../OTHER/03:04:05_7_sleep.bin", tenant: "ACME", userID: 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := multipartKeyOwned(tt.key, category, tt.tenant, tt.userID); got != tt.want {
+				t.Errorf("multipartKeyOwned(%q, %q, %d) = %v, want %v", tt.key, tt.tenant, tt.userID, got, tt.want)
+			}
+		})
+	}
+}
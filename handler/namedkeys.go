@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/httpapi"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/storage"
+)
+
+// documentNamePattern limits the names clients give documents to ones that
+// are safe in an object key.
+var documentNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+var errNoConditionalWrites = errors.New("the bucket's uploader does not support conditional writes")
+
+// isDocumentRoute reports whether the request is a PUT to a named document,
+// /{category}/documents/{name}, which clients overwrite in place.
+func isDocumentRoute(request events.APIGatewayProxyRequest) bool {
+	return request.HTTPMethod == http.MethodPut && strings.HasSuffix(request.Resource, "/documents/{name}")
+}
+
+// documentName is the name of the document the request is for, checked to
+// be safe in a key.
+func documentName(request events.APIGatewayProxyRequest) (string, error) {
+	name := request.PathParameters["name"]
+	if !documentNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid document name %q", name)
+	}
+	return name, nil
+}
+
+// documentKey is where a user's named document is kept. Unlike upload keys
+// it stays the same from one write to the next.
+func documentKey(category *uploadCategory, tenant string, userID int64, name, extension string) string {
+	return fmt.Sprintf("%s/users/%d/%s.%s", category.keyPrefix(tenant), userID, name, extension)
+}
+
+// requestPrecondition reads If-Match and If-None-Match. S3 conditional
+// writes only support If-None-Match: *, which creates the document only if
+// it does not exist yet.
+func requestPrecondition(request events.APIGatewayProxyRequest) (storage.Precondition, error) {
+	condition := storage.Precondition{
+		IfMatch:     httpapi.RequestHeader(request, "If-Match"),
+		IfNoneMatch: httpapi.RequestHeader(request, "If-None-Match"),
+	}
+	if condition.IfNoneMatch != "" && condition.IfNoneMatch != "*" {
+		return storage.Precondition{}, errors.New("If-None-Match only supports *")
+	}
+	if condition.IfMatch != "" && condition.IfNoneMatch != "" {
+		return storage.Precondition{}, errors.New("If-Match and If-None-Match cannot be used together")
+	}
+	return condition, nil
+}
+
+// uploadNamedDocument overwrites a named document if options.Condition
+// holds and returns its new ETag.
+func uploadNamedDocument(ctx context.Context, uploader storage.Uploader, key string, object storedObject, metadata map[string]string, options storage.ObjectOptions) (string, error) {
+	conditional, ok := uploader.(storage.ConditionalUploader)
+	if !ok {
+		return "", errNoConditionalWrites
+	}
+	if withOptions, ok := uploader.(storage.OptionsUploader); ok {
+		return withOptions.UploadObjectWith(ctx, key, object.data, object.contentType, metadata, options)
+	}
+	return conditional.UploadObjectIf(ctx, key, object.data, object.contentType, metadata, options.Condition)
+}
+
+// preconditionFailed answers a write whose condition no longer held with
+// the document's current ETag, so the client can re-read and retry.
+func preconditionFailed(ctx context.Context, uploader storage.Uploader, key string) *uploadFailure {
+	failure := failed(http.StatusPreconditionFailed, storage.ErrPreconditionFailed)
+
+	current, err := uploader.(storage.ConditionalUploader).ETag(ctx, key)
+	if err != nil {
+		log.Printf("Unable to read the current ETag of %s: %v", key, err)
+	}
+	failure.etag = current
+	return failure
+}
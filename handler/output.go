@@ -0,0 +1,256 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"sort"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// Output formats a category can store its uploads in.
+const (
+	outputFormatJSON    = "json"
+	outputFormatParquet = "parquet"
+	outputFormatAvro    = "avro"
+)
+
+// avroName is what Avro allows for record and field names.
+var avroName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// storedObject is an upload ready to be written, in its final format.
+type storedObject struct {
+	data        string
+	extension   string
+	contentType string
+}
+
+// convertOutput converts the payload to the category's output format. Only
+// flat payloads (an object, or an array of objects, of scalar fields all
+// declared in the schema) can be converted; anything else, or any conversion
+// failure, falls back to storing the JSON as is. parse supplies the payload
+// unmarshalled, and is only called when there is a conversion to do.
+func (a *App) convertOutput(category *uploadCategory, schema *payloadSchema, payload string, parse func() (interface{}, error)) storedObject {
+	raw := storedObject{data: payload, extension: "json", contentType: "application/json"}
+
+	if category.OutputFormat == "" || category.OutputFormat == outputFormatJSON {
+		return raw
+	}
+
+	var converted storedObject
+	columns, rows, err := flatRows(schema, parse)
+	if err == nil {
+		switch category.OutputFormat {
+		case outputFormatParquet:
+			converted.data, err = toParquet(columns, schema, rows)
+			converted.extension, converted.contentType = "parquet", "application/vnd.apache.parquet"
+		case outputFormatAvro:
+			converted.data, err = toAvro(category.Name, columns, schema, rows)
+			converted.extension, converted.contentType = "avro", "application/avro"
+		default:
+			err = fmt.Errorf("unknown output format %q", category.OutputFormat)
+		}
+	}
+
+	if err != nil {
+		log.Printf("Storing %s upload as JSON, %s conversion failed: %v", category.Name, category.OutputFormat, err)
+		a.emitMetrics(map[string]string{
+			"Category":     category.Name,
+			"OutputFormat": category.OutputFormat,
+		}, metric{Name: "OutputConversionFallbacks", Value: 1, Unit: "Count"})
+		return raw
+	}
+
+	return converted
+}
+
+// flatRows checks the payload is flat and matches the schema, returning the
+// sorted column names and one row per object.
+func flatRows(schema *payloadSchema, parse func() (interface{}, error)) ([]string, []map[string]interface{}, error) {
+	if schema == nil || len(schema.Properties) == 0 {
+		return nil, nil, errors.New("no registered schema properties to derive columns from")
+	}
+
+	temp, err := parse()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var rows []map[string]interface{}
+	switch v := temp.(type) {
+	case map[string]interface{}:
+		rows = append(rows, v)
+	case []interface{}:
+		for _, item := range v {
+			row, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, nil, errors.New("array items must be objects")
+			}
+			rows = append(rows, row)
+		}
+	default:
+		return nil, nil, errors.New("payload must be an object or array of objects")
+	}
+
+	columns := make([]string, 0, len(schema.Properties))
+	for field, fieldType := range schema.Properties {
+		switch fieldType {
+		case "string", "number", "boolean":
+		default:
+			return nil, nil, fmt.Errorf("field %q is not a scalar", field)
+		}
+		columns = append(columns, field)
+	}
+	sort.Strings(columns)
+
+	for _, row := range rows {
+		for field, value := range row {
+			want, ok := schema.Properties[field]
+			if !ok {
+				return nil, nil, fmt.Errorf("field %q is not in the schema", field)
+			}
+			if value != nil && jsonType(value) != want {
+				return nil, nil, fmt.Errorf("field %q must be a JSON %s", field, want)
+			}
+		}
+	}
+
+	return columns, rows, nil
+}
+
+func toParquet(columns []string, schema *payloadSchema, rows []map[string]interface{}) (string, error) {
+	group := parquet.Group{}
+	for _, column := range columns {
+		switch schema.Properties[column] {
+		case "string":
+			group[column] = parquet.Optional(parquet.String())
+		case "number":
+			group[column] = parquet.Optional(parquet.Leaf(parquet.DoubleType))
+		case "boolean":
+			group[column] = parquet.Optional(parquet.Leaf(parquet.BooleanType))
+		}
+	}
+	parquetSchema := parquet.NewSchema("upload", group)
+
+	// the schema orders its columns by name, as columns already is
+	var buf bytes.Buffer
+	writer := parquet.NewWriter(&buf, parquetSchema, parquet.Compression(&parquet.Snappy))
+	for _, row := range rows {
+		values := make(parquet.Row, len(columns))
+		for i, column := range columns {
+			switch v := row[column].(type) {
+			case string:
+				values[i] = parquet.ByteArrayValue([]byte(v)).Level(0, 1, i)
+			case float64:
+				values[i] = parquet.DoubleValue(v).Level(0, 1, i)
+			case bool:
+				values[i] = parquet.BooleanValue(v).Level(0, 1, i)
+			default:
+				values[i] = parquet.NullValue().Level(0, 0, i)
+			}
+		}
+		if _, err := writer.WriteRows([]parquet.Row{values}); err != nil {
+			return "", err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// toAvro encodes the rows as an Avro object container file with a single
+// block, every field being a nullable union.
+func toAvro(name string, columns []string, schema *payloadSchema, rows []map[string]interface{}) (string, error) {
+	if !avroName.MatchString(name) {
+		name = "upload"
+	}
+
+	type avroField struct {
+		Name    string      `json:"name"`
+		Type    []string    `json:"type"`
+		Default interface{} `json:"default"`
+	}
+
+	fields := make([]avroField, len(columns))
+	for i, column := range columns {
+		if !avroName.MatchString(column) {
+			return "", fmt.Errorf("field %q is not a valid Avro name", column)
+		}
+		avroType := map[string]string{"string": "string", "number": "double", "boolean": "boolean"}[schema.Properties[column]]
+		fields[i] = avroField{Name: column, Type: []string{"null", avroType}}
+	}
+
+	avroSchema, err := json.Marshal(map[string]interface{}{
+		"type":   "record",
+		"name":   name,
+		"fields": fields,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sync := make([]byte, 16)
+	if _, err := rand.Read(sync); err != nil {
+		return "", err
+	}
+
+	var block bytes.Buffer
+	for _, row := range rows {
+		for _, column := range columns {
+			switch v := row[column].(type) {
+			case string:
+				writeAvroLong(&block, 1)
+				writeAvroBytes(&block, []byte(v))
+			case float64:
+				writeAvroLong(&block, 1)
+				block.Write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(v)))
+			case bool:
+				writeAvroLong(&block, 1)
+				if v {
+					block.WriteByte(1)
+				} else {
+					block.WriteByte(0)
+				}
+			default:
+				writeAvroLong(&block, 0)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("Obj\x01")
+	writeAvroLong(&buf, 2)
+	writeAvroBytes(&buf, []byte("avro.schema"))
+	writeAvroBytes(&buf, avroSchema)
+	writeAvroBytes(&buf, []byte("avro.codec"))
+	writeAvroBytes(&buf, []byte("null"))
+	writeAvroLong(&buf, 0)
+	buf.Write(sync)
+
+	writeAvroLong(&buf, int64(len(rows)))
+	writeAvroLong(&buf, int64(block.Len()))
+	buf.Write(block.Bytes())
+	buf.Write(sync)
+
+	return buf.String(), nil
+}
+
+// writeAvroLong writes a zig-zag encoded variable-length long.
+func writeAvroLong(buf *bytes.Buffer, n int64) {
+	var scratch [binary.MaxVarintLen64]byte
+	buf.Write(scratch[:binary.PutVarint(scratch[:], n)])
+}
+
+func writeAvroBytes(buf *bytes.Buffer, b []byte) {
+	writeAvroLong(buf, int64(len(b)))
+	buf.Write(b)
+}
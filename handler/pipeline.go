@@ -0,0 +1,371 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/httpapi"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/storage"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/validation"
+)
+
+// defaultPipeline is the stages a document goes through when its category
+// does not list its own.
+var defaultPipeline = []string{"decode", "harden", "validate", "redact", "profile", "enrich", "encrypt", "convert", "upload"}
+
+// pipelineStage is one step of a document's way to S3. Stages take the
+// document's payload, the JSON as it stands, and may replace it, build up
+// what is stored, or fail the document.
+type pipelineStage struct {
+	run func(ctx context.Context, a *App, doc *pipelineDocument) *uploadFailure
+	// timing is the latency budget the time up to the end of the stage
+	// counts against, if any.
+	timing string
+}
+
+// pipelineStages are the stages categories can list, by name.
+var pipelineStages = map[string]pipelineStage{
+	"decode":   {run: decodeStage},
+	"harden":   {run: hardenStage},
+	"validate": {run: validateStage},
+	"redact":   {run: redactStage, timing: "validation"},
+	"profile":  {run: profileStage},
+	"enrich":   {run: enrichStage},
+	"encrypt":  {run: encryptStage},
+	"convert":  {run: convertStage},
+	"upload":   {run: uploadStage, timing: "upload"},
+}
+
+// pipelineDocument is a document on its way through the pipeline.
+type pipelineDocument struct {
+	uploadDocument
+	timer *stageTimer
+
+	schema *payloadSchema
+	// response is the JSON echoed back to the client, kept by stages that
+	// change the payload in ways the client should not see.
+	response string
+	object   storedObject
+	metadata map[string]string
+	stored   storedDocument
+
+	// parsed is the payload as parsedPayload unmarshalled it, kept until a
+	// stage replaces the payload through setPayload.
+	parsed    interface{}
+	parseErr  error
+	hasParsed bool
+}
+
+// parsedPayload is the payload unmarshalled into interface{}. It is parsed
+// at most once for the stages that inspect it rather than once per stage.
+func (doc *pipelineDocument) parsedPayload() (interface{}, error) {
+	if !doc.hasParsed {
+		doc.parseErr = json.Unmarshal([]byte(doc.payload), &doc.parsed)
+		doc.hasParsed = true
+	}
+	return doc.parsed, doc.parseErr
+}
+
+// setPayload replaces the payload, dropping the parsed copy of the old one.
+func (doc *pipelineDocument) setPayload(payload string) {
+	doc.payload = payload
+	doc.parsed, doc.parseErr, doc.hasParsed = nil, nil, false
+}
+
+// guardStages are the stages that keep malformed, invalid and personal data
+// out of the bucket. A category's pipeline must run them, before the stages
+// that rewrite the payload for storage, unless the category sets
+// allow_unvalidated_pipeline.
+var guardStages = []string{"harden", "validate", "redact"}
+
+// storageStages rewrite the payload into what is stored, which the guard
+// stages can no longer check.
+var storageStages = map[string]bool{"encrypt": true, "convert": true}
+
+// checkPipeline rejects pipelines with unknown stages, that do not end by
+// uploading the document or, unless allowUnvalidated is set, that skip a
+// guard stage or run it too late.
+func checkPipeline(stages []string, allowUnvalidated bool) error {
+	positions := map[string]int{}
+	firstStorage := len(stages)
+	for i, name := range stages {
+		if _, ok := pipelineStages[name]; !ok {
+			return fmt.Errorf("unknown pipeline stage %q", name)
+		}
+		if name == "upload" && i != len(stages)-1 {
+			return errors.New("upload must be the last pipeline stage")
+		}
+		if storageStages[name] && i < firstStorage {
+			firstStorage = i
+		}
+		positions[name] = i
+	}
+	if len(stages) == 0 || stages[len(stages)-1] != "upload" {
+		return errors.New("pipeline must end with upload")
+	}
+
+	if allowUnvalidated {
+		return nil
+	}
+	for _, name := range guardStages {
+		position, ok := positions[name]
+		if !ok {
+			return fmt.Errorf("pipeline must include %s, or set allow_unvalidated_pipeline", name)
+		}
+		if position > firstStorage {
+			return fmt.Errorf("%s must run before %s", name, stages[firstStorage])
+		}
+	}
+	return nil
+}
+
+// pipeline is the category's own stages, or the default ones.
+func (c *uploadCategory) pipeline() []string {
+	if len(c.Pipeline) > 0 {
+		return c.Pipeline
+	}
+	return defaultPipeline
+}
+
+// runPipeline runs the document through each of its category's stages in
+// turn, stopping at the first that fails it.
+func (a *App) runPipeline(ctx context.Context, doc *pipelineDocument) *uploadFailure {
+	for _, name := range doc.category.pipeline() {
+		stage := pipelineStages[name]
+		if failure := stage.run(ctx, a, doc); failure != nil {
+			return failure
+		}
+		if stage.timing != "" {
+			doc.timer.mark(stage.timing)
+		}
+	}
+	return nil
+}
+
+// decodeStage converts form and CSV payloads from older devices to JSON.
+func decodeStage(ctx context.Context, a *App, doc *pipelineDocument) *uploadFailure {
+	payload, originalContentType, err := canonicalJSON(doc.payload, doc.contentType, doc.base64Encoded)
+	if errors.Is(err, errUnsupportedContentType) {
+		return failed(http.StatusUnsupportedMediaType, err)
+	}
+	if err != nil {
+		return failed(http.StatusBadRequest, err)
+	}
+
+	doc.setPayload(payload)
+	if originalContentType != "" {
+		doc.setMetadata(originalContentTypeMetadataKey, originalContentType)
+	}
+	return nil
+}
+
+// hardenStage rejects JSON constructs that downstream consumers parse
+// differently or not at all.
+func hardenStage(ctx context.Context, a *App, doc *pipelineDocument) *uploadFailure {
+	errs, err := validation.Harden(a.getenv, doc.payload)
+	if err != nil {
+		return failed(http.StatusInternalServerError, err)
+	}
+	if len(errs) > 0 {
+		return invalid(http.StatusBadRequest, errs, "")
+	}
+	return nil
+}
+
+// validateStage checks the JSON structure, then the payload against the
+// schema version the client uses.
+func validateStage(ctx context.Context, a *App, doc *pipelineDocument) *uploadFailure {
+	category, payload := doc.category, doc.payload
+
+	if errs := validation.ValidateJSON(payload); errs != nil {
+		if a.quarantineEnabled() {
+			return invalid(500, errs, a.quarantinePayload(doc.uploader, category, doc.requestID, doc.userID, payload, errs))
+		}
+		return invalid(500, errs, "")
+	}
+
+	schema, ok := category.schemaFor(doc.schemaVersion)
+	if !ok {
+		return failed(http.StatusBadRequest, fmt.Errorf("unknown schema version %q for category %q", doc.schemaVersion, category.Name))
+	}
+	if schema == nil {
+		return nil
+	}
+	value, err := doc.parsedPayload()
+	if err != nil {
+		return failed(http.StatusBadRequest, err)
+	}
+	if errs := schema.validateValue(value); len(errs) > 0 {
+		if a.schemaInferenceEnabled() {
+			storeInferenceReport(ctx, doc.uploader, category, doc.requestID, value, errs)
+		}
+		if a.quarantineEnabled() {
+			return invalid(http.StatusBadRequest, errs, a.quarantinePayload(doc.uploader, category, doc.requestID, doc.userID, payload, errs))
+		}
+		return invalid(http.StatusBadRequest, errs, "")
+	}
+
+	doc.schema = schema
+	return nil
+}
+
+// redactStage rejects or masks personal data clients send by mistake.
+func redactStage(ctx context.Context, a *App, doc *pipelineDocument) *uploadFailure {
+	body, piiErrs, err := validation.CheckPII(a.getenv, doc.payload)
+	if err != nil {
+		return failed(http.StatusInternalServerError, err)
+	}
+	if len(piiErrs) > 0 {
+		return invalid(http.StatusUnprocessableEntity, piiErrs, "")
+	}
+
+	doc.setPayload(body)
+	return nil
+}
+
+// profileStage records the shape of a sample of payloads for capacity
+// planning.
+func profileStage(ctx context.Context, a *App, doc *pipelineDocument) *uploadFailure {
+	a.profilePayload(doc.category, doc.payload, doc.parsedPayload)
+	return nil
+}
+
+// encryptStage encrypts sensitive fields before the object lands in S3. The
+// client is still answered with the plaintext.
+func encryptStage(ctx context.Context, a *App, doc *pipelineDocument) *uploadFailure {
+	encrypted, metadata, err := a.encryptFields(ctx, doc.category, doc.payload)
+	if err != nil {
+		return failed(http.StatusInternalServerError, err)
+	}
+
+	if doc.response == "" {
+		doc.response = doc.payload
+	}
+	doc.setPayload(encrypted)
+	for k, v := range metadata {
+		doc.setMetadata(k, v)
+	}
+	return nil
+}
+
+// convertStage converts to the category's output format, falling back to
+// JSON.
+func convertStage(ctx context.Context, a *App, doc *pipelineDocument) *uploadFailure {
+	doc.object = a.convertOutput(doc.category, doc.schema, doc.payload, doc.parsedPayload)
+	return nil
+}
+
+// uploadStage writes the document to S3, at its dated key or, for named
+// documents, at the user's stable key for it.
+func uploadStage(ctx context.Context, a *App, doc *pipelineDocument) *uploadFailure {
+	category, object := doc.category, doc.object
+	if object.extension == "" {
+		// no convert stage; store the JSON as it stands
+		object = storedObject{data: doc.payload, extension: "json", contentType: "application/json"}
+	}
+
+	now := a.Clock.Now()
+	fileName := fmt.Sprintf("%s/%d/%d/%d/%v_%d_%s%s.%s",
+		category.keyPrefix(doc.tenant), now.Year(), now.Month(), now.Day(), now.Format("15:04:05"), doc.userID, category.Name, doc.keySuffix, object.extension)
+	if doc.name != "" {
+		fileName = documentKey(category, doc.tenant, doc.userID, doc.name, object.extension)
+	}
+
+	// Give up now rather than time out halfway through the S3 call
+	if err := a.checkUploadDeadline(ctx); err != nil {
+		return failed(http.StatusGatewayTimeout, err)
+	}
+
+	options := doc.options
+
+	// Hold the tenant to its storage quota, counting the object the upload
+	// is stored in rather than the pointer or copies written beside it
+	quotaKey := fileName
+	if doc.name == "" && options.contentAddressedLayout {
+		quotaKey, _ = contentKey(doc.tenant, object)
+	}
+	releaseQuota, withinQuota, err := a.reserveStorage(doc.tenant, quotaObject(bucketOf(doc.uploader), quotaKey), len(object.data))
+	if err != nil {
+		return failed(http.StatusInternalServerError, err)
+	}
+	if !withinQuota {
+		return failed(http.StatusForbidden, httpapi.WithCode(httpapi.CodeQuotaExceeded, errQuotaExceeded))
+	}
+
+	objectKey, etag := fileName, ""
+	if doc.name != "" {
+		etag, err = uploadNamedDocument(ctx, doc.uploader, fileName, object, doc.metadata, storage.ObjectOptions{Condition: doc.condition, Tags: tenantTags(doc.tenant)})
+	} else if options.contentAddressedLayout {
+		objectKey, err = storeContentAddressed(ctx, doc.uploader, doc.tenant, fileName, contentPointer{
+			UserID:     doc.userID,
+			Category:   category.Name,
+			UploadedAt: now.UTC(),
+		}, object, doc.metadata, storage.ObjectOptions{Tags: tenantTags(doc.tenant), Lock: true})
+	} else {
+		err = uploadObject(ctx, doc.uploader, fileName, object, doc.metadata, storage.ObjectOptions{Tags: tenantTags(doc.tenant), Lock: true})
+	}
+	if errors.Is(err, storage.ErrPreconditionFailed) {
+		releaseQuota()
+		return preconditionFailed(ctx, doc.uploader, fileName)
+	}
+	if err != nil {
+		releaseQuota()
+		return failed(500, httpapi.WithCode(httpapi.CodeUpstreamS3, err))
+	}
+	a.emitMetrics(map[string]string{"Category": category.Name, "Tenant": a.metricTenant(doc.tenant)},
+		metric{Name: "Uploads", Value: 1, Unit: "Count"},
+		metric{Name: "UploadBytes", Value: float64(len(object.data)), Unit: "Bytes"},
+	)
+
+	// Keep a copy of the user's most recent upload at a stable key
+	if doc.name == "" && a.latestEnabled(category) {
+		a.writeLatest(doc.uploadDocument, objectKey, object, doc.metadata)
+	}
+
+	body := doc.response
+	if body == "" {
+		body = doc.payload
+	}
+	doc.stored = storedDocument{
+		key:        objectKey,
+		fileName:   fileName,
+		body:       body,
+		object:     object,
+		metadata:   doc.metadata,
+		schema:     doc.schema,
+		uploadedAt: now,
+		etag:       etag,
+	}
+
+	// Hand the stored object on for heavy post-processing
+	if a.workflowEnabled(category) {
+		executionARN, err := a.startWorkflow(ctx, doc.uploadDocument, objectKey)
+		if err != nil && a.workflowFailuresFatal() {
+			return workflowFailed(objectKey, err)
+		}
+		doc.stored.executionARN = executionARN
+	}
+	return nil
+}
+
+// setMetadata adds an entry to the object metadata stored with the
+// document.
+func (doc *pipelineDocument) setMetadata(key, value string) {
+	if doc.metadata == nil {
+		doc.metadata = map[string]string{}
+	}
+	doc.metadata[key] = value
+}
+
+// uploadObject writes an upload's own object with its options, on uploaders
+// that take them.
+func uploadObject(ctx context.Context, uploader storage.Uploader, key string, object storedObject, metadata map[string]string, options storage.ObjectOptions) error {
+	if withOptions, ok := uploader.(storage.OptionsUploader); ok {
+		_, err := withOptions.UploadObjectWith(ctx, key, object.data, object.contentType, metadata, options)
+		return err
+	}
+	return uploader.UploadObject(key, object.data, object.contentType, metadata)
+}
@@ -0,0 +1,225 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootsdigitalhealth/lambda-upload-s3/upload/uploadtest"
+)
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+var testNow = fixedClock(time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC))
+
+func TestCheckPipeline(t *testing.T) {
+	tests := []struct {
+		name             string
+		stages           []string
+		allowUnvalidated bool
+		wantErr          string
+	}{
+		{name: "default", stages: defaultPipeline},
+		{name: "guards only", stages: []string{"harden", "validate", "redact", "upload"}},
+		{name: "empty", stages: nil, wantErr: "pipeline must end with upload"},
+		{name: "unknown stage", stages: []string{"harden", "validate", "redact", "shred", "upload"}, wantErr: `unknown pipeline stage "shred"`},
+		{name: "upload not last", stages: []string{"harden", "validate", "upload", "redact"}, wantErr: "upload must be the last pipeline stage"},
+		{name: "no upload", stages: []string{"harden", "validate", "redact"}, wantErr: "pipeline must end with upload"},
+		{name: "missing harden", stages: []string{"validate", "redact", "upload"}, wantErr: "pipeline must include harden"},
+		{name: "missing validate", stages: []string{"harden", "redact", "upload"}, wantErr: "pipeline must include validate"},
+		{name: "missing redact", stages: []string{"harden", "validate", "upload"}, wantErr: "pipeline must include redact"},
+		{name: "validate after encrypt", stages: []string{"harden", "encrypt", "validate", "redact", "upload"}, wantErr: "validate must run before encrypt"},
+		{name: "redact after convert", stages: []string{"harden", "validate", "convert", "redact", "upload"}, wantErr: "redact must run before convert"},
+		{name: "reviewed bypass", stages: []string{"decode", "upload"}, allowUnvalidated: true},
+		{name: "bypass still needs upload", stages: []string{"decode"}, allowUnvalidated: true, wantErr: "pipeline must end with upload"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPipeline(tt.stages, tt.allowUnvalidated)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkPipeline() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkPipeline() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPipelineStages(t *testing.T) {
+	schema := &payloadSchema{Version: "2", Type: "object", Required: []string{"steps"}, Properties: map[string]string{"steps": "number"}}
+	category := &uploadCategory{Name: "activity", Prefix: "actions", Schema: schema}
+
+	tests := []struct {
+		name  string
+		stage string
+		env   map[string]string
+		doc   uploadDocument
+		// wantStatus is the failure's status, or 0 for success.
+		wantStatus  int
+		wantPayload string
+		wantErrRule string
+	}{
+		{
+			name:        "decode leaves JSON alone",
+			stage:       "decode",
+			doc:         uploadDocument{payload: `{"steps":1}`, contentType: "application/json"},
+			wantPayload: `{"steps":1}`,
+		},
+		{
+			name:        "decode converts forms",
+			stage:       "decode",
+			doc:         uploadDocument{payload: "steps=1", contentType: "application/x-www-form-urlencoded"},
+			wantPayload: `{"steps":"1"}`,
+		},
+		{
+			name:       "decode rejects other media types",
+			stage:      "decode",
+			doc:        uploadDocument{payload: "<steps/>", contentType: "application/xml"},
+			wantStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:  "harden accepts plain JSON",
+			stage: "harden",
+			doc:   uploadDocument{payload: `{"steps":1}`},
+		},
+		{
+			name:        "harden rejects duplicate keys",
+			stage:       "harden",
+			doc:         uploadDocument{payload: `{"steps":1,"steps":2}`},
+			wantStatus:  http.StatusBadRequest,
+			wantErrRule: "duplicate_key",
+		},
+		{
+			name:  "validate accepts a conforming payload",
+			stage: "validate",
+			doc:   uploadDocument{payload: `{"steps":1}`},
+		},
+		{
+			name:        "validate rejects malformed JSON",
+			stage:       "validate",
+			doc:         uploadDocument{payload: `{"steps":`},
+			wantStatus:  http.StatusInternalServerError,
+			wantErrRule: "syntax",
+		},
+		{
+			name:        "validate checks the schema",
+			stage:       "validate",
+			doc:         uploadDocument{payload: `{"steps":"many"}`},
+			wantStatus:  http.StatusBadRequest,
+			wantErrRule: "type",
+		},
+		{
+			name:        "validate requires fields",
+			stage:       "validate",
+			doc:         uploadDocument{payload: `{}`},
+			wantStatus:  http.StatusBadRequest,
+			wantErrRule: "required",
+		},
+		{
+			name:       "validate rejects unknown schema versions",
+			stage:      "validate",
+			doc:        uploadDocument{payload: `{"steps":1}`, schemaVersion: "9"},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:        "redact is off by default",
+			stage:       "redact",
+			doc:         uploadDocument{payload: `{"note":"me@example.com"}`},
+			wantPayload: `{"note":"me@example.com"}`,
+		},
+		{
+			name:        "redact rejects personal data",
+			stage:       "redact",
+			env:         map[string]string{"PII_MODE": "reject"},
+			doc:         uploadDocument{payload: `{"note":"me@example.com"}`},
+			wantStatus:  http.StatusUnprocessableEntity,
+			wantErrRule: "pii:email",
+		},
+		{
+			name:        "redact masks personal data",
+			stage:       "redact",
+			env:         map[string]string{"PII_MODE": "redact"},
+			doc:         uploadDocument{payload: `{"note":"me@example.com"}`},
+			wantPayload: `{"note":"[REDACTED:email]"}`,
+		},
+		{
+			name:        "enrich replaces the client's _meta",
+			stage:       "enrich",
+			env:         map[string]string{"ENRICHMENT_MODE": "body"},
+			doc:         uploadDocument{payload: `{"_meta":{"user_id":1},"steps":1}`, userID: 7, requestID: "r1", tenant: defaultTenant},
+			wantPayload: `{"_meta":{"user_id":7,"received_at":"2026-01-02T03:04:05Z","request_id":"r1"},"steps":1}`,
+		},
+		{
+			name:        "enrich leaves arrays alone",
+			stage:       "enrich",
+			env:         map[string]string{"ENRICHMENT_MODE": "body"},
+			doc:         uploadDocument{payload: `[1]`, userID: 7, tenant: defaultTenant},
+			wantPayload: `[1]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &App{Clock: testNow, Getenv: func(key string) string { return tt.env[key] }}
+			tt.doc.category = category
+			doc := &pipelineDocument{uploadDocument: tt.doc}
+
+			failure := pipelineStages[tt.stage].run(context.Background(), app, doc)
+			if tt.wantStatus == 0 {
+				if failure != nil {
+					t.Fatalf("%s stage failed with %d: %v %v", tt.stage, failure.status, failure.err, failure.errs)
+				}
+			} else {
+				if failure == nil {
+					t.Fatalf("%s stage succeeded, want status %d", tt.stage, tt.wantStatus)
+				}
+				if failure.status != tt.wantStatus {
+					t.Errorf("status = %d, want %d", failure.status, tt.wantStatus)
+				}
+				if tt.wantErrRule != "" && (len(failure.errs) == 0 || failure.errs[0].Rule != tt.wantErrRule) {
+					t.Errorf("errors = %v, want rule %q", failure.errs, tt.wantErrRule)
+				}
+			}
+			if tt.wantPayload != "" && doc.payload != tt.wantPayload {
+				t.Errorf("payload = %s, want %s", doc.payload, tt.wantPayload)
+			}
+		})
+	}
+}
+
+func TestUploadStage(t *testing.T) {
+	uploader := &uploadtest.MemoryUploader{}
+	doc := &pipelineDocument{uploadDocument: uploadDocument{
+		uploader: uploader,
+		category: &uploadCategory{Name: "activity", Prefix: "actions"},
+		tenant:   "BRAND_A",
+		userID:   7,
+		payload:  `{"steps":1}`,
+	}}
+
+	app := &App{Clock: testNow, Getenv: func(string) string { return "" }}
+	if failure := uploadStage(context.Background(), app, doc); failure != nil {
+		t.Fatalf("upload stage failed with %d: %v", failure.status, failure.err)
+	}
+
+	want := "actions/BRAND_A/2026/1/2/03:04:05_7_activity.json"
+	if doc.stored.key != want {
+		t.Fatalf("stored key = %q, want %q", doc.stored.key, want)
+	}
+	object, ok := uploader.Object(want)
+	if !ok {
+		t.Fatalf("nothing stored at %s; have %v", want, uploader.Keys())
+	}
+	if object.Data != `{"steps":1}` || object.ContentType != "application/json" {
+		t.Errorf("stored %+v", object)
+	}
+}
@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultPoolConcurrency is how many items a pool works on at once when its
+// concurrency variable is not set.
+const defaultPoolConcurrency = 8
+
+// workerPool works through the items of a multi-object upload a bounded
+// number at a time.
+type workerPool struct {
+	app *App
+	// name is the Pool dimension of the pool's metrics.
+	name        string
+	concurrency int
+	// itemTimeout bounds each item; zero leaves only the caller's deadline.
+	itemTimeout time.Duration
+}
+
+// newWorkerPool configures a pool from {prefix}_CONCURRENCY and
+// {prefix}_ITEM_TIMEOUT_MS.
+func (a *App) newWorkerPool(name, prefix string) workerPool {
+	pool := workerPool{app: a, name: name, concurrency: defaultPoolConcurrency}
+	if workers, err := strconv.Atoi(a.getenv(prefix + "_CONCURRENCY")); err == nil && workers > 0 {
+		pool.concurrency = workers
+	}
+	if ms, err := strconv.Atoi(a.getenv(prefix + "_ITEM_TIMEOUT_MS")); err == nil && ms > 0 {
+		pool.itemTimeout = time.Duration(ms) * time.Millisecond
+	}
+	return pool
+}
+
+// itemError is why one item of a pool's run failed.
+type itemError struct {
+	Index int
+	Err   error
+}
+
+// poolErrors collects the failures of a run, in item order.
+type poolErrors []itemError
+
+func (e poolErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, failure := range e {
+		messages[i] = fmt.Sprintf("item %d: %v", failure.Index, failure.Err)
+	}
+	return fmt.Sprintf("%d of the items failed: %s", len(e), strings.Join(messages, "; "))
+}
+
+// errFor returns the error item i failed with, or nil.
+func (e poolErrors) errFor(i int) error {
+	for _, failure := range e {
+		if failure.Index == i {
+			return failure.Err
+		}
+	}
+	return nil
+}
+
+// run calls work for each of n items and waits for them all. Once ctx is
+// done no more items are started; those left fail with the context's
+// error. run returns poolErrors when any item failed.
+func (p workerPool) run(ctx context.Context, n int, work func(ctx context.Context, i int) error) error {
+	errs := make([]error, n)
+	slots := make(chan struct{}, p.concurrency)
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if err := ctx.Err(); err != nil {
+			for ; i < n; i++ {
+				errs[i] = err
+			}
+			break
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			errs[i] = p.runItem(ctx, i, n-i-1, work)
+		}(i)
+	}
+	wg.Wait()
+
+	var failures poolErrors
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, itemError{Index: i, Err: err})
+		}
+	}
+	if len(failures) > 0 {
+		return failures
+	}
+	return nil
+}
+
+// runItem works on one item, recording how long it took and how many items
+// were still queued behind it.
+func (p workerPool) runItem(ctx context.Context, i, queued int, work func(ctx context.Context, i int) error) error {
+	if p.itemTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.itemTimeout)
+		defer cancel()
+	}
+
+	started := time.Now()
+	err := work(ctx, i)
+	p.app.emitMetrics(map[string]string{"Pool": p.name},
+		metric{Name: "PoolQueueDepth", Value: float64(queued), Unit: "Count"},
+		metric{Name: "PoolItemLatency", Value: float64(time.Since(started).Milliseconds()), Unit: "Milliseconds"},
+	)
+	return err
+}
@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewWorkerPool(t *testing.T) {
+	tests := []struct {
+		name            string
+		env             map[string]string
+		wantConcurrency int
+		wantTimeout     time.Duration
+	}{
+		{name: "defaults", wantConcurrency: defaultPoolConcurrency},
+		{name: "configured", env: map[string]string{"BATCH_CONCURRENCY": "3", "BATCH_ITEM_TIMEOUT_MS": "250"}, wantConcurrency: 3, wantTimeout: 250 * time.Millisecond},
+		{name: "invalid values ignored", env: map[string]string{"BATCH_CONCURRENCY": "0", "BATCH_ITEM_TIMEOUT_MS": "soon"}, wantConcurrency: defaultPoolConcurrency},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &App{Getenv: func(key string) string { return tt.env[key] }}
+			pool := app.newWorkerPool("batch", "BATCH")
+			if pool.concurrency != tt.wantConcurrency || pool.itemTimeout != tt.wantTimeout {
+				t.Errorf("pool = %d workers, %v timeout, want %d, %v", pool.concurrency, pool.itemTimeout, tt.wantConcurrency, tt.wantTimeout)
+			}
+		})
+	}
+}
+
+func TestWorkerPoolBoundsConcurrency(t *testing.T) {
+	pool := workerPool{app: &App{}, name: "test", concurrency: 3}
+
+	var running, peak, done atomic.Int32
+	err := pool.run(context.Background(), 20, func(ctx context.Context, i int) error {
+		now := running.Add(1)
+		for {
+			highest := peak.Load()
+			if now <= highest || peak.CompareAndSwap(highest, now) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		running.Add(-1)
+		done.Add(1)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("run() = %v, want nil", err)
+	}
+	if done.Load() != 20 {
+		t.Errorf("worked on %d items, want 20", done.Load())
+	}
+	if peak.Load() > 3 {
+		t.Errorf("%d items ran at once, want at most 3", peak.Load())
+	}
+}
+
+func TestWorkerPoolCollectsErrors(t *testing.T) {
+	pool := workerPool{app: &App{}, name: "test", concurrency: 2}
+	errOdd := errors.New("odd item")
+
+	err := pool.run(context.Background(), 5, func(ctx context.Context, i int) error {
+		if i%2 == 1 {
+			return errOdd
+		}
+		return nil
+	})
+
+	var failures poolErrors
+	if !errors.As(err, &failures) {
+		t.Fatalf("run() = %v, want poolErrors", err)
+	}
+	if len(failures) != 2 || failures[0].Index != 1 || failures[1].Index != 3 {
+		t.Fatalf("failures = %+v, want items 1 and 3 in order", failures)
+	}
+	for i := 0; i < 5; i++ {
+		if got, want := failures.errFor(i), i%2 == 1; (got != nil) != want {
+			t.Errorf("errFor(%d) = %v", i, got)
+		}
+	}
+}
+
+func TestWorkerPoolStopsWhenCancelled(t *testing.T) {
+	pool := workerPool{app: &App{}, name: "test", concurrency: 1}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var started atomic.Int32
+	err := pool.run(ctx, 5, func(ctx context.Context, i int) error {
+		started.Add(1)
+		if i == 1 {
+			cancel()
+		}
+		return nil
+	})
+
+	var failures poolErrors
+	if !errors.As(err, &failures) {
+		t.Fatalf("run() = %v, want poolErrors", err)
+	}
+	if started.Load() != 2 {
+		t.Errorf("started %d items, want 2", started.Load())
+	}
+	for i := 2; i < 5; i++ {
+		if !errors.Is(failures.errFor(i), context.Canceled) {
+			t.Errorf("item %d: error = %v, want context.Canceled", i, failures.errFor(i))
+		}
+	}
+}
+
+func TestWorkerPoolItemTimeout(t *testing.T) {
+	pool := workerPool{app: &App{}, name: "test", concurrency: 2, itemTimeout: 10 * time.Millisecond}
+
+	err := pool.run(context.Background(), 2, func(ctx context.Context, i int) error {
+		if i == 0 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+
+	var failures poolErrors
+	if !errors.As(err, &failures) || len(failures) != 1 || !errors.Is(failures.errFor(0), context.DeadlineExceeded) {
+		t.Fatalf("run() = %v, want only item 0 to time out", err)
+	}
+}
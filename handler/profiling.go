@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math/rand"
+	"strconv"
+)
+
+// payloadProfileSampleRate is the fraction of uploads, between 0 and 1, that
+// are profiled. Profiling is off unless PAYLOAD_PROFILE_SAMPLE_RATE is set.
+func (a *App) payloadProfileSampleRate() float64 {
+	rate, err := strconv.ParseFloat(a.getenv("PAYLOAD_PROFILE_SAMPLE_RATE"), 64)
+	if err != nil || rate < 0 {
+		return 0
+	}
+	return min(rate, 1)
+}
+
+// profilePayload emits metrics describing the shape of a sample of uploaded
+// payloads: size, field counts, top-level type and how well it compresses.
+// Nothing about the content itself is recorded. parse supplies the payload
+// unmarshalled, and is only called for sampled payloads.
+func (a *App) profilePayload(category *uploadCategory, jsonData string, parse func() (interface{}, error)) {
+	if rand.Float64() >= a.payloadProfileSampleRate() {
+		return
+	}
+
+	temp, err := parse()
+	if err != nil {
+		return
+	}
+
+	topLevelFields := 0
+	switch v := temp.(type) {
+	case map[string]interface{}:
+		topLevelFields = len(v)
+	case []interface{}:
+		topLevelFields = len(v)
+	}
+
+	metrics := []metric{
+		{Name: "PayloadBytes", Value: float64(len(jsonData)), Unit: "Bytes"},
+		{Name: "PayloadTopLevelFields", Value: float64(topLevelFields), Unit: "Count"},
+		{Name: "PayloadTotalFields", Value: float64(countFields(temp)), Unit: "Count"},
+	}
+
+	if ratio, ok := compressionRatio(jsonData); ok {
+		metrics = append(metrics, metric{Name: "PayloadCompressionRatio", Value: ratio, Unit: "None"})
+	}
+
+	a.emitMetrics(map[string]string{
+		"Category":     category.Name,
+		"TopLevelType": jsonType(temp),
+	}, metrics...)
+}
+
+// countFields counts the object fields across the whole document.
+func countFields(value interface{}) int {
+	count := 0
+	switch v := value.(type) {
+	case map[string]interface{}:
+		count += len(v)
+		for _, child := range v {
+			count += countFields(child)
+		}
+	case []interface{}:
+		for _, child := range v {
+			count += countFields(child)
+		}
+	}
+	return count
+}
+
+// compressionRatio is the raw size divided by the gzipped size.
+func compressionRatio(data string) (float64, bool) {
+	if len(data) == 0 {
+		return 0, false
+	}
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write([]byte(data)); err != nil {
+		return 0, false
+	}
+	if err := writer.Close(); err != nil {
+		return 0, false
+	}
+
+	return float64(len(data)) / float64(buf.Len()), true
+}
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/storage"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/validation"
+)
+
+const (
+	// quarantinePrefix holds payloads that failed validation. Bucket policy
+	// restricts it to the diagnostics role.
+	quarantinePrefix = "diagnostics/quarantine/"
+
+	// defaultQuarantineRetentionDays is how long quarantined payloads are
+	// kept when QUARANTINE_RETENTION_DAYS is not set.
+	defaultQuarantineRetentionDays = 7
+)
+
+// quarantineEnabled reports whether QUARANTINE_MODE is on, so payloads that
+// fail validation are kept for debugging client bugs.
+func (a *App) quarantineEnabled() bool {
+	enabled, _ := strconv.ParseBool(a.getenv("QUARANTINE_MODE"))
+	return enabled
+}
+
+func (a *App) quarantineRetentionDays() int {
+	if days, err := strconv.Atoi(a.getenv("QUARANTINE_RETENTION_DAYS")); err == nil && days > 0 {
+		return days
+	}
+	return defaultQuarantineRetentionDays
+}
+
+// quarantinePayload stores a rejected payload under diagnostics/quarantine/,
+// encrypted with SSE-KMS (QUARANTINE_KMS_KEY_ID, or the AWS managed key) and
+// tagged for short retention. It returns the quarantine key, or empty if the
+// payload could not be stored; the caller still rejects the upload either way.
+func (a *App) quarantinePayload(uploader storage.Uploader, category *uploadCategory, requestID string, userID int64, payload string, errs validation.Errors) string {
+	s3Uploader, err := asS3Uploader(uploader)
+	if err != nil {
+		log.Printf("Unable to quarantine payload: %v", err)
+		return ""
+	}
+
+	now := time.Now()
+	key := fmt.Sprintf("%s%s/%d/%d/%d/%s.json",
+		quarantinePrefix, category.Name, now.Year(), now.Month(), now.Day(), requestID)
+
+	rules := make([]string, 0, len(errs))
+	for _, e := range errs {
+		if !containsString(rules, e.Rule) {
+			rules = append(rules, e.Rule)
+		}
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s3Uploader.Bucket),
+		Key:         aws.String(key),
+		Body:        strings.NewReader(payload),
+		ContentType: aws.String("application/octet-stream"),
+		Metadata: map[string]string{
+			storage.ProducerMetadataKey: storage.ProducerName,
+			"user-id":                   strconv.FormatInt(userID, 10),
+			"failed-rules":              strings.Join(rules, ","),
+		},
+		ServerSideEncryption: types.ServerSideEncryptionAwsKms,
+		Tagging:              aws.String(url.Values{storage.RetentionTagKey(a.getenv): []string{strconv.Itoa(a.quarantineRetentionDays())}}.Encode()),
+	}
+	if keyID := a.getenv("QUARANTINE_KMS_KEY_ID"); keyID != "" {
+		input.SSEKMSKeyId = aws.String(keyID)
+	}
+
+	if _, err := s3Uploader.Client.PutObject(context.TODO(), input); err != nil {
+		log.Printf("Unable to quarantine payload: %v", err)
+		return ""
+	}
+	return key
+}
@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	goredis "github.com/go-redis/redis"
+)
+
+var errQuotaExceeded = errors.New("storage quota exceeded for this client")
+
+const (
+	// quotaSizesKey and quotaOwnersKey are hashes of each counted object's
+	// size and tenant, keyed by "{bucket}/{key}", so overwrites are counted
+	// net of what they replace and deletions can be given back.
+	quotaSizesKey  = "quota:objects:size"
+	quotaOwnersKey = "quota:objects:owner"
+)
+
+// reserveScript atomically adds the upload's bytes, net of the object it
+// replaces, to the tenant's usage, rolling the addition back if it takes
+// the tenant over its quota. It returns 0 when the quota would be exceeded,
+// otherwise 1 and the size of the object replaced, or -1 if there was none.
+var reserveScript = goredis.NewScript(`
+local previous = redis.call("HGET", KEYS[2], ARGV[1])
+local delta = tonumber(ARGV[2]) - tonumber(previous or "0")
+local used = redis.call("INCRBY", KEYS[1], delta)
+if delta > 0 and used > tonumber(ARGV[3]) then
+	redis.call("DECRBY", KEYS[1], delta)
+	return {0, -1}
+end
+redis.call("HSET", KEYS[2], ARGV[1], ARGV[2])
+redis.call("HSETNX", KEYS[3], ARGV[1], ARGV[4])
+return {1, tonumber(previous or "-1")}
+`)
+
+// unreserveScript undoes reserveScript for an upload that failed, putting
+// back the size of the object it was to replace.
+var unreserveScript = goredis.NewScript(`
+local previous = tonumber(ARGV[3])
+redis.call("DECRBY", KEYS[1], tonumber(ARGV[2]) - math.max(previous, 0))
+if previous < 0 then
+	redis.call("HDEL", KEYS[2], ARGV[1])
+	redis.call("HDEL", KEYS[3], ARGV[1])
+else
+	redis.call("HSET", KEYS[2], ARGV[1], previous)
+end
+return 1
+`)
+
+// forgetScript gives a deleted or expired object's bytes back to the
+// tenant it was counted against.
+var forgetScript = goredis.NewScript(`
+local size = redis.call("HGET", KEYS[1], ARGV[1])
+local owner = redis.call("HGET", KEYS[2], ARGV[1])
+redis.call("HDEL", KEYS[1], ARGV[1])
+redis.call("HDEL", KEYS[2], ARGV[1])
+if size and owner then
+	redis.call("DECRBY", "quota:bytes:" .. owner, size)
+end
+return 1
+`)
+
+// loadStorageQuotas parses TENANT_STORAGE_QUOTAS, a JSON object of system
+// code to the number of bytes the tenant may store. The "*" entry, if
+// present, applies to tenants without their own quota.
+func (a *App) loadStorageQuotas() (map[string]int64, error) {
+	return a.storageQuotas.get(func() (map[string]int64, error) {
+		quotas := map[string]int64{}
+
+		raw := a.getenv("TENANT_STORAGE_QUOTAS")
+		if raw == "" {
+			return quotas, nil
+		}
+
+		if err := json.Unmarshal([]byte(raw), &quotas); err != nil {
+			return nil, fmt.Errorf("invalid TENANT_STORAGE_QUOTAS: %v", err)
+		}
+		return quotas, nil
+	})
+}
+
+// quotaObject identifies an object in the quota ledger.
+func quotaObject(bucket, key string) string {
+	return bucket + "/" + key
+}
+
+// reserveStorage counts size bytes stored at object against the tenant's
+// quota, tracked in the app Redis under quota:bytes:{tenant}. Only an
+// upload's own object is counted, net of any object it overwrites. It
+// returns false when the upload would exceed the quota; otherwise the
+// returned release func gives the bytes back if the upload then fails. Like
+// concurrency limiting, quotas fail open when Redis is unavailable.
+func (a *App) reserveStorage(tenant, object string, size int) (func(), bool, error) {
+	noop := func() {}
+
+	quotas, err := a.loadStorageQuotas()
+	if err != nil {
+		return noop, false, err
+	}
+
+	quota, ok := quotas[tenant]
+	if !ok {
+		quota, ok = quotas["*"]
+	}
+	client := a.Redis
+	if !ok || client == nil {
+		return noop, true, nil
+	}
+
+	keys := []string{"quota:bytes:" + tenant, quotaSizesKey, quotaOwnersKey}
+	result, err := reserveScript.Run(client, keys, object, size, quota, tenant).Result()
+	if err != nil {
+		log.Printf("Skipping storage quota for %s: %v", tenant, err)
+		return noop, true, nil
+	}
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		log.Printf("Skipping storage quota for %s: unexpected reply %v", tenant, result)
+		return noop, true, nil
+	}
+	if reserved, _ := values[0].(int64); reserved == 0 {
+		a.emitMetrics(map[string]string{"Tenant": a.metricTenant(tenant)}, metric{Name: "QuotaRejections", Value: 1, Unit: "Count"})
+		return noop, false, nil
+	}
+	previous, _ := values[1].(int64)
+
+	release := func() {
+		if err := unreserveScript.Run(client, keys, object, size, previous).Err(); err != nil {
+			log.Printf("Unable to release storage quota for %s: %v", tenant, err)
+		}
+	}
+
+	return release, true, nil
+}
+
+// forgetStoredObject gives the bytes of a deleted or expired object back to
+// the tenant whose quota they were counted against.
+func (a *App) forgetStoredObject(object string) error {
+	client := a.Redis
+	if client == nil {
+		return nil
+	}
+	return forgetScript.Run(client, []string{quotaSizesKey, quotaOwnersKey}, object).Err()
+}
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/go-redis/redis"
+)
+
+// quotaApp is an App with TENANT_STORAGE_QUOTAS set to quotas and its app
+// Redis on a miniredis server.
+func quotaApp(t *testing.T, quotas string) (*App, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	app := &App{
+		Getenv: func(key string) string {
+			if key == "TENANT_STORAGE_QUOTAS" {
+				return quotas
+			}
+			return ""
+		},
+		Redis: goredis.NewClient(&goredis.Options{Addr: server.Addr()}),
+	}
+	return app, server
+}
+
+// used is the bytes counted against tenant.
+func used(t *testing.T, server *miniredis.Miniredis, tenant string) string {
+	t.Helper()
+	value, err := server.Get("quota:bytes:" + tenant)
+	if err == miniredis.ErrKeyNotFound {
+		return "0"
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func mustReserve(t *testing.T, app *App, tenant, object string, size int) func() {
+	t.Helper()
+	release, ok, err := app.reserveStorage(tenant, object, size)
+	if err != nil || !ok {
+		t.Fatalf("reserveStorage(%s, %s, %d) = %v, %v, want a reservation", tenant, object, size, ok, err)
+	}
+	return release
+}
+
+func TestReserveStorage(t *testing.T) {
+	tests := []struct {
+		name string
+		// before are reservations made first, each for its own object.
+		before   []int
+		object   string
+		size     int
+		wantOK   bool
+		wantUsed string
+	}{
+		{name: "within quota", object: "b/new", size: 60, wantOK: true, wantUsed: "60"},
+		{name: "exactly at quota", before: []int{40}, object: "b/new", size: 60, wantOK: true, wantUsed: "100"},
+		{name: "over quota", before: []int{60}, object: "b/new", size: 50, wantUsed: "60"},
+		{name: "overwrite counted net", before: []int{60, 30}, object: "b/0", size: 70, wantOK: true, wantUsed: "100"},
+		{name: "overwrite over quota", before: []int{60, 30}, object: "b/0", size: 71, wantUsed: "90"},
+		{name: "shrinking overwrite", before: []int{60, 30}, object: "b/0", size: 10, wantOK: true, wantUsed: "40"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, server := quotaApp(t, `{"ACME": 100}`)
+			for i, size := range tt.before {
+				mustReserve(t, app, "ACME", "b/"+string(rune('0'+i)), size)
+			}
+
+			_, ok, err := app.reserveStorage("ACME", tt.object, tt.size)
+			if err != nil {
+				t.Fatalf("reserveStorage() error = %v", err)
+			}
+			if ok != tt.wantOK {
+				t.Errorf("reserveStorage() = %v, want %v", ok, tt.wantOK)
+			}
+			if got := used(t, server, "ACME"); got != tt.wantUsed {
+				t.Errorf("ACME uses %s bytes, want %s", got, tt.wantUsed)
+			}
+		})
+	}
+}
+
+func TestReserveStorageRelease(t *testing.T) {
+	app, server := quotaApp(t, `{"ACME": 100}`)
+	mustReserve(t, app, "ACME", "b/old", 30)
+
+	// a failed new upload is forgotten entirely
+	mustReserve(t, app, "ACME", "b/new", 50)()
+	if got := used(t, server, "ACME"); got != "30" {
+		t.Errorf("after releasing a new object ACME uses %s bytes, want 30", got)
+	}
+	if server.HGet(quotaSizesKey, "b/new") != "" || server.HGet(quotaOwnersKey, "b/new") != "" {
+		t.Error("released object is still in the quota ledger")
+	}
+
+	// a failed overwrite puts back the size of the object it replaced
+	mustReserve(t, app, "ACME", "b/old", 80)()
+	if got := used(t, server, "ACME"); got != "30" {
+		t.Errorf("after releasing an overwrite ACME uses %s bytes, want 30", got)
+	}
+	if size := server.HGet(quotaSizesKey, "b/old"); size != "30" {
+		t.Errorf("b/old is counted as %s bytes, want 30", size)
+	}
+}
+
+func TestForgetStoredObject(t *testing.T) {
+	app, server := quotaApp(t, `{"*": 100}`)
+	mustReserve(t, app, "ACME", "b/acme", 40)
+	mustReserve(t, app, "OTHER", "b/other", 25)
+
+	if err := app.forgetStoredObject("b/acme"); err != nil {
+		t.Fatalf("forgetStoredObject() error = %v", err)
+	}
+	if got := used(t, server, "ACME"); got != "0" {
+		t.Errorf("ACME uses %s bytes after its object was deleted, want 0", got)
+	}
+	if got := used(t, server, "OTHER"); got != "25" {
+		t.Errorf("OTHER uses %s bytes, want 25", got)
+	}
+
+	// objects that were never counted are ignored
+	if err := app.forgetStoredObject("b/unknown"); err != nil {
+		t.Fatalf("forgetStoredObject() of an uncounted object: error = %v", err)
+	}
+}
+
+func TestReserveStorageUnlimited(t *testing.T) {
+	app, server := quotaApp(t, `{"ACME": 100}`)
+	mustReserve(t, app, "OTHER", "b/other", 1000)
+	if got := used(t, server, "OTHER"); got != "0" {
+		t.Errorf("tenant without a quota was counted %s bytes", got)
+	}
+}
+
+func TestReserveStorageFailsOpen(t *testing.T) {
+	app, server := quotaApp(t, `{"ACME": 100}`)
+	server.Close()
+
+	mustReserve(t, app, "ACME", "b/new", 1000)
+}
+
+func TestReserveStorageInvalidQuotas(t *testing.T) {
+	app, _ := quotaApp(t, `{"ACME": "lots"}`)
+	if _, _, err := app.reserveStorage("ACME", "b/new", 1); err == nil {
+		t.Fatal("reserveStorage() error = nil, want an error for invalid TENANT_STORAGE_QUOTAS")
+	}
+}
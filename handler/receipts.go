@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/storage"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/receipt"
+)
+
+const (
+	// receiptHeader carries the signed receipt back to the client.
+	receiptHeader = "X-Upload-Receipt"
+
+	// receiptSuffix is appended to the object key for the stored copy.
+	receiptSuffix = ".receipt.jws"
+)
+
+// receiptsEnabled reports whether UPLOAD_RECEIPT_KMS_KEY_ID names the
+// asymmetric key uploads are receipted with.
+func (a *App) receiptsEnabled() bool {
+	return a.getenv("UPLOAD_RECEIPT_KMS_KEY_ID") != ""
+}
+
+// issueReceipt signs a receipt for the object stored at key and keeps a copy
+// beside the upload's dated key, fileName, which unlike a content-addressed
+// key belongs to this upload alone. The upload has already succeeded, so a
+// receipt that can't be issued is logged and counted rather than failing
+// the request.
+func (a *App) issueReceipt(ctx context.Context, uploader storage.Uploader, key, fileName string, data string, userID int64, now time.Time) string {
+	client, err := a.kmsClient()
+	if err != nil {
+		log.Printf("Unable to issue receipt for %s: %v", key, err)
+		a.emitMetrics(nil, metric{Name: "ReceiptFailures", Value: 1, Unit: "Count"})
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(data))
+	token, err := receipt.Sign(ctx, client, a.getenv("UPLOAD_RECEIPT_KMS_KEY_ID"), receipt.Claims{
+		Key:      key,
+		SHA256:   hex.EncodeToString(sum[:]),
+		UserID:   userID,
+		IssuedAt: now.Unix(),
+	})
+	if err != nil {
+		log.Printf("Unable to issue receipt for %s: %v", key, err)
+		a.emitMetrics(nil, metric{Name: "ReceiptFailures", Value: 1, Unit: "Count"})
+		return ""
+	}
+
+	if err := uploader.UploadObject(fileName+receiptSuffix, token, "application/jose", nil); err != nil {
+		log.Printf("Unable to store receipt for %s: %v", key, err)
+		a.emitMetrics(nil, metric{Name: "ReceiptFailures", Value: 1, Unit: "Count"})
+	}
+	return token
+}
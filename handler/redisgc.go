@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	goredis "github.com/go-redis/redis"
+)
+
+// redisGCScanCount is the SCAN batch size hint.
+const redisGCScanCount = 500
+
+// redisGCReserve is left on the clock when the handler stops scanning, so a
+// large keyspace is picked up again by the next scheduled run.
+const redisGCReserve = 5 * time.Second
+
+// RedisGCHandler is run on a schedule to reclaim keys of ours in the app
+// Redis that escaped their TTLs: dedup: keys without an expiry are deleted,
+// and concurrency: gauges lose leases older than the lease period. Keys
+// under the extra REDIS_GC_PREFIXES (comma separated, e.g. idempotency or
+// nonce keys written by other components) are deleted when they have no TTL.
+func (a *App) RedisGCHandler(ctx context.Context, event events.CloudWatchEvent) error {
+	client := a.Redis
+	if client == nil {
+		return errors.New("APP_REDIS_ADDR is required for Redis garbage collection")
+	}
+
+	prefixes := []string{"dedup:"}
+	for _, prefix := range strings.Split(a.getenv("REDIS_GC_PREFIXES"), ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+
+	if err := a.collectRedisKeys(ctx, client, "concurrency:", a.collectConcurrencyKey); err != nil {
+		return err
+	}
+	for _, prefix := range prefixes {
+		if err := a.collectRedisKeys(ctx, client, prefix, collectUnexpiringKey); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// collectRedisKeys scans every key under prefix, handing each to collect,
+// which reports whether it reclaimed the key.
+func (a *App) collectRedisKeys(ctx context.Context, client *goredis.Client, prefix string, collect func(*goredis.Client, string) (bool, error)) error {
+	var cursor uint64
+	var scanned, reclaimed int
+
+	defer func() {
+		log.Printf("Redis GC scanned %d keys under %s and reclaimed %d", scanned, prefix, reclaimed)
+		a.emitMetrics(map[string]string{"Prefix": prefix},
+			metric{Name: "RedisKeysScanned", Value: float64(scanned), Unit: "Count"},
+			metric{Name: "RedisKeysReclaimed", Value: float64(reclaimed), Unit: "Count"})
+	}()
+
+	for {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < redisGCReserve {
+			log.Printf("Redis GC ran out of time under %s", prefix)
+			return nil
+		}
+
+		keys, next, err := client.Scan(cursor, prefix+"*", redisGCScanCount).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			scanned++
+			ok, err := collect(client, key)
+			if err != nil {
+				log.Printf("Unable to collect %s: %v", key, err)
+				continue
+			}
+			if ok {
+				reclaimed++
+			}
+		}
+
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// collectUnexpiringKey deletes a key that should have had a TTL but has none.
+func collectUnexpiringKey(client *goredis.Client, key string) (bool, error) {
+	ttl, err := client.TTL(key).Result()
+	if err != nil {
+		return false, err
+	}
+	// -1 means the key exists without an expiry
+	if ttl != -1*time.Second {
+		return false, nil
+	}
+	return true, client.Del(key).Err()
+}
+
+// collectConcurrencyKey drops leases that were never released and deletes
+// the gauge once it is empty.
+func (a *App) collectConcurrencyKey(client *goredis.Client, key string) (bool, error) {
+	expired := time.Now().Add(-a.concurrencyLease()).UnixMilli()
+	if err := client.ZRemRangeByScore(key, "-inf", strconv.FormatInt(expired, 10)).Err(); err != nil {
+		return false, err
+	}
+
+	count, err := client.ZCard(key).Result()
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+	return true, client.Del(key).Err()
+}
@@ -0,0 +1,206 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/validation"
+)
+
+const (
+	// redacted replaces anything scrubbed from the request log.
+	redacted = "[REDACTED]"
+
+	// maxLoggedBodyBytes bounds how much of a body debug logging writes.
+	maxLoggedBodyBytes = 1024
+)
+
+// defaultProdDetailSampleRate is the share of requests logged with full
+// details in prod when LOG_DETAIL_SAMPLE_RATE is not set.
+const defaultProdDetailSampleRate = 0.01
+
+// newLogHandler writes JSON lines for CloudWatch Logs Insights to query, at
+// LOG_LEVEL or above.
+func newLogHandler(getenv func(string) string) slog.Handler {
+	return slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel(getenv)})
+}
+
+// requestLogger writes the App's one line per request.
+func (a *App) requestLogger() *slog.Logger {
+	logger, _ := a.logger.get(func() (*slog.Logger, error) {
+		return slog.New(newLogHandler(a.getenv)), nil
+	})
+	return logger
+}
+
+// logLevel is LOG_LEVEL (debug, info, warn or error), defaulting to info in
+// prod and debug elsewhere.
+func logLevel(getenv func(string) string) slog.Level {
+	level := slog.LevelDebug
+	if inProd(getenv) {
+		level = slog.LevelInfo
+	}
+	if raw := getenv("LOG_LEVEL"); raw != "" {
+		if err := level.UnmarshalText([]byte(raw)); err != nil {
+			log.Printf("Ignoring invalid LOG_LEVEL: %v", err)
+		}
+	}
+	return level
+}
+
+// logDetailSampleRate is LOG_DETAIL_SAMPLE_RATE, the share of successful
+// requests logged with headers and body details even above debug level.
+func (a *App) logDetailSampleRate() float64 {
+	if rate, err := strconv.ParseFloat(a.getenv("LOG_DETAIL_SAMPLE_RATE"), 64); err == nil && rate >= 0 && rate <= 1 {
+		return rate
+	}
+	if inProd(a.getenv) {
+		return defaultProdDetailSampleRate
+	}
+	return 0
+}
+
+func inProd(getenv func(string) string) bool {
+	return strings.EqualFold(getenv("ENVIRONMENT"), "prod")
+}
+
+// sensitiveHeaders are never logged.
+var sensitiveHeaders = []string{"Authorization", "Cookie", "X-Api-Key", "X-Amz-Security-Token"}
+
+// defaultLogSensitiveFields are scrubbed from logged bodies on top of the
+// PII_SENSITIVE_FIELDS and LOG_SENSITIVE_FIELDS names.
+var defaultLogSensitiveFields = []string{"password", "token", "secret"}
+
+// logRequest records the request's metadata and outcome: at error level for
+// 5xx responses, warn for 4xx and info otherwise. Failed requests always
+// carry the headers and body size, successful ones only at debug level or
+// when sampled. Credentials are scrubbed from the headers, and the body is
+// left out unless LOG_REQUEST_BODIES is set outside prod, in which case
+// sensitive fields are scrubbed and the rest truncated.
+func (a *App) logRequest(ctx context.Context, request events.APIGatewayProxyRequest, response events.APIGatewayProxyResponse, requestID string, started time.Time) {
+	level := slog.LevelInfo
+	switch {
+	case response.StatusCode >= 500:
+		level = slog.LevelError
+	case response.StatusCode >= 400:
+		level = slog.LevelWarn
+	}
+
+	attrs := []interface{}{
+		slog.String("request_id", requestID),
+		slog.String("method", request.HTTPMethod),
+		slog.String("resource", request.Resource),
+		slog.String("path", request.Path),
+		slog.String("tenant", tenantFromRequest(request)),
+		slog.Int("status", response.StatusCode),
+		slog.Int64("duration_ms", time.Since(started).Milliseconds()),
+	}
+
+	details := level >= slog.LevelWarn ||
+		a.requestLogger().Enabled(ctx, slog.LevelDebug) ||
+		rand.Float64() < a.logDetailSampleRate()
+	if details {
+		attrs = append(attrs,
+			slog.Any("headers", scrubHeaders(request.Headers)),
+			slog.Int("body_bytes", len(request.Body)),
+		)
+		if a.logRequestBodies() {
+			attrs = append(attrs, slog.String("body", scrubBody(request.Body, a.logSensitiveField)))
+		}
+	}
+
+	a.requestLogger().Log(ctx, level, "request", attrs...)
+}
+
+// logRequestBodies reports whether LOG_REQUEST_BODIES asks for bodies to be
+// logged. It is ignored when ENVIRONMENT is prod.
+func (a *App) logRequestBodies() bool {
+	if inProd(a.getenv) {
+		return false
+	}
+	enabled, _ := strconv.ParseBool(a.getenv("LOG_REQUEST_BODIES"))
+	return enabled
+}
+
+func scrubHeaders(headers map[string]string) map[string]string {
+	scrubbed := make(map[string]string, len(headers))
+	for name, value := range headers {
+		scrubbed[name] = value
+		for _, sensitive := range sensitiveHeaders {
+			if strings.EqualFold(name, sensitive) {
+				scrubbed[name] = redacted
+				break
+			}
+		}
+	}
+	return scrubbed
+}
+
+// scrubBody redacts sensitive fields anywhere in a JSON body and truncates
+// the result. Bodies that are not JSON can not be scrubbed, so are left out.
+func scrubBody(body string, sensitive func(field string) bool) string {
+	var document interface{}
+	if err := json.Unmarshal([]byte(body), &document); err != nil {
+		return "[unparsed body omitted]"
+	}
+
+	scrubbed, err := json.Marshal(scrubValue(document, sensitive))
+	if err != nil {
+		return "[unparsed body omitted]"
+	}
+	if len(scrubbed) > maxLoggedBodyBytes {
+		return string(scrubbed[:maxLoggedBodyBytes]) + "..."
+	}
+	return string(scrubbed)
+}
+
+func scrubValue(value interface{}, sensitive func(field string) bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if sensitive(key) {
+				v[key] = redacted
+				continue
+			}
+			v[key] = scrubValue(child, sensitive)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = scrubValue(child, sensitive)
+		}
+	}
+	return value
+}
+
+// logSensitiveFields is the defaults plus the comma-separated
+// LOG_SENSITIVE_FIELDS.
+func (a *App) logSensitiveFields() map[string]bool {
+	names := defaultLogSensitiveFields
+	if raw := a.getenv("LOG_SENSITIVE_FIELDS"); raw != "" {
+		names = append(strings.Split(raw, ","), names...)
+	}
+
+	fields := make(map[string]bool, len(names))
+	for _, name := range names {
+		fields[normaliseLogField(name)] = true
+	}
+	return fields
+}
+
+// logSensitiveField reports whether a field is scrubbed from logged bodies,
+// going by logSensitiveFields and PII_SENSITIVE_FIELDS.
+func (a *App) logSensitiveField(name string) bool {
+	return a.logSensitiveFields()[normaliseLogField(name)] || validation.SensitiveField(a.getenv, name)
+}
+
+func normaliseLogField(name string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "", " ", "").Replace(strings.TrimSpace(name)))
+}
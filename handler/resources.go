@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// knownResources are the API Gateway resources the function serves, most
+// specific first.
+var knownResources = []string{
+	"/capabilities",
+	"/health",
+	"/uploads/batch",
+	"/{category}/documents/{name}",
+	"/{category}/multipart/{uploadId}/complete",
+	"/{category}/multipart/{uploadId}",
+	"/{category}/multipart",
+	"/{category}",
+	"/",
+}
+
+// envList splits a comma-separated variable, dropping blank entries.
+func (a *App) envList(name string) []string {
+	var values []string
+	for _, value := range strings.Split(a.getenv(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// resourceAllowed reports whether the request is for one of the resources
+// in ALLOWED_RESOURCES, or one of knownResources when it is not set.
+func (a *App) resourceAllowed(request events.APIGatewayProxyRequest) bool {
+	allowed := a.envList("ALLOWED_RESOURCES")
+	if len(allowed) == 0 {
+		allowed = knownResources
+	}
+
+	for _, resource := range allowed {
+		if request.Resource == resource {
+			return true
+		}
+	}
+	return false
+}
+
+// payloadTypeAllowed reports whether the category's documents are accepted
+// by this deployment: it must be listed in ALLOWED_PAYLOAD_TYPES (comma
+// separated category names), or any category is when that is not set.
+func (a *App) payloadTypeAllowed(category *uploadCategory) bool {
+	allowed := a.envList("ALLOWED_PAYLOAD_TYPES")
+	if len(allowed) == 0 {
+		return true
+	}
+
+	for _, name := range allowed {
+		if name == category.Name {
+			return true
+		}
+	}
+	return false
+}
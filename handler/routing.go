@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// loadBucketRoutes returns the bucket routing map, read from the secret
+// named by BUCKET_ROUTES_SECRET or else parsed from BUCKET_ROUTES. Keys are
+// "<system code>/<category>", "<system code>" or "*/<category>", e.g.
+//
+//	{"BRAND_A": "brand-a-uploads", "*/sleep": "sleep-uploads"}
+func (a *App) loadBucketRoutes(secrets SecretSource) (map[string]string, error) {
+	if secretID := a.getenv("BUCKET_ROUTES_SECRET"); secretID != "" {
+		routes, err := secrets.SecretMap(secretID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read bucket routes: %v", err)
+		}
+		return routes, nil
+	}
+
+	return a.bucketRoutes.get(func() (map[string]string, error) {
+		routes := map[string]string{}
+		if raw := a.getenv("BUCKET_ROUTES"); raw != "" {
+			if err := json.Unmarshal([]byte(raw), &routes); err != nil {
+				return nil, fmt.Errorf("invalid BUCKET_ROUTES: %v", err)
+			}
+		}
+		return routes, nil
+	})
+}
+
+// resolveBucket picks the bucket for an upload, from the most specific route
+// to the least, falling back to BUCKET_NAME. tenant must come from
+// sessionTenant, so brands stay isolated whatever a client claims. Uploads
+// for the default tenant have no system code to route on and only take
+// the "*/<category>" routes.
+func (a *App) resolveBucket(secrets SecretSource, tenant, category string) (string, error) {
+	routes, err := a.loadBucketRoutes(secrets)
+	if err != nil {
+		return "", err
+	}
+
+	candidates := []string{"*/" + category}
+	if tenant != defaultTenant {
+		candidates = append([]string{tenant + "/" + category, tenant}, candidates...)
+	}
+	for _, route := range candidates {
+		if bucket := routes[route]; bucket != "" {
+			return bucket, nil
+		}
+	}
+
+	if bucket := a.getenv("BUCKET_NAME"); bucket != "" {
+		return bucket, nil
+	}
+	return "", errors.New("no bucket is configured for this upload")
+}
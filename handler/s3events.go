@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/storage"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/validation"
+)
+
+// conformancePrefix is where the S3 event consumer records its results.
+const conformancePrefix = "ledger/conformance/"
+
+// schemaVersionMetadataKey is the object metadata other producers declare
+// the schema version they wrote against in. Objects without it are checked
+// against the category's current schema.
+const schemaVersionMetadataKey = "schema-version"
+
+// conformanceResult records whether an object written by another producer
+// conforms to the schema registered for its category.
+type conformanceResult struct {
+	Key         string            `json:"key"`
+	Category    string            `json:"category,omitempty"`
+	Conforms    bool              `json:"conforms"`
+	Errors      validation.Errors `json:"errors,omitempty"`
+	ValidatedAt time.Time         `json:"validated_at"`
+}
+
+// S3EventHandler consumes ObjectCreated events for the bucket, validating
+// objects written by other producers against the registered schemas and
+// recording the outcome under ledger/conformance/. ObjectRemoved and
+// LifecycleExpiration events give the object's bytes back to the storage
+// quota it was counted against.
+func (a *App) S3EventHandler(ctx context.Context, event events.S3Event) error {
+	uploaders := map[string]*storage.S3Uploader{}
+	var checks []conformanceCheck
+
+	for _, record := range event.Records {
+		if strings.HasPrefix(record.EventName, "ObjectRemoved:") || strings.HasPrefix(record.EventName, "LifecycleExpiration:") {
+			key, err := url.QueryUnescape(record.S3.Object.Key)
+			if err != nil {
+				return fmt.Errorf("invalid object key %q: %v", record.S3.Object.Key, err)
+			}
+			if err := a.forgetStoredObject(quotaObject(record.S3.Bucket.Name, key)); err != nil {
+				log.Printf("Unable to release storage quota for %s: %v", key, err)
+			}
+			continue
+		}
+		if !strings.HasPrefix(record.EventName, "ObjectCreated:") {
+			continue
+		}
+
+		uploader, ok := uploaders[record.S3.Bucket.Name]
+		if !ok {
+			var err error
+			uploader, err = storage.NewS3Uploader(record.S3.Bucket.Name, a.getenv)
+			if err != nil {
+				return err
+			}
+			uploaders[record.S3.Bucket.Name] = uploader
+		}
+
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			return fmt.Errorf("invalid object key %q: %v", record.S3.Object.Key, err)
+		}
+
+		// never validate our own output, which would loop forever
+		if strings.HasPrefix(key, conformancePrefix) || strings.HasPrefix(key, "diagnostics/") || strings.HasPrefix(key, scanQuarantinePrefix) {
+			continue
+		}
+
+		checks = append(checks, conformanceCheck{uploader: uploader, key: key})
+	}
+
+	// Objects are checked S3_EVENTS_CONCURRENCY at a time, each for at most
+	// S3_EVENTS_ITEM_TIMEOUT_MS
+	return a.newWorkerPool("s3events", "S3_EVENTS").run(ctx, len(checks), func(ctx context.Context, i int) error {
+		return a.checkConformance(ctx, checks[i].uploader, checks[i].key)
+	})
+}
+
+// conformanceCheck is an object from the event waiting to be checked.
+type conformanceCheck struct {
+	uploader *storage.S3Uploader
+	key      string
+}
+
+// checkConformance validates one object written by another producer. The
+// object is inspected with HeadObject first so that our own uploads, keys
+// that are not JSON and objects too large for any category (multipart .bin
+// uploads can run to gigabytes) are never downloaded; the body read is
+// capped at maxPayloadBytes in case the object is replaced in between.
+func (a *App) checkConformance(ctx context.Context, uploader *storage.S3Uploader, key string) error {
+	if ext := path.Ext(key); ext != "" && ext != ".json" {
+		return nil
+	}
+
+	info, err := uploader.Head(ctx, key)
+	if err != nil {
+		return fmt.Errorf("unable to inspect %s: %v", key, err)
+	}
+	if info.Metadata[storage.ProducerMetadataKey] == storage.ProducerName {
+		return nil
+	}
+	if path.Ext(key) == "" && !strings.HasPrefix(info.ContentType, "application/json") {
+		return nil
+	}
+
+	result := conformanceResult{Key: key, ValidatedAt: time.Now().UTC()}
+
+	category, err := a.categoryForKey(key)
+	if err != nil {
+		return err
+	}
+	if category != nil {
+		result.Category = category.Name
+	}
+
+	limit := int64(a.maxPayloadBytes())
+	var data string
+	if info.Size <= limit {
+		data, err = uploader.DownloadLimited(ctx, key, limit)
+	}
+	if info.Size > limit || errors.Is(err, storage.ErrObjectTooLarge) {
+		result.Errors = validation.Errors{{
+			Rule:    "size",
+			Message: fmt.Sprintf("object exceeds %d bytes", limit),
+		}}
+		return recordConformance(ctx, uploader, result)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %v", key, err)
+	}
+
+	result.Errors = validation.ValidateJSON(data)
+	if category != nil {
+		if len(result.Errors) == 0 {
+			result.Errors = category.conformanceErrors(info.Metadata[schemaVersionMetadataKey], data)
+		}
+	} else {
+		result.Errors = append(result.Errors, validation.Error{
+			Rule:    "category",
+			Message: "no category is registered for this prefix",
+		})
+	}
+	return recordConformance(ctx, uploader, result)
+}
+
+// conformanceErrors validates data against the schema version it was
+// written for, as validateStage does for uploads.
+func (c *uploadCategory) conformanceErrors(version, data string) validation.Errors {
+	schema, ok := c.schemaFor(version)
+	if !ok {
+		return validation.Errors{{
+			Rule:    "schema_version",
+			Message: fmt.Sprintf("unknown schema version %q for category %q", version, c.Name),
+		}}
+	}
+	return schema.validate(data)
+}
+
+// recordConformance writes the result under ledger/conformance/.
+func recordConformance(ctx context.Context, uploader *storage.S3Uploader, result conformanceResult) error {
+	result.Conforms = len(result.Errors) == 0
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Conformance of %s: %v", result.Key, result.Conforms)
+	return uploader.UploadJSON(ctx, conformancePrefix+result.Key, string(body))
+}
+
+// categoryForKey finds the category whose prefix the object key falls under.
+func (a *App) categoryForKey(key string) (*uploadCategory, error) {
+	allowed, err := a.loadCategories()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, category := range allowed {
+		if strings.HasPrefix(key, category.Prefix+"/") {
+			return category, nil
+		}
+	}
+	if strings.HasPrefix(key, defaultCategory.Prefix+"/") {
+		return defaultCategory, nil
+	}
+
+	return nil, nil
+}
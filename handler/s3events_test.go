@@ -0,0 +1,43 @@
+package handler
+
+import "testing"
+
+func TestConformanceErrors(t *testing.T) {
+	category := &uploadCategory{
+		Name:   "sleep",
+		Prefix: "sleep",
+		Schema: &payloadSchema{Version: "2", Type: "object", Required: []string{"start", "end"}},
+		Versions: map[string]*payloadSchema{
+			"1": {Type: "object", Required: []string{"start"}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		version  string
+		data     string
+		wantRule string
+	}{
+		{name: "current schema", data: `{"start":"22:00","end":"07:00"}`},
+		{name: "current schema by version", version: "2", data: `{"start":"22:00","end":"07:00"}`},
+		{name: "current schema violated", data: `{"start":"22:00"}`, wantRule: "required"},
+		{name: "older version", version: "1", data: `{"start":"22:00"}`},
+		{name: "older version violated", version: "1", data: `{"end":"07:00"}`, wantRule: "required"},
+		{name: "unknown version", version: "3", data: `{"start":"22:00","end":"07:00"}`, wantRule: "schema_version"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := category.conformanceErrors(tt.version, tt.data)
+			if tt.wantRule == "" {
+				if len(errs) != 0 {
+					t.Fatalf("conformanceErrors() = %v, want none", errs)
+				}
+				return
+			}
+			if len(errs) == 0 || errs[0].Rule != tt.wantRule {
+				t.Fatalf("conformanceErrors() = %v, want a %s error", errs, tt.wantRule)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/httpapi"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/storage"
+)
+
+const (
+	// scanQuarantinePrefix holds uploads until they have been scanned.
+	scanQuarantinePrefix = "quarantine/"
+
+	// defaultClamdAddr is where the ClamAV Lambda layer runs clamd.
+	defaultClamdAddr = "127.0.0.1:3310"
+
+	// clamdChunkSize is the size of the INSTREAM chunks sent to clamd.
+	clamdChunkSize = 64 * 1024
+
+	clamdTimeout = 30 * time.Second
+
+	// defaultClamdStreamMax is clamd's default StreamMaxLength; it refuses
+	// longer INSTREAM scans.
+	defaultClamdStreamMax = 25 << 20
+)
+
+var (
+	sqsOnce   sync.Once
+	sqsClient *sqs.Client
+	sqsErr    error
+)
+
+// SQSAPI is the part of the SQS client used to queue scan jobs.
+type SQSAPI interface {
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+}
+
+func getSQSClient() (*sqs.Client, error) {
+	sqsOnce.Do(func() {
+		cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion("eu-west-2"))
+		if err != nil {
+			sqsErr = fmt.Errorf("unable to load AWS config: %v", err)
+			return
+		}
+		sqsClient = sqs.NewFromConfig(cfg)
+	})
+
+	return sqsClient, sqsErr
+}
+
+func (a *App) sqsClient() (SQSAPI, error) {
+	if a.SQS == nil {
+		return nil, errors.New("no SQS client is configured")
+	}
+	return a.SQS()
+}
+
+// scanVerdict is a scanner's opinion of an upload.
+type scanVerdict struct {
+	Clean     bool
+	Signature string
+}
+
+// scanner checks uploaded files for viruses and malware.
+type scanner interface {
+	scan(ctx context.Context, r io.Reader) (scanVerdict, error)
+}
+
+// scanJob asks the asynchronous scanner to check a quarantined upload and
+// move it to its destination if it is clean.
+type scanJob struct {
+	Bucket         string `json:"bucket"`
+	Key            string `json:"key"`
+	DestinationKey string `json:"destination_key"`
+}
+
+// scanningEnabled reports whether SCANNER_MODE is set. Uploads are then
+// written under quarantine/ and only reach their destination once scanned:
+// "clamav" scans inline with clamd at CLAMD_ADDR, "quarantine" publishes a
+// scan job to SCAN_QUEUE_URL for an out-of-band scanner.
+func (a *App) scanningEnabled() bool {
+	return a.getenv("SCANNER_MODE") != ""
+}
+
+// quarantinedKey is where an upload bound for key waits to be scanned.
+func quarantinedKey(key string) string {
+	return scanQuarantinePrefix + key
+}
+
+// multipartObjectKey is where a multipart upload for key is written: under
+// quarantine/ while scanning is enabled, else straight to key.
+func (a *App) multipartObjectKey(key string) string {
+	if a.scanningEnabled() {
+		return quarantinedKey(key)
+	}
+	return key
+}
+
+// clamdScanner streams files to clamd with the INSTREAM command.
+type clamdScanner struct {
+	addr string
+}
+
+func (c clamdScanner) scan(ctx context.Context, r io.Reader) (scanVerdict, error) {
+	dialer := net.Dialer{Timeout: clamdTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return scanVerdict{}, fmt.Errorf("unable to reach clamd: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(clamdTimeout))
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return scanVerdict{}, err
+	}
+
+	chunk := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, err := r.Read(chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(append(size, chunk[:n]...)); err != nil {
+				return scanVerdict{}, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return scanVerdict{}, err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return scanVerdict{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return scanVerdict{}, err
+	}
+	reply = strings.TrimSpace(strings.TrimSuffix(reply, "\x00"))
+
+	// replies look like "stream: OK" or "stream: Eicar-Signature FOUND"
+	switch {
+	case strings.HasSuffix(reply, " OK"):
+		return scanVerdict{Clean: true}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		signature := strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND")
+		return scanVerdict{Signature: signature}, nil
+	default:
+		return scanVerdict{}, fmt.Errorf("unexpected clamd reply %q", reply)
+	}
+}
+
+// clamdStreamMax is CLAMD_STREAM_MAX_BYTES, which must match clamd's
+// StreamMaxLength. Larger uploads are left to the asynchronous scanner.
+func (a *App) clamdStreamMax() int64 {
+	if limit, err := strconv.ParseInt(a.getenv("CLAMD_STREAM_MAX_BYTES"), 10, 64); err == nil && limit > 0 {
+		return limit
+	}
+	return defaultClamdStreamMax
+}
+
+// releaseScannedUpload deals with a completed upload waiting under
+// quarantine/, either scanning it inline and moving it to key if clean, or
+// leaving it for the asynchronous scanner.
+func (a *App) releaseScannedUpload(ctx context.Context, uploader *storage.S3Uploader, category *uploadCategory, key string) (events.APIGatewayProxyResponse, error) {
+	quarantined := quarantinedKey(key)
+
+	switch mode := a.getenv("SCANNER_MODE"); mode {
+	case "clamav":
+		addr := a.getenv("CLAMD_ADDR")
+		if addr == "" {
+			addr = defaultClamdAddr
+		}
+		return a.scanInline(ctx, clamdScanner{addr: addr}, uploader, category, quarantined, key)
+	case "quarantine":
+		return a.queueScan(ctx, uploader, quarantined, key)
+	default:
+		return httpapi.ErrorResponse(http.StatusInternalServerError, fmt.Errorf("invalid SCANNER_MODE %q", mode))
+	}
+}
+
+// queueScan leaves the quarantined upload to the asynchronous scanner.
+func (a *App) queueScan(ctx context.Context, uploader *storage.S3Uploader, quarantined, key string) (events.APIGatewayProxyResponse, error) {
+	if err := a.publishScanJob(ctx, scanJob{Bucket: uploader.Bucket, Key: quarantined, DestinationKey: key}); err != nil {
+		return httpapi.ErrorResponse(http.StatusInternalServerError, err)
+	}
+	return httpapi.JSONResponse(http.StatusAccepted, map[string]string{"key": key, "status": "pending_scan"})
+}
+
+// scanInline scans the quarantined upload with clamd and moves it to key if
+// it is clean. Uploads longer than clamd will stream are queued for the
+// asynchronous scanner instead, which SCAN_QUEUE_URL must then be set for.
+func (a *App) scanInline(ctx context.Context, s scanner, uploader *storage.S3Uploader, category *uploadCategory, quarantined, key string) (events.APIGatewayProxyResponse, error) {
+	info, err := uploader.Head(ctx, quarantined)
+	if err != nil {
+		return httpapi.ErrorResponse(http.StatusInternalServerError, httpapi.WithCode(httpapi.CodeUpstreamS3, fmt.Errorf("unable to read upload for scanning: %v", err)))
+	}
+	if info.Size > a.clamdStreamMax() {
+		return a.queueScan(ctx, uploader, quarantined, key)
+	}
+
+	output, err := uploader.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(uploader.Bucket),
+		Key:    aws.String(quarantined),
+	})
+	if err != nil {
+		return httpapi.ErrorResponse(http.StatusInternalServerError, httpapi.WithCode(httpapi.CodeUpstreamS3, fmt.Errorf("unable to read upload for scanning: %v", err)))
+	}
+	defer output.Body.Close()
+
+	verdict, err := s.scan(ctx, output.Body)
+	if err != nil {
+		return httpapi.ErrorResponse(http.StatusServiceUnavailable, fmt.Errorf("unable to scan upload: %v", err))
+	}
+	if !verdict.Clean {
+		log.Printf("Upload %s matched %s and stays quarantined", quarantined, verdict.Signature)
+		a.emitMetrics(map[string]string{"Category": category.Name}, metric{Name: "InfectedUploads", Value: 1, Unit: "Count"})
+		return httpapi.ErrorResponse(http.StatusUnprocessableEntity, httpapi.WithCode(httpapi.CodeMalwareDetected, errors.New("upload was rejected by the malware scanner")))
+	}
+
+	if err := uploader.CopyObject(ctx, quarantined, key); err != nil {
+		return httpapi.ErrorResponse(http.StatusInternalServerError, httpapi.WithCode(httpapi.CodeUpstreamS3, fmt.Errorf("unable to release scanned upload: %v", err)))
+	}
+	_, err = uploader.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(uploader.Bucket),
+		Key:    aws.String(quarantined),
+	})
+	if err != nil {
+		log.Printf("Unable to remove released upload from quarantine: %v", err)
+	}
+
+	return httpapi.JSONResponse(http.StatusOK, map[string]string{"key": key})
+}
+
+func (a *App) publishScanJob(ctx context.Context, job scanJob) error {
+	queueURL := a.getenv("SCAN_QUEUE_URL")
+	if queueURL == "" {
+		return errors.New("SCAN_QUEUE_URL is required with SCANNER_MODE=quarantine")
+	}
+
+	client, err := a.sqsClient()
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(queueURL),
+		MessageBody: aws.String(string(body)),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to publish scan job: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// fakeClamd serves one INSTREAM scan, answering with reply. The streamed
+// file is sent on the returned channel.
+func fakeClamd(t *testing.T, reply string) (string, <-chan []byte) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		command, err := r.ReadString(0)
+		if err != nil || command != "zINSTREAM\x00" {
+			return
+		}
+		var file bytes.Buffer
+		size := make([]byte, 4)
+		for {
+			if _, err := io.ReadFull(r, size); err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(size)
+			if n == 0 {
+				break
+			}
+			if _, err := io.CopyN(&file, r, int64(n)); err != nil {
+				return
+			}
+		}
+		received <- file.Bytes()
+		conn.Write([]byte(reply + "\x00"))
+	}()
+
+	return listener.Addr().String(), received
+}
+
+func TestClamdScanner(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		reply     string
+		want      scanVerdict
+		wantError bool
+	}{
+		{name: "clean", file: "id,steps\n1,4000\n", reply: "stream: OK", want: scanVerdict{Clean: true}},
+		{name: "infected", file: "X5O!P%@AP", reply: "stream: Eicar-Test-Signature FOUND", want: scanVerdict{Signature: "Eicar-Test-Signature"}},
+		{name: "larger than a chunk", file: strings.Repeat("a", clamdChunkSize*2+10), reply: "stream: OK", want: scanVerdict{Clean: true}},
+		{name: "empty", reply: "stream: OK", want: scanVerdict{Clean: true}},
+		{name: "over the stream limit", file: "big", reply: "INSTREAM size limit exceeded. ERROR", wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, received := fakeClamd(t, tt.reply)
+
+			verdict, err := clamdScanner{addr: addr}.scan(context.Background(), strings.NewReader(tt.file))
+			if tt.wantError {
+				if err == nil {
+					t.Fatalf("scan() = %+v, want an error", verdict)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("scan() error = %v", err)
+			}
+			if verdict != tt.want {
+				t.Errorf("scan() = %+v, want %+v", verdict, tt.want)
+			}
+			if file := <-received; string(file) != tt.file {
+				t.Errorf("clamd received %d bytes, want the %d byte file", len(file), len(tt.file))
+			}
+		})
+	}
+}
+
+func TestClamdScannerUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	if _, err := (clamdScanner{addr: addr}).scan(context.Background(), strings.NewReader("x")); err == nil {
+		t.Fatal("scan() error = nil, want an error when clamd is down")
+	}
+}
+
+// fakeSQS records the messages sent to it.
+type fakeSQS struct {
+	sent []*sqs.SendMessageInput
+}
+
+func (f *fakeSQS) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	f.sent = append(f.sent, params)
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func TestPublishScanJob(t *testing.T) {
+	queue := &fakeSQS{}
+	env := map[string]string{}
+	app := &App{
+		Getenv: func(key string) string { return env[key] },
+		SQS:    func() (SQSAPI, error) { return queue, nil },
+	}
+	job := scanJob{Bucket: "uploads", Key: quarantinedKey("sleep/a.bin"), DestinationKey: "sleep/a.bin"}
+
+	if err := app.publishScanJob(context.Background(), job); err == nil {
+		t.Fatal("publishScanJob() without SCAN_QUEUE_URL: error = nil, want an error")
+	}
+
+	env["SCAN_QUEUE_URL"] = "https://sqs.eu-west-2.amazonaws.com/123/scans"
+	if err := app.publishScanJob(context.Background(), job); err != nil {
+		t.Fatalf("publishScanJob() error = %v", err)
+	}
+	if len(queue.sent) != 1 || aws.ToString(queue.sent[0].QueueUrl) != env["SCAN_QUEUE_URL"] {
+		t.Fatalf("sent %+v, want one message to %s", queue.sent, env["SCAN_QUEUE_URL"])
+	}
+	var got scanJob
+	if err := json.Unmarshal([]byte(aws.ToString(queue.sent[0].MessageBody)), &got); err != nil || got != job {
+		t.Errorf("message = %s, want %+v", aws.ToString(queue.sent[0].MessageBody), job)
+	}
+}
+
+func TestMultipartObjectKey(t *testing.T) {
+	for _, tt := range []struct {
+		mode string
+		want string
+	}{
+		{mode: "", want: "sleep/a.bin"},
+		{mode: "clamav", want: "quarantine/sleep/a.bin"},
+		{mode: "quarantine", want: "quarantine/sleep/a.bin"},
+	} {
+		env := map[string]string{"SCANNER_MODE": tt.mode}
+		app := &App{Getenv: func(key string) string { return env[key] }}
+		if got := app.multipartObjectKey("sleep/a.bin"); got != tt.want {
+			t.Errorf("SCANNER_MODE=%q: multipartObjectKey() = %q, want %q", tt.mode, got, tt.want)
+		}
+	}
+}
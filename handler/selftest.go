@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	// bucketSelfTestPrefix is where the cold-start self-test writes.
+	bucketSelfTestPrefix = "healthcheck/"
+
+	// bucketSelfTestTimeout bounds the whole self-test, which delays the
+	// first request.
+	bucketSelfTestTimeout = 5 * time.Second
+)
+
+// bucketSelfTestEnabled reports whether BUCKET_SELF_TEST is set.
+func (a *App) bucketSelfTestEnabled() bool {
+	enabled, _ := strconv.ParseBool(a.getenv("BUCKET_SELF_TEST"))
+	return enabled
+}
+
+// verifyBucket checks at cold start that the execution role can reach and
+// write to BUCKET_NAME, and that the bucket encrypts objects by default, so
+// a missing permission shows up in the logs as soon as a deploy lands
+// rather than on the first upload. Every problem is logged and counted in
+// BucketSelfTestFailures by check; none stops the function starting.
+func (a *App) verifyBucket(ctx context.Context) {
+	bucket := a.getenv("BUCKET_NAME")
+	if bucket == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, bucketSelfTestTimeout)
+	defer cancel()
+
+	uploader, err := a.NewUploader(defaultTenant, bucket)
+	if err != nil {
+		a.selfTestFailed("uploader", "Bucket self-test could not create an uploader for %s: %v", bucket, err)
+		return
+	}
+	s3Uploader, err := asS3Uploader(uploader)
+	if err != nil {
+		return
+	}
+
+	if _, err := s3Uploader.Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		a.selfTestFailed("head", "Bucket self-test cannot reach bucket %s (check it exists and the role has s3:ListBucket): %v", bucket, err)
+		return
+	}
+
+	encryption, err := s3Uploader.Client.GetBucketEncryption(ctx, &s3.GetBucketEncryptionInput{Bucket: aws.String(bucket)})
+	switch {
+	case err != nil:
+		a.selfTestFailed("encryption", "Bucket self-test cannot read the default encryption of %s (check it has default encryption and the role has s3:GetEncryptionConfiguration): %v", bucket, err)
+	case encryption.ServerSideEncryptionConfiguration == nil || len(encryption.ServerSideEncryptionConfiguration.Rules) == 0:
+		a.selfTestFailed("encryption", "Bucket self-test found no default encryption on %s", bucket)
+	default:
+		rule := encryption.ServerSideEncryptionConfiguration.Rules[0].ApplyServerSideEncryptionByDefault
+		if rule != nil {
+			log.Printf("Bucket %s encrypts objects with %s by default", bucket, rule.SSEAlgorithm)
+		}
+	}
+
+	key := fmt.Sprintf("%s%d.json", bucketSelfTestPrefix, time.Now().UnixNano())
+	if err := s3Uploader.UploadJSON(ctx, key, `{"self_test":true}`); err != nil {
+		if isAccessDenied(err) {
+			a.selfTestFailed("put", "Bucket self-test: the execution role lacks s3:PutObject on %s, so every upload will fail: %v", bucket, err)
+		} else {
+			a.selfTestFailed("put", "Bucket self-test could not write to %s: %v", bucket, err)
+		}
+		return
+	}
+
+	if _, err := s3Uploader.Client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}); err != nil {
+		a.selfTestFailed("delete", "Bucket self-test could not delete %s from %s; a lifecycle rule on %s can clean it up: %v", key, bucket, bucketSelfTestPrefix, err)
+		return
+	}
+
+	log.Printf("Bucket self-test passed for %s", bucket)
+}
+
+func (a *App) selfTestFailed(check string, format string, v ...interface{}) {
+	log.Printf(format, v...)
+	a.emitMetrics(map[string]string{"Check": check}, metric{Name: "BucketSelfTestFailures", Value: 1, Unit: "Count"})
+}
+
+// isAccessDenied reports whether S3 refused the call for lack of permission.
+func isAccessDenied(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "AccessDenied"
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// shutdownTimeout bounds the flush at shutdown. Lambda allows 300ms
+// between SIGTERM and SIGKILL when only internal extensions are registered.
+const shutdownTimeout = 250 * time.Millisecond
+
+var (
+	shutdownMu    sync.Mutex
+	shutdownHooks []func(context.Context)
+
+	// background tracks work that may outlive the request that started it,
+	// such as a secondary write the request stopped waiting for.
+	background sync.WaitGroup
+)
+
+// onShutdown registers fn to flush buffered work before the sandbox shuts
+// down.
+func onShutdown(fn func(context.Context)) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	shutdownHooks = append(shutdownHooks, fn)
+}
+
+// shutdown is called when Lambda sends SIGTERM before shutting the sandbox
+// down. It waits up to half of shutdownTimeout for background work, so the
+// hooks it may feed are left time to run, then runs the shutdown hooks in
+// reverse order of registration.
+func shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout / 2):
+		log.Printf("Shutting down with background work still in flight")
+	}
+
+	shutdownMu.Lock()
+	hooks := shutdownHooks
+	shutdownMu.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i](ctx)
+	}
+}
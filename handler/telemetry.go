@@ -0,0 +1,173 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/storage"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	otelmetric "go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	tracerProvider *sdktrace.TracerProvider
+	meterProvider  *sdkmetric.MeterProvider
+
+	instrumentsMu sync.Mutex
+	counters      = map[string]otelmetric.Float64Counter{}
+	histograms    = map[string]otelmetric.Float64Histogram{}
+)
+
+// tracer makes the request and stage spans. Until setupTelemetry installs a
+// provider it is a no-op.
+func tracer() trace.Tracer {
+	return otel.Tracer(storage.ProducerName)
+}
+
+// setupTelemetry exports traces and metrics over OTLP/HTTP when
+// OTEL_EXPORTER_OTLP_ENDPOINT is set, for stacks that use an OpenTelemetry
+// collector rather than X-Ray. The exporters read the rest of the standard
+// OTEL_* variables from the process environment themselves.
+func setupTelemetry(ctx context.Context, getenv func(string) string) error {
+	if getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" {
+		return nil
+	}
+
+	serviceName := getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = storage.ProducerName
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(serviceName)))
+	if err != nil {
+		return err
+	}
+
+	traceExporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return err
+	}
+	metricExporter, err := otlpmetrichttp.New(ctx)
+	if err != nil {
+		return err
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(traceExporter), sdktrace.WithResource(res))
+	meterProvider = sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)), sdkmetric.WithResource(res))
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetMeterProvider(meterProvider)
+	onShutdown(shutdownTelemetry)
+	return nil
+}
+
+// flushTelemetry exports everything recorded during the invocation, since
+// Lambda freezes the process between invocations.
+func flushTelemetry(ctx context.Context) {
+	if tracerProvider != nil {
+		if err := tracerProvider.ForceFlush(ctx); err != nil {
+			log.Printf("Unable to flush traces: %v", err)
+		}
+	}
+	if meterProvider != nil {
+		if err := meterProvider.ForceFlush(ctx); err != nil {
+			log.Printf("Unable to flush metrics: %v", err)
+		}
+	}
+}
+
+// shutdownTelemetry exports anything left and stops the providers when the
+// sandbox shuts down.
+func shutdownTelemetry(ctx context.Context) {
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		log.Printf("Unable to shut down tracing: %v", err)
+	}
+	if err := meterProvider.Shutdown(ctx); err != nil {
+		log.Printf("Unable to shut down metrics: %v", err)
+	}
+}
+
+// recordOTelMetrics mirrors EMF metrics into OpenTelemetry with the same
+// names, and the dimensions as attributes: counts become counters and
+// everything else a histogram.
+func recordOTelMetrics(dimensions map[string]string, metrics []metric) {
+	if meterProvider == nil {
+		return
+	}
+
+	keys := make([]string, 0, len(dimensions))
+	for key := range dimensions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	attrs := make([]attribute.KeyValue, len(keys))
+	for i, key := range keys {
+		attrs[i] = attribute.String(key, dimensions[key])
+	}
+	options := otelmetric.WithAttributes(attrs...)
+
+	ctx := context.Background()
+	for _, m := range metrics {
+		if m.Unit == "Count" {
+			if counter, err := otelCounter(m.Name); err == nil {
+				counter.Add(ctx, m.Value, options)
+			}
+			continue
+		}
+		if histogram, err := otelHistogram(m.Name, m.Unit); err == nil {
+			histogram.Record(ctx, m.Value, options)
+		}
+	}
+}
+
+func otelCounter(name string) (otelmetric.Float64Counter, error) {
+	instrumentsMu.Lock()
+	defer instrumentsMu.Unlock()
+
+	if counter, ok := counters[name]; ok {
+		return counter, nil
+	}
+	counter, err := otel.Meter(storage.ProducerName).Float64Counter(name)
+	if err != nil {
+		return nil, err
+	}
+	counters[name] = counter
+	return counter, nil
+}
+
+func otelHistogram(name, unit string) (otelmetric.Float64Histogram, error) {
+	instrumentsMu.Lock()
+	defer instrumentsMu.Unlock()
+
+	if histogram, ok := histograms[name]; ok {
+		return histogram, nil
+	}
+	histogram, err := otel.Meter(storage.ProducerName).Float64Histogram(name, otelmetric.WithUnit(otelUnit(unit)))
+	if err != nil {
+		return nil, err
+	}
+	histograms[name] = histogram
+	return histogram, nil
+}
+
+// otelUnit converts a CloudWatch unit to UCUM, as OpenTelemetry expects.
+func otelUnit(unit string) string {
+	switch unit {
+	case "Milliseconds":
+		return "ms"
+	case "Seconds":
+		return "s"
+	case "Bytes":
+		return "By"
+	default:
+		return ""
+	}
+}
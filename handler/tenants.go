@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/storage"
+)
+
+// systemCodeTagKey is the object tag recording which client application an
+// upload was made through.
+const systemCodeTagKey = "system-code"
+
+// tenantTags are the object tags an upload for tenant is stored with.
+func tenantTags(tenant string) map[string]string {
+	if tenant == "" || tenant == defaultTenant {
+		return nil
+	}
+	return map[string]string{systemCodeTagKey: tenant}
+}
+
+// tenantBucket is an enterprise tenant's own bucket, written to through a
+// role in their account.
+type tenantBucket struct {
+	BucketARN  string `json:"bucket_arn"`
+	RoleARN    string `json:"role_arn"`
+	ExternalID string `json:"external_id,omitempty"`
+	Region     string `json:"region,omitempty"`
+}
+
+// loadTenantBuckets parses TENANT_BUCKETS, a JSON object of system code to
+// tenantBucket, e.g.
+//
+//	{"ACME": {"bucket_arn": "arn:aws:s3:::acme-uploads", "role_arn": "arn:aws:iam::123456789012:role/upload"}}
+func (a *App) loadTenantBuckets() (map[string]*tenantBucket, error) {
+	return a.tenantBuckets.get(func() (map[string]*tenantBucket, error) {
+		buckets := map[string]*tenantBucket{}
+
+		raw := a.getenv("TENANT_BUCKETS")
+		if raw == "" {
+			return buckets, nil
+		}
+
+		if err := json.Unmarshal([]byte(raw), &buckets); err != nil {
+			return nil, fmt.Errorf("invalid TENANT_BUCKETS: %v", err)
+		}
+
+		for tenant, bucket := range buckets {
+			if bucket == nil || !strings.HasPrefix(bucket.BucketARN, "arn:aws:s3:::") || bucket.RoleARN == "" {
+				return nil, fmt.Errorf("invalid TENANT_BUCKETS: tenant %q needs a bucket_arn and role_arn", tenant)
+			}
+		}
+		return buckets, nil
+	})
+}
+
+// uploaderForTenant returns an uploader for the tenant's own bucket when one
+// is registered, otherwise for the default bucket. tenant must come from
+// sessionTenant: writing through a tenant's role on a client's say-so would
+// let anyone write into that tenant's account.
+func (a *App) uploaderForTenant(tenant, defaultBucket string) (*storage.S3Uploader, error) {
+	buckets, err := a.loadTenantBuckets()
+	if err != nil {
+		return nil, err
+	}
+
+	a.uploadersMu.Lock()
+	defer a.uploadersMu.Unlock()
+
+	bucket, ok := buckets[tenant]
+	if !ok {
+		// reuse the client so its connections to S3 stay warm
+		if uploader, ok := a.bucketUploaders[defaultBucket]; ok {
+			return uploader, nil
+		}
+		uploader, err := storage.NewS3Uploader(defaultBucket, a.getenv)
+		if err != nil {
+			return nil, err
+		}
+		if a.bucketUploaders == nil {
+			a.bucketUploaders = map[string]*storage.S3Uploader{}
+		}
+		a.bucketUploaders[defaultBucket] = uploader
+		return uploader, nil
+	}
+
+	// reuse the uploader so the assumed role credentials stay cached
+	if uploader, ok := a.tenantUploaders[tenant]; ok {
+		return uploader, nil
+	}
+
+	uploader, err := a.newCrossAccountUploader(bucket)
+	if err != nil {
+		return nil, err
+	}
+	if a.tenantUploaders == nil {
+		a.tenantUploaders = map[string]*storage.S3Uploader{}
+	}
+	a.tenantUploaders[tenant] = uploader
+
+	return uploader, nil
+}
+
+func (a *App) newCrossAccountUploader(bucket *tenantBucket) (*storage.S3Uploader, error) {
+	region := bucket.Region
+	if region == "" {
+		region = "eu-west-2"
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load AWS config: %v", err)
+	}
+
+	provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), bucket.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = storage.ProducerName
+		if bucket.ExternalID != "" {
+			o.ExternalID = aws.String(bucket.ExternalID)
+		}
+	})
+	cfg.Credentials = aws.NewCredentialsCache(provider)
+
+	client := s3.NewFromConfig(cfg, storage.S3Options(a.getenv))
+	return &storage.S3Uploader{Client: client, Bucket: strings.TrimPrefix(bucket.BucketARN, "arn:aws:s3:::"), Getenv: a.getenv}, nil
+}
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/httpapi"
+)
+
+// defaultWarmupMarker is the field scheduler pings set to true when
+// WARMUP_MARKER is not set.
+const defaultWarmupMarker = "warmup"
+
+// isWarmup reports whether payload is a warm-up ping, a JSON object with the
+// WARMUP_MARKER field set to true.
+func (a *App) isWarmup(payload []byte) bool {
+	marker := a.getenv("WARMUP_MARKER")
+	if marker == "" {
+		marker = defaultWarmupMarker
+	}
+
+	var event map[string]interface{}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return false
+	}
+	warmup, _ := event[marker].(bool)
+	return warmup
+}
+
+// Invoke is the Lambda entrypoint. Warm-up pings sent straight to the
+// function are answered without going through the API Gateway handler,
+// where they would fail auth and count as errors.
+func (a *App) Invoke(ctx context.Context, payload json.RawMessage) (events.APIGatewayProxyResponse, error) {
+	if a.isWarmup(payload) {
+		return a.warmUp(ctx)
+	}
+
+	var request events.APIGatewayProxyRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	return a.Handler(ctx, request)
+}
+
+// warmUp sets up the Secrets Manager, Redis and S3 clients ahead of real
+// traffic. Failures are only logged: the next request retries them anyway.
+func (a *App) warmUp(ctx context.Context) (events.APIGatewayProxyResponse, error) {
+	if a.configErr != nil {
+		return a.misconfiguredResponse()
+	}
+
+	if checker, ok := a.Sessions.(readinessChecker); ok {
+		if err := checker.Ready(ctx); err != nil {
+			log.Printf("Unable to warm up sessions Redis: %v", err)
+		}
+	}
+
+	if client := a.Redis; client != nil {
+		if err := client.Ping().Err(); err != nil {
+			log.Printf("Unable to warm up app Redis: %v", err)
+		}
+	}
+
+	if bucket := a.getenv("BUCKET_NAME"); bucket != "" {
+		if _, err := a.NewUploader(defaultTenant, bucket); err != nil {
+			log.Printf("Unable to warm up S3 uploader: %v", err)
+		}
+	}
+
+	a.emitMetrics(nil, metric{Name: "WarmupInvocations", Value: 1, Unit: "Count"})
+	return httpapi.JSONResponse(http.StatusOK, map[string]string{"status": "warmed"})
+}
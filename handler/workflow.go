@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+)
+
+// executionHeader carries the ARN of the Step Functions execution started
+// for an upload back to the client.
+const executionHeader = "X-Execution-Arn"
+
+var (
+	sfnOnce   sync.Once
+	sfnClient *sfn.Client
+	sfnErr    error
+)
+
+// SFNAPI is the part of the Step Functions client used to start
+// post-processing workflows.
+type SFNAPI interface {
+	StartExecution(ctx context.Context, params *sfn.StartExecutionInput, optFns ...func(*sfn.Options)) (*sfn.StartExecutionOutput, error)
+}
+
+func getSFNClient() (*sfn.Client, error) {
+	sfnOnce.Do(func() {
+		cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion("eu-west-2"))
+		if err != nil {
+			sfnErr = fmt.Errorf("unable to load AWS config: %v", err)
+			return
+		}
+		sfnClient = sfn.NewFromConfig(cfg)
+	})
+
+	return sfnClient, sfnErr
+}
+
+func (a *App) sfnClient() (SFNAPI, error) {
+	if a.StepFunctions == nil {
+		return nil, errors.New("no Step Functions client is configured")
+	}
+	return a.StepFunctions()
+}
+
+// workflowInput is what a post-processing execution is started with.
+type workflowInput struct {
+	Bucket    string `json:"bucket,omitempty"`
+	Key       string `json:"key"`
+	Category  string `json:"category"`
+	UserID    int64  `json:"user_id"`
+	Tenant    string `json:"tenant"`
+	RequestID string `json:"request_id"`
+}
+
+// workflowEnabled reports whether the category's uploads are handed to the
+// STATE_MACHINE_ARN state machine: it must be listed in WORKFLOW_CATEGORIES
+// (comma separated category names).
+func (a *App) workflowEnabled(category *uploadCategory) bool {
+	if a.getenv("STATE_MACHINE_ARN") == "" {
+		return false
+	}
+	for _, name := range strings.Split(a.getenv("WORKFLOW_CATEGORIES"), ",") {
+		if strings.TrimSpace(name) == category.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// workflowFailuresFatal is WORKFLOW_FAILURES_FATAL. By default an execution
+// that can't be started is only logged and counted, since the upload
+// itself has succeeded; when fatal the request fails with 502
+// WORKFLOW_FAILED, still carrying the key the document was stored under.
+func (a *App) workflowFailuresFatal() bool {
+	fatal, _ := strconv.ParseBool(a.getenv("WORKFLOW_FAILURES_FATAL"))
+	return fatal
+}
+
+// startWorkflow starts a post-processing execution for the object stored
+// at key and returns its ARN.
+func (a *App) startWorkflow(ctx context.Context, doc uploadDocument, key string) (string, error) {
+	client, err := a.sfnClient()
+	if err != nil {
+		return "", err
+	}
+
+	input := workflowInput{
+		Bucket:    bucketOf(doc.uploader),
+		Key:       key,
+		Category:  doc.category.Name,
+		UserID:    doc.userID,
+		Tenant:    doc.tenant,
+		RequestID: doc.requestID,
+	}
+	encoded, err := json.Marshal(input)
+	if err != nil {
+		return "", err
+	}
+
+	output, err := client.StartExecution(ctx, &sfn.StartExecutionInput{
+		StateMachineArn: aws.String(a.getenv("STATE_MACHINE_ARN")),
+		Input:           aws.String(string(encoded)),
+	})
+	if err != nil {
+		log.Printf("Unable to start processing %s: %v", key, err)
+		a.emitMetrics(map[string]string{"Category": doc.category.Name}, metric{Name: "WorkflowStartFailures", Value: 1, Unit: "Count"})
+		return "", fmt.Errorf("unable to start processing: %v", err)
+	}
+	return aws.ToString(output.ExecutionArn), nil
+}
@@ -0,0 +1,95 @@
+// Package auth resolves the bearer tokens clients upload with to sessions.
+package auth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/bootsdigitalhealth/lambda-upload-s3/upload"
+)
+
+// ErrInvalidSession is returned for tokens without a valid session.
+var ErrInvalidSession = upload.ErrInvalidSession
+
+// newDevSessionStore is set by builds with the devauth tag. It stays nil in
+// production builds so the dev stub can never be switched on there.
+var newDevSessionStore func(getenv func(string) string) (SessionStore, error)
+
+// Session is the part of a caller's session the handler relies on.
+type Session = upload.Session
+
+// SessionStore resolves a bearer token to the caller's session.
+type SessionStore = upload.SessionGetter
+
+// NewSessionStore returns the sessions Redis store, or the dev stub when
+// DEV_AUTH_ENABLED is set in a build that includes it. With
+// SESSION_CACHE_TTL_MS set, sessions are cached in memory for that long.
+// All of the store's settings are read with getenv.
+func NewSessionStore(getenv func(string) string) (SessionStore, error) {
+	store, err := newSessionStore(getenv)
+	if err != nil {
+		return nil, err
+	}
+
+	if ttl := sessionCacheTTL(getenv); ttl > 0 {
+		return newCachingSessionStore(store, ttl, sessionCacheSize(getenv)), nil
+	}
+	return store, nil
+}
+
+func newSessionStore(getenv func(string) string) (SessionStore, error) {
+	devAuth, _ := strconv.ParseBool(getenv("DEV_AUTH_ENABLED"))
+	if !devAuth {
+		return redisSessionStore{secretID: getenv("REDIS_SECRET"), timeout: CommandTimeout(getenv)}, nil
+	}
+
+	if newDevSessionStore == nil {
+		return nil, errors.New("DEV_AUTH_ENABLED is set but dev auth is not compiled into this build")
+	}
+	return newDevSessionStore(getenv)
+}
+
+// redisSessionStore looks sessions up in the sessions Redis through go-db.
+type redisSessionStore struct {
+	// secretID names the Secrets Manager secret holding the connection
+	// settings.
+	secretID string
+	timeout  time.Duration
+}
+
+// Ready connects to the sessions Redis, reading its secret from Secrets
+// Manager, if that has not happened yet.
+func (s redisSessionStore) Ready(ctx context.Context) error {
+	_, err := sessionsClient(ctx, s.secretID)
+	return err
+}
+
+func (s redisSessionStore) GetSession(ctx context.Context, token string) (Session, error) {
+	client, err := sessionsClient(ctx, s.secretID)
+	if err != nil {
+		return Session{}, err
+	}
+
+	session, err := redisCall(ctx, s.timeout, client.GetSession, token)
+	if err != nil && isRedisAuthError(err) {
+		log.Printf("Reconnecting to Redis after authentication failure: %v", err)
+		client, err = reconnectSessionsRedis(ctx, s.secretID, client)
+		if err != nil {
+			return Session{}, err
+		}
+		session, err = redisCall(ctx, s.timeout, client.GetSession, token)
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	if session.UserID == 0 {
+		return Session{}, ErrInvalidSession
+	}
+
+	// go-db's sessions don't record the system code they were created for,
+	// so the handler falls back to X-System-Code for them
+	return Session{UserID: int64(session.UserID)}, nil
+}
@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultSessionCacheSize bounds the session cache when SESSION_CACHE_SIZE
+// is not set.
+const defaultSessionCacheSize = 1024
+
+// SessionInvalidator is implemented by session stores that cache sessions.
+// Call Invalidate when a session is refreshed or deleted so the stale copy
+// is never served.
+type SessionInvalidator interface {
+	Invalidate(token string)
+}
+
+// sessionCacheTTL is SESSION_CACHE_TTL_MS. Caching is off unless it is set,
+// since a cached session outlives its deletion by up to the TTL.
+func sessionCacheTTL(getenv func(string) string) time.Duration {
+	if ms, err := strconv.Atoi(getenv("SESSION_CACHE_TTL_MS")); err == nil && ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return 0
+}
+
+// sessionCacheSize is SESSION_CACHE_SIZE or the default.
+func sessionCacheSize(getenv func(string) string) int {
+	if size, err := strconv.Atoi(getenv("SESSION_CACHE_SIZE")); err == nil && size > 0 {
+		return size
+	}
+	return defaultSessionCacheSize
+}
+
+// cachedSession is a session held by cachingSessionStore. Tokens are kept
+// only as a hash.
+type cachedSession struct {
+	key     [sha256.Size]byte
+	session Session
+	expires time.Time
+}
+
+// cachingSessionStore keeps recently resolved sessions in a small LRU for
+// the life of the container, so a chatty client doesn't cost a Redis round
+// trip per request. Only valid sessions are cached.
+type cachingSessionStore struct {
+	SessionStore
+
+	ttl      time.Duration
+	capacity int
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	// order has the most recently used session at the front.
+	order *list.List
+}
+
+func newCachingSessionStore(store SessionStore, ttl time.Duration, capacity int) *cachingSessionStore {
+	return &cachingSessionStore{
+		SessionStore: store,
+		ttl:          ttl,
+		capacity:     capacity,
+		entries:      map[[sha256.Size]byte]*list.Element{},
+		order:        list.New(),
+	}
+}
+
+func (s *cachingSessionStore) GetSession(ctx context.Context, token string) (Session, error) {
+	key := sha256.Sum256([]byte(token))
+	if session, ok := s.lookup(key); ok {
+		return session, nil
+	}
+
+	session, err := s.SessionStore.GetSession(ctx, token)
+	if err != nil {
+		return session, err
+	}
+	s.store(key, session)
+	return session, nil
+}
+
+// Invalidate drops the token's session from the cache.
+func (s *cachingSessionStore) Invalidate(token string) {
+	key := sha256.Sum256([]byte(token))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if element, ok := s.entries[key]; ok {
+		s.remove(element)
+	}
+}
+
+// Ready checks the underlying store, if it has a connection to check.
+func (s *cachingSessionStore) Ready(ctx context.Context) error {
+	if checker, ok := s.SessionStore.(interface{ Ready(context.Context) error }); ok {
+		return checker.Ready(ctx)
+	}
+	return nil
+}
+
+func (s *cachingSessionStore) lookup(key [sha256.Size]byte) (Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, ok := s.entries[key]
+	if !ok {
+		return Session{}, false
+	}
+	entry := element.Value.(*cachedSession)
+	if time.Now().After(entry.expires) {
+		s.remove(element)
+		return Session{}, false
+	}
+	s.order.MoveToFront(element)
+	return entry.session, true
+}
+
+func (s *cachingSessionStore) store(key [sha256.Size]byte, session Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := &cachedSession{key: key, session: session, expires: time.Now().Add(s.ttl)}
+	if element, ok := s.entries[key]; ok {
+		element.Value = entry
+		s.order.MoveToFront(element)
+		return
+	}
+
+	s.entries[key] = s.order.PushFront(entry)
+	for s.order.Len() > s.capacity {
+		s.remove(s.order.Back())
+	}
+}
+
+func (s *cachingSessionStore) remove(element *list.Element) {
+	s.order.Remove(element)
+	delete(s.entries, element.Value.(*cachedSession).key)
+}
@@ -0,0 +1,48 @@
+//go:build devauth
+
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// The dev session store only exists in binaries built with -tags devauth, so
+// front-end developers can exercise the upload API locally without Redis,
+// MySQL or Secrets Manager. It accepts the single DEV_AUTH_TOKEN and maps it
+// to a fake session for DEV_AUTH_USER_ID and, if set, DEV_AUTH_SYSTEM_CODE.
+func init() {
+	newDevSessionStore = func(getenv func(string) string) (SessionStore, error) {
+		if strings.EqualFold(getenv("ENVIRONMENT"), "prod") {
+			return nil, errors.New("dev auth is refused when ENVIRONMENT is prod")
+		}
+
+		token := getenv("DEV_AUTH_TOKEN")
+		if token == "" {
+			return nil, errors.New("DEV_AUTH_TOKEN must be set for dev auth")
+		}
+
+		userID, err := strconv.ParseInt(getenv("DEV_AUTH_USER_ID"), 10, 64)
+		if err != nil || userID <= 0 {
+			return nil, errors.New("DEV_AUTH_USER_ID must be a positive user ID for dev auth")
+		}
+
+		return devSessionStore{token: token, userID: userID, systemCode: getenv("DEV_AUTH_SYSTEM_CODE")}, nil
+	}
+}
+
+type devSessionStore struct {
+	token      string
+	userID     int64
+	systemCode string
+}
+
+func (d devSessionStore) GetSession(_ context.Context, token string) (Session, error) {
+	if subtle.ConstantTimeCompare([]byte(token), []byte(d.token)) != 1 {
+		return Session{}, ErrInvalidSession
+	}
+	return Session{UserID: d.userID, SystemCode: d.systemCode}, nil
+}
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/bootsdigitalhealth/go-aws/secret"
+	"github.com/bootsdigitalhealth/go-db/redis"
+)
+
+// secretGetter is the part of the go-aws secret cache the sessions Redis
+// connection needs.
+type secretGetter interface {
+	GetSecretStringAsMap(secretID string) (map[string]interface{}, error)
+}
+
+var (
+	// newSecretCache and newSessionsRedis create the connection's
+	// dependencies; tests replace them.
+	newSecretCache = func() (secretGetter, error) {
+		return secret.New()
+	}
+	newSessionsRedis = func(config map[string]interface{}) (*redis.Client, error) {
+		return redis.NewClient(config, "sessions_db")
+	}
+
+	// connectMu guards sessionsRedisClient, connecting and refreshSecrets.
+	connectMu           sync.Mutex
+	sessionsRedisClient *redis.Client
+	connecting          *connectAttempt
+	// refreshSecrets makes the next attempt fetch the Redis secret afresh.
+	refreshSecrets bool
+
+	// secretCache is only used by the connect attempt in flight, and
+	// attempts never overlap.
+	secretCache secretGetter
+)
+
+// connectAttempt is a connection to the sessions Redis being made in the
+// background. Callers wait for it or give up at their own deadline, while
+// the attempt carries on so the next request finds Redis connected.
+type connectAttempt struct {
+	done   chan struct{}
+	client *redis.Client
+	err    error
+}
+
+// sessionsClient returns the sessions Redis client, connecting if that has
+// not happened yet. Concurrent callers share a single attempt, and a failed
+// attempt is retried by the next caller.
+func sessionsClient(ctx context.Context, secretID string) (*redis.Client, error) {
+	connectMu.Lock()
+	if client := sessionsRedisClient; client != nil {
+		connectMu.Unlock()
+		return client, nil
+	}
+	attempt := connecting
+	if attempt == nil {
+		attempt = &connectAttempt{done: make(chan struct{})}
+		connecting = attempt
+		go attempt.run(secretID, refreshSecrets)
+		refreshSecrets = false
+	}
+	connectMu.Unlock()
+
+	select {
+	case <-attempt.done:
+		return attempt.client, attempt.err
+	case <-ctx.Done():
+		return nil, ErrTimeout
+	}
+}
+
+func (a *connectAttempt) run(secretID string, refresh bool) {
+	a.client, a.err = connectSessionsRedis(secretID, refresh)
+
+	connectMu.Lock()
+	if a.err == nil {
+		sessionsRedisClient = a.client
+	}
+	connecting = nil
+	connectMu.Unlock()
+
+	close(a.done)
+}
+
+// connectSessionsRedis connects with the secret named by secretID,
+// refreshing the secret cache once if Redis rejects the cached credentials.
+func connectSessionsRedis(secretID string, refresh bool) (*redis.Client, error) {
+	if secretCache == nil || refresh {
+		if err := refreshSecretCache(); err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := dialSessionsRedis(secretID)
+	if err != nil && isRedisAuthError(err) {
+		// the auth token may have rotated since the secret was cached
+		log.Printf("Refreshing Redis secret after authentication failure: %v", err)
+		if err := refreshSecretCache(); err != nil {
+			return nil, err
+		}
+		client, err = dialSessionsRedis(secretID)
+	}
+	return client, err
+}
+
+func dialSessionsRedis(secretID string) (*redis.Client, error) {
+	redisSecret, err := secretCache.GetSecretStringAsMap(secretID)
+	if err != nil {
+		return nil, err
+	}
+	return newSessionsRedis(redisSecret)
+}
+
+// redisAuthErrors are the replies Redis gives when the AUTH token is wrong,
+// typically because ElastiCache rotated it after the secret was cached.
+var redisAuthErrors = []string{"NOAUTH", "WRONGPASS", "invalid password", "invalid username-password pair"}
+
+func isRedisAuthError(err error) bool {
+	for _, reply := range redisAuthErrors {
+		if strings.Contains(err.Error(), reply) {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshSecretCache drops every cached secret so the next lookup fetches the
+// current value from Secrets Manager.
+func refreshSecretCache() error {
+	cache, err := newSecretCache()
+	if err != nil {
+		return err
+	}
+
+	secretCache = cache
+	return nil
+}
+
+// reconnectSessionsRedis makes a single attempt to reconnect with freshly
+// fetched credentials after stale failed to authenticate. Callers that see
+// the same failure together share one reconnect.
+func reconnectSessionsRedis(ctx context.Context, secretID string, stale *redis.Client) (*redis.Client, error) {
+	connectMu.Lock()
+	if sessionsRedisClient == stale {
+		sessionsRedisClient = nil
+		refreshSecrets = true
+	}
+	connectMu.Unlock()
+
+	return sessionsClient(ctx, secretID)
+}
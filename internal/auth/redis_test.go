@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bootsdigitalhealth/go-db/redis"
+)
+
+type fakeSecrets struct{}
+
+func (fakeSecrets) GetSecretStringAsMap(secretID string) (map[string]interface{}, error) {
+	return map[string]interface{}{"host": "sessions.test"}, nil
+}
+
+// fakeSessionsRedis connects the package to dial instead of a real Redis
+// and puts the connection state back afterwards.
+func fakeSessionsRedis(t *testing.T, dial func() (*redis.Client, error)) {
+	t.Helper()
+	restoreSecrets, restoreRedis := newSecretCache, newSessionsRedis
+	t.Cleanup(func() {
+		newSecretCache, newSessionsRedis = restoreSecrets, restoreRedis
+		sessionsRedisClient, secretCache, refreshSecrets = nil, nil, false
+	})
+
+	newSecretCache = func() (secretGetter, error) {
+		return fakeSecrets{}, nil
+	}
+	newSessionsRedis = func(config map[string]interface{}) (*redis.Client, error) {
+		return dial()
+	}
+}
+
+func TestReadyConnectsOnce(t *testing.T) {
+	var dials atomic.Int32
+	release := make(chan struct{})
+	fakeSessionsRedis(t, func() (*redis.Client, error) {
+		dials.Add(1)
+		<-release
+		return new(redis.Client), nil
+	})
+	store := redisSessionStore{secretID: "sessions"}
+
+	// callers that give up leave the attempt running rather than starting
+	// another one
+	for i := 0; i < 5; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		err := store.Ready(ctx)
+		cancel()
+		if !errors.Is(err, ErrTimeout) {
+			t.Fatalf("Ready() with an expired context = %v, want ErrTimeout", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := store.Ready(context.Background()); err != nil {
+				t.Errorf("Ready() = %v", err)
+			}
+		}()
+	}
+	close(release)
+	wg.Wait()
+
+	if got := dials.Load(); got != 1 {
+		t.Errorf("dialled the sessions Redis %d times, want 1", got)
+	}
+}
+
+func TestReadyRetriesAfterFailure(t *testing.T) {
+	var dials atomic.Int32
+	fakeSessionsRedis(t, func() (*redis.Client, error) {
+		if dials.Add(1) == 1 {
+			return nil, errors.New("connection refused")
+		}
+		return new(redis.Client), nil
+	})
+	store := redisSessionStore{secretID: "sessions"}
+
+	if err := store.Ready(context.Background()); err == nil {
+		t.Fatal("Ready() = nil, want the connection error")
+	}
+	if err := store.Ready(context.Background()); err != nil {
+		t.Fatalf("Ready() after a failed attempt = %v, want nil", err)
+	}
+	if err := store.Ready(context.Background()); err != nil {
+		t.Fatalf("Ready() once connected = %v, want nil", err)
+	}
+	if got := dials.Load(); got != 2 {
+		t.Errorf("dialled the sessions Redis %d times, want 2", got)
+	}
+}
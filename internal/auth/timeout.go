@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultRedisCommandTimeout bounds a single Redis command, separately
+	// from the time allowed to dial a connection.
+	defaultRedisCommandTimeout = 500 * time.Millisecond
+
+	// redisDeadlineReserve is kept back from the Lambda deadline so there is
+	// always time left to answer with a 503.
+	redisDeadlineReserve = 200 * time.Millisecond
+)
+
+var ErrTimeout = errors.New("session store did not respond in time")
+
+// CommandTimeout is REDIS_COMMAND_TIMEOUT_MS or the default.
+func CommandTimeout(getenv func(string) string) time.Duration {
+	if ms, err := strconv.Atoi(getenv("REDIS_COMMAND_TIMEOUT_MS")); err == nil && ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return defaultRedisCommandTimeout
+}
+
+// redisBudget is the per-command timeout, shortened to what remains of the
+// request deadline once the reserve is taken out.
+func redisBudget(ctx context.Context, timeout time.Duration) time.Duration {
+	budget := timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		budget = min(budget, time.Until(deadline)-redisDeadlineReserve)
+	}
+	return budget
+}
+
+// redisCall runs a call on the go-db Redis wrapper, which has no command
+// timeout of its own, and gives up with ErrTimeout once the budget is
+// spent so a hung node cannot consume the whole Lambda timeout.
+func redisCall[A, T any](ctx context.Context, timeout time.Duration, call func(A) (T, error), arg A) (T, error) {
+	var zero T
+
+	budget := redisBudget(ctx, timeout)
+	if budget <= 0 {
+		return zero, ErrTimeout
+	}
+
+	type result struct {
+		value T
+		err   error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		value, err := call(arg)
+		done <- result{value: value, err: err}
+	}()
+
+	timer := time.NewTimer(budget)
+	defer timer.Stop()
+
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-timer.C:
+		return zero, ErrTimeout
+	case <-ctx.Done():
+		return zero, ErrTimeout
+	}
+}
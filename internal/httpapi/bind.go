@@ -0,0 +1,95 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/validation"
+	"github.com/go-playground/validator/v10"
+)
+
+var (
+	validateOnce sync.Once
+	validate     *validator.Validate
+)
+
+// structValidator reports fields by their JSON names, so the pointers in
+// errors match the request body rather than the Go struct.
+func structValidator() *validator.Validate {
+	validateOnce.Do(func() {
+		validate = validator.New(validator.WithRequiredStructEnabled())
+		validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				return ""
+			}
+			if name == "" {
+				return field.Name
+			}
+			return name
+		})
+	})
+	return validate
+}
+
+// BindAndValidate decodes the JSON request body into dst, a pointer to a
+// struct, and checks it against the struct's validate tags. Every problem
+// is returned, ready for ValidationErrorResponse with a 400.
+func BindAndValidate(request events.APIGatewayProxyRequest, dst interface{}) validation.Errors {
+	if err := json.Unmarshal([]byte(request.Body), dst); err != nil {
+		invalid := validation.Error{Rule: "syntax", Message: fmt.Sprintf("invalid request body: %v", err)}
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			invalid.Pointer = validation.Pointer(strings.Split(typeErr.Field, ".")...)
+			invalid.Rule = "type"
+			invalid.Message = fmt.Sprintf("%s cannot be a %s", invalid.Pointer, typeErr.Value)
+		}
+		return validation.Errors{invalid}
+	}
+
+	err := structValidator().Struct(dst)
+	var fieldErrs validator.ValidationErrors
+	if !errors.As(err, &fieldErrs) {
+		if err != nil {
+			return validation.Errors{{Rule: "schema", Message: err.Error()}}
+		}
+		return nil
+	}
+
+	errs := make(validation.Errors, 0, len(fieldErrs))
+	for _, fieldErr := range fieldErrs {
+		pointer := namespacePointer(fieldErr.Namespace())
+		message := fmt.Sprintf("%s failed the %s rule", pointer, fieldErr.Tag())
+		if fieldErr.Param() != "" {
+			message = fmt.Sprintf("%s failed the %s=%s rule", pointer, fieldErr.Tag(), fieldErr.Param())
+		}
+		errs = append(errs, validation.Error{
+			Pointer: pointer,
+			Rule:    fieldErr.Tag(),
+			Value:   validation.Value(fieldErr.Value()),
+			Message: message,
+		})
+	}
+	return errs
+}
+
+// namespacePointer turns a validator namespace such as
+// "request.parts[0].etag" into the JSON Pointer "/parts/0/etag".
+func namespacePointer(namespace string) string {
+	_, path, _ := strings.Cut(namespace, ".")
+
+	var tokens []string
+	for _, field := range strings.Split(path, ".") {
+		name, index, indexed := strings.Cut(field, "[")
+		tokens = append(tokens, name)
+		if indexed {
+			tokens = append(tokens, strings.TrimSuffix(index, "]"))
+		}
+	}
+	return validation.Pointer(tokens...)
+}
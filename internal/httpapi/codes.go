@@ -0,0 +1,83 @@
+package httpapi
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Code identifies a kind of failure, so clients can branch on it instead of
+// parsing messages. Codes are part of the API: add new ones, never rename.
+type Code string
+
+const (
+	CodeAuthMissing          Code = "AUTH_MISSING"
+	CodeAuthInvalid          Code = "AUTH_INVALID"
+	CodeForbidden            Code = "FORBIDDEN"
+	CodeBadRequest           Code = "BAD_REQUEST"
+	CodeNotFound             Code = "NOT_FOUND"
+	CodeMethodNotAllowed     Code = "METHOD_NOT_ALLOWED"
+	CodePreconditionFailed   Code = "PRECONDITION_FAILED"
+	CodeConflict             Code = "CONFLICT"
+	CodePayloadInvalid       Code = "PAYLOAD_INVALID"
+	CodePayloadTooLarge      Code = "PAYLOAD_TOO_LARGE"
+	CodeUnsupportedMediaType Code = "UNSUPPORTED_MEDIA_TYPE"
+	CodeMalwareDetected      Code = "MALWARE_DETECTED"
+	CodeRateLimited          Code = "RATE_LIMITED"
+	CodeQuotaExceeded        Code = "QUOTA_EXCEEDED"
+	CodeUnavailable          Code = "UNAVAILABLE"
+	CodeTimeout              Code = "TIMEOUT"
+	CodeUpstreamS3           Code = "UPSTREAM_S3"
+	CodeUpstreamRedis        Code = "UPSTREAM_REDIS"
+	CodeWorkflowFailed       Code = "WORKFLOW_FAILED"
+	CodeMisconfigured        Code = "MISCONFIGURED"
+	CodeInternal             Code = "INTERNAL"
+)
+
+// statusCodes is the code used for a status when the error carries none.
+var statusCodes = map[int]Code{
+	http.StatusBadRequest:            CodeBadRequest,
+	http.StatusUnauthorized:          CodeAuthInvalid,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusMethodNotAllowed:      CodeMethodNotAllowed,
+	http.StatusConflict:              CodeConflict,
+	http.StatusPreconditionFailed:    CodePreconditionFailed,
+	http.StatusRequestEntityTooLarge: CodePayloadTooLarge,
+	http.StatusUnsupportedMediaType:  CodeUnsupportedMediaType,
+	http.StatusUnprocessableEntity:   CodePayloadInvalid,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusServiceUnavailable:    CodeUnavailable,
+	http.StatusGatewayTimeout:        CodeTimeout,
+}
+
+// CodedError is an error tagged with the code to answer it with.
+type CodedError struct {
+	Code Code
+	Err  error
+}
+
+func (e *CodedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CodedError) Unwrap() error {
+	return e.Err
+}
+
+// WithCode tags err with code.
+func WithCode(code Code, err error) error {
+	return &CodedError{Code: code, Err: err}
+}
+
+// CodeFor is the code err was tagged with, or else the usual code for the
+// status.
+func CodeFor(statusCode int, err error) Code {
+	var coded *CodedError
+	if errors.As(err, &coded) {
+		return coded.Code
+	}
+	if code, ok := statusCodes[statusCode]; ok {
+		return code
+	}
+	return CodeInternal
+}
@@ -0,0 +1,97 @@
+package httpapi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// defaultCompressionMinBytes is the smallest body compressed when
+// RESPONSE_COMPRESSION_MIN_BYTES is not set. Below it the encoding overhead
+// outweighs the saving.
+const defaultCompressionMinBytes = 1024
+
+func compressionMinBytes(getenv func(string) string) int {
+	if n, err := strconv.Atoi(getenv("RESPONSE_COMPRESSION_MIN_BYTES")); err == nil && n >= 0 {
+		return n
+	}
+	return defaultCompressionMinBytes
+}
+
+// Compress encodes the response body with gzip or deflate when the client
+// accepts one and the body is large enough to be worth it. API Gateway
+// needs binary bodies base64 encoded. getenv supplies
+// RESPONSE_COMPRESSION_MIN_BYTES.
+func Compress(getenv func(string) string, request events.APIGatewayProxyRequest, response events.APIGatewayProxyResponse) events.APIGatewayProxyResponse {
+	if response.IsBase64Encoded || len(response.Body) < compressionMinBytes(getenv) {
+		return response
+	}
+	if response.Headers["Content-Encoding"] != "" {
+		return response
+	}
+
+	encoding := acceptedEncoding(RequestHeader(request, "Accept-Encoding"))
+	if encoding == "" {
+		return response
+	}
+
+	var buf bytes.Buffer
+	var writer io.WriteCloser
+	if encoding == "gzip" {
+		writer = gzip.NewWriter(&buf)
+	} else {
+		writer = zlib.NewWriter(&buf)
+	}
+	if _, err := io.WriteString(writer, response.Body); err != nil {
+		return response
+	}
+	if err := writer.Close(); err != nil {
+		return response
+	}
+
+	if response.Headers == nil {
+		response.Headers = map[string]string{}
+	}
+	response.Headers["Content-Encoding"] = encoding
+	response.Headers["Vary"] = "Accept-Encoding"
+	response.Body = base64.StdEncoding.EncodeToString(buf.Bytes())
+	response.IsBase64Encoded = true
+	return response
+}
+
+// acceptedEncoding picks gzip, then deflate, from an Accept-Encoding header,
+// skipping any the client refused with q=0. A * accepts either.
+func acceptedEncoding(header string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+
+		refused := false
+		for _, param := range fields[1:] {
+			if q, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+					refused = true
+				}
+			}
+		}
+		accepted[name] = !refused
+	}
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		if ok, listed := accepted[encoding]; listed {
+			if ok {
+				return encoding
+			}
+		} else if accepted["*"] {
+			return encoding
+		}
+	}
+	return ""
+}
@@ -0,0 +1,125 @@
+// Package httpapi builds the API Gateway responses the upload function
+// answers with.
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/internal/validation"
+)
+
+// RequestHeader looks a header up regardless of how the client cased it.
+func RequestHeader(request events.APIGatewayProxyRequest, name string) string {
+	if value, ok := request.Headers[name]; ok {
+		return value
+	}
+	for key, value := range request.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// Envelope is the body of every JSON response: Data on success, Error on
+// failure.
+type Envelope struct {
+	Data      interface{} `json:"data,omitempty"`
+	Error     *ErrorBody  `json:"error,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+}
+
+// ErrorBody describes why a request failed.
+type ErrorBody struct {
+	Code          Code              `json:"code"`
+	Message       string            `json:"message"`
+	Errors        validation.Errors `json:"errors,omitempty"`
+	QuarantineKey string            `json:"quarantine_key,omitempty"`
+	// Key is where the document was stored when a step after storing it
+	// failed, so the client does not upload it again.
+	Key string `json:"key,omitempty"`
+}
+
+// ErrorResponse answers with the error's code and message and the status
+// code.
+func ErrorResponse(statusCode int, err error) (events.APIGatewayProxyResponse, error) {
+	return StoredErrorResponse(statusCode, err, "")
+}
+
+// StoredErrorResponse is ErrorResponse for a document that was stored at
+// key before the request failed.
+func StoredErrorResponse(statusCode int, err error, key string) (events.APIGatewayProxyResponse, error) {
+	return envelopeResponse(statusCode, Envelope{
+		Error: &ErrorBody{Code: CodeFor(statusCode, err), Message: err.Error(), Key: key},
+	})
+}
+
+// JSONResponse answers with v as the envelope's data.
+func JSONResponse(statusCode int, v interface{}) (events.APIGatewayProxyResponse, error) {
+	return envelopeResponse(statusCode, Envelope{Data: v})
+}
+
+// ValidationErrorResponse returns every validation error to the caller.
+func ValidationErrorResponse(statusCode int, errs validation.Errors) (events.APIGatewayProxyResponse, error) {
+	return QuarantinedErrorResponse(statusCode, errs, "")
+}
+
+// QuarantinedErrorResponse returns every validation error to the caller along
+// with the key the rejected payload was quarantined under, if any.
+func QuarantinedErrorResponse(statusCode int, errs validation.Errors, quarantineKey string) (events.APIGatewayProxyResponse, error) {
+	return envelopeResponse(statusCode, Envelope{
+		Error: &ErrorBody{
+			Code:          CodePayloadInvalid,
+			Message:       "payload failed validation",
+			Errors:        errs,
+			QuarantineKey: quarantineKey,
+		},
+	})
+}
+
+// WithRequestID stamps the request ID onto an enveloped response, leaving
+// any other response as it is.
+func WithRequestID(response events.APIGatewayProxyResponse, requestID string) events.APIGatewayProxyResponse {
+	if requestID == "" || response.IsBase64Encoded || response.Headers["Content-Type"] != "application/json" {
+		return response
+	}
+
+	var envelope struct {
+		Data      json.RawMessage `json:"data,omitempty"`
+		Error     *ErrorBody      `json:"error,omitempty"`
+		RequestID string          `json:"request_id,omitempty"`
+	}
+	if err := json.Unmarshal([]byte(response.Body), &envelope); err != nil {
+		return response
+	}
+	if envelope.Data == nil && envelope.Error == nil {
+		return response
+	}
+
+	envelope.RequestID = requestID
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		return response
+	}
+	response.Body = string(body)
+	return response
+}
+
+func envelopeResponse(statusCode int, envelope Envelope) (events.APIGatewayProxyResponse, error) {
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		statusCode = http.StatusInternalServerError
+		body, _ = json.Marshal(Envelope{Error: &ErrorBody{Code: CodeInternal, Message: err.Error()}})
+	}
+
+	return events.APIGatewayProxyResponse{
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body:       string(body),
+		StatusCode: statusCode,
+	}, nil
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// ErrPreconditionFailed is returned by a conditional write when the object
+// is no longer in the state the caller expected.
+var ErrPreconditionFailed = errors.New("object does not match the write's precondition")
+
+// preconditionRejections are the error codes S3 answers a conditional
+// write with when its condition does not hold, or when a concurrent
+// conditional write to the same key won.
+var preconditionRejections = map[string]bool{
+	"PreconditionFailed":         true,
+	"ConditionalRequestConflict": true,
+}
+
+// Precondition is the state an object must be in for a write to go ahead.
+// The zero value always writes.
+type Precondition struct {
+	// IfMatch is the ETag the object must still have.
+	IfMatch string
+	// IfNoneMatch, which S3 only accepts as "*", writes the object only if
+	// it does not exist yet.
+	IfNoneMatch string
+}
+
+// ConditionalUploader writes objects only when they are in the state the
+// caller expects, for clients that update a known key. *S3Uploader is the
+// production implementation.
+type ConditionalUploader interface {
+	// UploadObjectIf writes the object when condition holds and returns its
+	// new ETag, or ErrPreconditionFailed.
+	UploadObjectIf(ctx context.Context, key string, data string, contentType string, metadata map[string]string, condition Precondition) (string, error)
+	// ETag returns the object's current ETag, or "" if it does not exist.
+	ETag(ctx context.Context, key string) (string, error)
+}
+
+// UploadObjectIf writes the object with S3 conditional writes.
+func (u *S3Uploader) UploadObjectIf(ctx context.Context, key string, data string, contentType string, metadata map[string]string, condition Precondition) (string, error) {
+	return u.putObject(ctx, key, data, contentType, metadata, ObjectOptions{Condition: condition})
+}
+
+// ETag returns the object's current ETag, or "" if it does not exist.
+func (u *S3Uploader) ETag(ctx context.Context, key string) (string, error) {
+	output, err := u.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(u.Bucket),
+		Key:    aws.String(key),
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(output.ETag), nil
+}
+
+func applyPrecondition(input *s3.PutObjectInput, condition Precondition) {
+	if condition.IfMatch != "" {
+		input.IfMatch = aws.String(condition.IfMatch)
+	}
+	if condition.IfNoneMatch != "" {
+		input.IfNoneMatch = aws.String(condition.IfNoneMatch)
+	}
+}
+
+// preconditionError turns S3's rejection of a conditional write into
+// ErrPreconditionFailed.
+func preconditionError(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && preconditionRejections[apiErr.ErrorCode()] {
+		return ErrPreconditionFailed
+	}
+	return err
+}
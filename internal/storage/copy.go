@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// maxCopyObjectSize is the largest object a single CopyObject call can
+	// copy; larger objects are copied part by part.
+	maxCopyObjectSize = 5 << 30
+
+	// copyPartSize is the size of the parts larger objects are copied in,
+	// raised when needed to stay within S3's 10,000 parts.
+	copyPartSize = 512 << 20
+	maxCopyParts = 10000
+)
+
+// CopyObject copies source to key within the bucket, keeping its content
+// type, metadata and tags and writing it with S3_STORAGE_CLASS. Objects over
+// 5 GiB, which CopyObject refuses, are copied with UploadPartCopy.
+func (u *S3Uploader) CopyObject(ctx context.Context, source, key string) error {
+	class, err := StorageClass(u.getenv)
+	if err != nil {
+		return err
+	}
+
+	info, err := u.Head(ctx, source)
+	if err != nil {
+		return err
+	}
+	if info.Size <= maxCopyObjectSize {
+		_, err := u.Client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:       aws.String(u.Bucket),
+			Key:          aws.String(key),
+			CopySource:   aws.String(copySource(u.Bucket, source)),
+			StorageClass: class,
+		})
+		return err
+	}
+
+	return u.copyMultipart(ctx, source, key, info, class)
+}
+
+// copyMultipart copies an object too large for CopyObject. A multipart copy
+// carries nothing over from the source, so its content type, metadata and
+// tags are set on the new upload.
+func (u *S3Uploader) copyMultipart(ctx context.Context, source, key string, info ObjectInfo, class types.StorageClass) error {
+	tagging, err := u.Client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(u.Bucket),
+		Key:    aws.String(source),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to read tags of %s: %v", source, err)
+	}
+	tags := url.Values{}
+	for _, tag := range tagging.TagSet {
+		tags.Set(aws.ToString(tag.Key), aws.ToString(tag.Value))
+	}
+
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:       aws.String(u.Bucket),
+		Key:          aws.String(key),
+		Metadata:     info.Metadata,
+		StorageClass: class,
+	}
+	if info.ContentType != "" {
+		input.ContentType = aws.String(info.ContentType)
+	}
+	if len(tags) > 0 {
+		input.Tagging = aws.String(tags.Encode())
+	}
+	created, err := u.Client.CreateMultipartUpload(ctx, input)
+	if err != nil {
+		return err
+	}
+
+	parts, err := u.copyParts(ctx, source, key, aws.ToString(created.UploadId), info.Size)
+	if err == nil {
+		_, err = u.Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(u.Bucket),
+			Key:             aws.String(key),
+			UploadId:        created.UploadId,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		})
+	}
+	if err != nil {
+		// don't leave the copied parts behind to be billed for
+		u.Client.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(u.Bucket),
+			Key:      aws.String(key),
+			UploadId: created.UploadId,
+		})
+		return err
+	}
+	return nil
+}
+
+func (u *S3Uploader) copyParts(ctx context.Context, source, key, uploadID string, size int64) ([]types.CompletedPart, error) {
+	partSize := int64(copyPartSize)
+	if minimum := (size + maxCopyParts - 1) / maxCopyParts; minimum > partSize {
+		partSize = minimum
+	}
+
+	var parts []types.CompletedPart
+	for start, number := int64(0), int32(1); start < size; start, number = start+partSize, number+1 {
+		end := start + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		output, err := u.Client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(u.Bucket),
+			Key:             aws.String(key),
+			UploadId:        aws.String(uploadID),
+			PartNumber:      aws.Int32(number),
+			CopySource:      aws.String(copySource(u.Bucket, source)),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to copy part %d of %s: %v", number, source, err)
+		}
+		parts = append(parts, types.CompletedPart{
+			ETag:       output.CopyPartResult.ETag,
+			PartNumber: aws.Int32(number),
+		})
+	}
+	return parts, nil
+}
+
+// copySource is the x-amz-copy-source value for key in bucket.
+func copySource(bucket, key string) string {
+	return strings.ReplaceAll(url.PathEscape(bucket+"/"+key), "%2F", "/")
+}
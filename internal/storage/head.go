@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ErrObjectTooLarge is returned by DownloadLimited when the object is
+// bigger than the caller is prepared to hold in memory.
+var ErrObjectTooLarge = errors.New("object exceeds the download limit")
+
+// ObjectInfo is what HeadObject reports about an object, read before
+// deciding whether to download it.
+type ObjectInfo struct {
+	Size        int64
+	ContentType string
+	Metadata    map[string]string
+}
+
+// Head returns the object's size, content type and user metadata without
+// reading its body.
+func (u *S3Uploader) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	output, err := u.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(u.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Size:        aws.ToInt64(output.ContentLength),
+		ContentType: aws.ToString(output.ContentType),
+		Metadata:    output.Metadata,
+	}, nil
+}
+
+// DownloadLimited reads the object's body, reading at most limit bytes so an
+// object that grew after it was inspected cannot exhaust memory.
+func (u *S3Uploader) DownloadLimited(ctx context.Context, key string, limit int64) (string, error) {
+	output, err := u.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(u.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer output.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(output.Body, limit+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) > limit {
+		return "", fmt.Errorf("%w: more than %d bytes", ErrObjectTooLarge, limit)
+	}
+	return string(data), nil
+}
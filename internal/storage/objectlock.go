@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// objectLockRejections are the error codes S3 answers with when a bucket
+// cannot honour the retention requested on PutObject.
+var objectLockRejections = map[string]bool{
+	"InvalidRequest":  true,
+	"InvalidArgument": true,
+	"AccessDenied":    true,
+}
+
+// applyObjectLock sets the S3_OBJECT_LOCK_MODE retention on the upload,
+// retained for S3_OBJECT_LOCK_RETENTION_DAYS, so audit-grade payloads can't
+// be modified or deleted. Object Lock also requires an integrity checksum.
+func applyObjectLock(getenv func(string) string, input *s3.PutObjectInput) error {
+	mode := strings.ToUpper(getenv("S3_OBJECT_LOCK_MODE"))
+	if mode == "" {
+		return nil
+	}
+
+	lockMode := types.ObjectLockMode(mode)
+	if lockMode != types.ObjectLockModeGovernance && lockMode != types.ObjectLockModeCompliance {
+		return fmt.Errorf("invalid S3_OBJECT_LOCK_MODE %q", mode)
+	}
+
+	days, err := strconv.Atoi(getenv("S3_OBJECT_LOCK_RETENTION_DAYS"))
+	if err != nil || days <= 0 {
+		return fmt.Errorf("S3_OBJECT_LOCK_RETENTION_DAYS must be a positive number of days with S3_OBJECT_LOCK_MODE")
+	}
+
+	input.ObjectLockMode = lockMode
+	input.ObjectLockRetainUntilDate = aws.Time(time.Now().UTC().AddDate(0, 0, days))
+	input.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+
+	return nil
+}
+
+// objectLockError explains a PutObject failure caused by the bucket refusing
+// the Object Lock settings, e.g. because Object Lock is not enabled on it.
+func objectLockError(input *s3.PutObjectInput, err error) error {
+	var apiErr smithy.APIError
+	if input.ObjectLockMode == "" || !errors.As(err, &apiErr) || !objectLockRejections[apiErr.ErrorCode()] {
+		return err
+	}
+
+	return fmt.Errorf("bucket %s rejected object lock %s retention until %s: %s",
+		aws.ToString(input.Bucket), input.ObjectLockMode,
+		input.ObjectLockRetainUntilDate.Format(time.RFC3339), apiErr.ErrorMessage())
+}
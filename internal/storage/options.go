@@ -0,0 +1,31 @@
+package storage
+
+import "context"
+
+// ObjectOptions are settings for an upload's own object, which the
+// pointers, copies and reports written alongside it don't take. The zero
+// value writes the object like UploadObject.
+type ObjectOptions struct {
+	// Condition is the state the object must be in for the write to go
+	// ahead.
+	Condition Precondition
+	// Tags are added to the object's tagging.
+	Tags map[string]string
+	// Lock applies the S3_OBJECT_LOCK_MODE retention. Only the object
+	// holding the upload itself is locked: pointers, markers and reports
+	// are rewritten or cleaned up and must stay mutable.
+	Lock bool
+}
+
+// OptionsUploader writes objects with per-object settings. *S3Uploader is
+// the production implementation.
+type OptionsUploader interface {
+	// UploadObjectWith writes the object and returns its new ETag, or
+	// ErrPreconditionFailed when options.Condition does not hold.
+	UploadObjectWith(ctx context.Context, key string, data string, contentType string, metadata map[string]string, options ObjectOptions) (string, error)
+}
+
+// UploadObjectWith writes the object with its options.
+func (u *S3Uploader) UploadObjectWith(ctx context.Context, key string, data string, contentType string, metadata map[string]string, options ObjectOptions) (string, error) {
+	return u.putObject(ctx, key, data, contentType, metadata, options)
+}
@@ -0,0 +1,165 @@
+// Package storage writes uploads to S3.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootsdigitalhealth/lambda-upload-s3/upload"
+)
+
+const (
+	// ProducerMetadataKey and ProducerName tag objects written by this
+	// function so the S3 event consumer can tell them apart from objects
+	// written by other producers.
+	ProducerMetadataKey = "producer"
+	ProducerName        = "lambda-upload-s3"
+)
+
+// Uploader stores objects in the bucket an upload is routed to.
+// *S3Uploader is the production implementation.
+type Uploader interface {
+	upload.Uploader
+	UploadObject(key string, data string, contentType string, metadata map[string]string) error
+	ObjectExists(key string) (bool, error)
+}
+
+// S3Uploader is a wrapper for S3 client
+type S3Uploader struct {
+	Client *s3.Client
+	Bucket string
+	// Getenv reads the S3_* settings objects are written with. It defaults
+	// to os.Getenv.
+	Getenv func(string) string
+}
+
+// NewS3Uploader initializes the S3 client, configured by getenv
+func NewS3Uploader(bucket string, getenv func(string) string) (*S3Uploader, error) {
+	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion("eu-west-2"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load AWS config: %v", err)
+	}
+
+	client := s3.NewFromConfig(cfg, S3Options(getenv))
+	return &S3Uploader{Client: client, Bucket: bucket, Getenv: getenv}, nil
+}
+
+// S3Options applies S3_USE_PATH_STYLE, which S3 emulators such as
+// LocalStack need, to an S3 client.
+func S3Options(getenv func(string) string) func(*s3.Options) {
+	return func(o *s3.Options) {
+		if pathStyle, _ := strconv.ParseBool(getenv("S3_USE_PATH_STYLE")); pathStyle {
+			o.UsePathStyle = true
+		}
+	}
+}
+
+func (u *S3Uploader) getenv(key string) string {
+	if u.Getenv == nil {
+		return os.Getenv(key)
+	}
+	return u.Getenv(key)
+}
+
+// UploadJSON uploads the JSON string to the S3 bucket
+func (u *S3Uploader) UploadJSON(ctx context.Context, key string, data string) error {
+	_, err := u.putObject(ctx, key, data, "application/json", nil, ObjectOptions{})
+	return err
+}
+
+// UploadJSONWithMetadata uploads the JSON string with extra user metadata
+func (u *S3Uploader) UploadJSONWithMetadata(key string, data string, metadata map[string]string) error {
+	return u.UploadObject(key, data, "application/json", metadata)
+}
+
+// UploadObject uploads data of any content type with extra user metadata
+func (u *S3Uploader) UploadObject(key string, data string, contentType string, metadata map[string]string) error {
+	_, err := u.putObject(context.TODO(), key, data, contentType, metadata, ObjectOptions{})
+	return err
+}
+
+// putObject writes the object with its options and returns its ETag.
+func (u *S3Uploader) putObject(ctx context.Context, key string, data string, contentType string, metadata map[string]string, options ObjectOptions) (string, error) {
+	objectMetadata := map[string]string{ProducerMetadataKey: ProducerName}
+	for k, v := range metadata {
+		objectMetadata[k] = v
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(u.Bucket),
+		Key:         aws.String(key),
+		Body:        strings.NewReader(data),
+		ContentType: aws.String(contentType),
+		Metadata:    objectMetadata,
+	}
+
+	class, err := StorageClass(u.getenv)
+	if err != nil {
+		return "", err
+	}
+	input.StorageClass = class
+
+	tagging, err := ObjectTagging(u.getenv, options.Tags)
+	if err != nil {
+		return "", err
+	}
+	if tagging != "" {
+		input.Tagging = aws.String(tagging)
+	}
+
+	if options.Lock {
+		if err := applyObjectLock(u.getenv, input); err != nil {
+			return "", err
+		}
+	}
+	applyPrecondition(input, options.Condition)
+
+	output, err := u.Client.PutObject(ctx, input)
+	if err != nil {
+		return "", preconditionError(objectLockError(input, err))
+	}
+	return aws.ToString(output.ETag), nil
+}
+
+// DownloadJSON reads an object from the S3 bucket along with its metadata
+func (u *S3Uploader) DownloadJSON(key string) (string, map[string]string, error) {
+	output, err := u.Client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(u.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	defer output.Body.Close()
+
+	data, err := io.ReadAll(output.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(data), output.Metadata, nil
+}
+
+// ObjectExists reports whether key is already in the uploader's bucket.
+func (u *S3Uploader) ObjectExists(key string) (bool, error) {
+	_, err := u.Client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(u.Bucket),
+		Key:    aws.String(key),
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// defaultRetentionTagKey is the object tag lifecycle rules match on when
+// S3_RETENTION_TAG_KEY is not set.
+const defaultRetentionTagKey = "retention-days"
+
+// storageClasses are the S3_STORAGE_CLASS values operators may choose.
+var storageClasses = map[string]types.StorageClass{
+	"STANDARD":            types.StorageClassStandard,
+	"STANDARD_IA":         types.StorageClassStandardIa,
+	"INTELLIGENT_TIERING": types.StorageClassIntelligentTiering,
+	"GLACIER_IR":          types.StorageClassGlacierIr,
+}
+
+// StorageClass is the S3_STORAGE_CLASS objects are written with, or empty to
+// use the bucket default.
+func StorageClass(getenv func(string) string) (types.StorageClass, error) {
+	name := strings.ToUpper(getenv("S3_STORAGE_CLASS"))
+	if name == "" {
+		return "", nil
+	}
+
+	class, ok := storageClasses[name]
+	if !ok {
+		return "", fmt.Errorf("invalid S3_STORAGE_CLASS %q", name)
+	}
+	return class, nil
+}
+
+// RetentionTagging is the x-amz-tagging value carrying S3_RETENTION_DAYS,
+// which bucket lifecycle rules use to expire objects, or empty when no
+// retention period is configured.
+func RetentionTagging(getenv func(string) string) (string, error) {
+	return ObjectTagging(getenv, nil)
+}
+
+// ObjectTagging is the x-amz-tagging value carrying tags along with
+// S3_RETENTION_DAYS, or empty when there are neither.
+func ObjectTagging(getenv func(string) string, tags map[string]string) (string, error) {
+	values := url.Values{}
+	for key, value := range tags {
+		values.Set(key, value)
+	}
+
+	if raw := getenv("S3_RETENTION_DAYS"); raw != "" {
+		days, err := strconv.Atoi(raw)
+		if err != nil || days <= 0 {
+			return "", fmt.Errorf("invalid S3_RETENTION_DAYS %q", raw)
+		}
+		values.Set(RetentionTagKey(getenv), strconv.Itoa(days))
+	}
+
+	return values.Encode(), nil
+}
+
+// RetentionTagKey is the S3_RETENTION_TAG_KEY lifecycle rules match on.
+func RetentionTagKey(getenv func(string) string) string {
+	if key := getenv("S3_RETENTION_TAG_KEY"); key != "" {
+		return key
+	}
+	return defaultRetentionTagKey
+}
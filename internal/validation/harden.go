@@ -0,0 +1,191 @@
+package validation
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// JSON_UNSAFE_NUMBERS values.
+const (
+	unsafeNumbersReject   = "reject"
+	unsafeNumbersPreserve = "preserve"
+)
+
+const (
+	// defaultMaxDepth is how deeply objects and arrays may nest when
+	// JSON_MAX_DEPTH is not set.
+	defaultMaxDepth = 64
+
+	// defaultMaxStringBytes caps strings, keys included, when
+	// JSON_MAX_STRING_BYTES is not set.
+	defaultMaxStringBytes = 1024 * 1024
+)
+
+// maxSafeInteger is the largest integer a float64 holds exactly, 2^53 - 1.
+// Consumers decoding numbers as float64, as JavaScript and encoding/json
+// do, silently round anything larger.
+var maxSafeInteger = new(big.Int).SetUint64(1<<53 - 1)
+
+// hardenLimits are the bounds Harden holds payloads to.
+type hardenLimits struct {
+	maxDepth       int
+	maxStringBytes int
+	rejectNumbers  bool
+}
+
+func loadHardenLimits(getenv func(string) string) (hardenLimits, error) {
+	limits := hardenLimits{maxDepth: defaultMaxDepth, maxStringBytes: defaultMaxStringBytes, rejectNumbers: true}
+
+	if raw := getenv("JSON_MAX_DEPTH"); raw != "" {
+		depth, err := strconv.Atoi(raw)
+		if err != nil || depth <= 0 {
+			return limits, fmt.Errorf("invalid JSON_MAX_DEPTH %q", raw)
+		}
+		limits.maxDepth = depth
+	}
+	if raw := getenv("JSON_MAX_STRING_BYTES"); raw != "" {
+		size, err := strconv.Atoi(raw)
+		if err != nil || size <= 0 {
+			return limits, fmt.Errorf("invalid JSON_MAX_STRING_BYTES %q", raw)
+		}
+		limits.maxStringBytes = size
+	}
+	switch mode := strings.ToLower(getenv("JSON_UNSAFE_NUMBERS")); mode {
+	case "", unsafeNumbersReject:
+	case unsafeNumbersPreserve:
+		limits.rejectNumbers = false
+	default:
+		return limits, fmt.Errorf("invalid JSON_UNSAFE_NUMBERS %q", mode)
+	}
+
+	return limits, nil
+}
+
+// hardenFrame is an object or array Harden is inside.
+type hardenFrame struct {
+	object bool
+	// wantKey is set in an object between a value and the next key.
+	wantKey bool
+	keys    map[string]bool
+	key     string
+	index   int
+}
+
+// Harden rejects JSON constructs that the usual interface{} unmarshal
+// hides but that trip up downstream consumers:
+//
+//   - duplicate object keys, which parsers resolve differently
+//   - nesting deeper than JSON_MAX_DEPTH (default 64)
+//   - strings and keys longer than JSON_MAX_STRING_BYTES (default 1 MiB)
+//   - numbers a float64 can't hold exactly
+//
+// With JSON_UNSAFE_NUMBERS=preserve, the last check is skipped. Numbers
+// are then stored exactly as sent, for consumers that decode them as
+// json.Number. Malformed JSON is left for ValidateJSON to report.
+func Harden(getenv func(string) string, jsonData string) (Errors, error) {
+	limits, err := loadHardenLimits(getenv)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(jsonData))
+	decoder.UseNumber()
+
+	var errs Errors
+	var stack []*hardenFrame
+	pointer := func() string {
+		tokens := make([]string, 0, len(stack))
+		for _, frame := range stack {
+			if frame.object {
+				tokens = append(tokens, frame.key)
+			} else {
+				tokens = append(tokens, strconv.Itoa(frame.index))
+			}
+		}
+		return Pointer(tokens...)
+	}
+	// valueDone moves the enclosing object or array past a complete value.
+	valueDone := func() {
+		if len(stack) == 0 {
+			return
+		}
+		if top := stack[len(stack)-1]; top.object {
+			top.wantKey = true
+		} else {
+			top.index++
+		}
+	}
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errs, nil
+		}
+
+		if len(stack) > 0 && stack[len(stack)-1].object && stack[len(stack)-1].wantKey {
+			top := stack[len(stack)-1]
+			if token == json.Delim('}') {
+				stack = stack[:len(stack)-1]
+				valueDone()
+				continue
+			}
+
+			key, _ := token.(string)
+			top.key = key
+			top.wantKey = false
+			if top.keys[key] {
+				errs = append(errs, Error{Pointer: pointer(), Rule: "duplicate_key", Message: fmt.Sprintf("duplicate key %q", truncate(key, MaxValueLength))})
+			}
+			if len(key) > limits.maxStringBytes {
+				errs = append(errs, Error{Pointer: pointer(), Rule: "string_length", Value: truncate(key, MaxValueLength), Message: fmt.Sprintf("key exceeds %d bytes", limits.maxStringBytes)})
+			}
+			top.keys[key] = true
+			continue
+		}
+
+		switch value := token.(type) {
+		case json.Delim:
+			switch value {
+			case '{', '[':
+				if len(stack) >= limits.maxDepth {
+					return append(errs, Error{Pointer: pointer(), Rule: "depth", Message: fmt.Sprintf("nesting exceeds %d levels", limits.maxDepth)}), nil
+				}
+				stack = append(stack, &hardenFrame{object: value == '{', wantKey: value == '{', keys: map[string]bool{}})
+			default:
+				stack = stack[:len(stack)-1]
+				valueDone()
+			}
+			continue
+		case string:
+			if len(value) > limits.maxStringBytes {
+				errs = append(errs, Error{Pointer: pointer(), Rule: "string_length", Value: truncate(value, MaxValueLength), Message: fmt.Sprintf("string exceeds %d bytes", limits.maxStringBytes)})
+			}
+		case json.Number:
+			if limits.rejectNumbers && !float64Safe(value) {
+				errs = append(errs, Error{Pointer: pointer(), Rule: "unsafe_number", Value: truncate(value.String(), MaxValueLength), Message: "number cannot be represented exactly as a float64"})
+			}
+		}
+		valueDone()
+	}
+
+	return errs, nil
+}
+
+// float64Safe reports whether n survives decoding as a float64: integers
+// must be within ±(2^53 - 1) and other numbers within float64's range.
+func float64Safe(n json.Number) bool {
+	literal := n.String()
+	if !strings.ContainsAny(literal, ".eE") {
+		integer, ok := new(big.Int).SetString(literal, 10)
+		return ok && integer.CmpAbs(maxSafeInteger) <= 0
+	}
+	_, err := strconv.ParseFloat(literal, 64)
+	return err == nil
+}
@@ -0,0 +1,223 @@
+package validation
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PII_MODE values.
+const (
+	piiModeOff    = ""
+	piiModeReject = "reject"
+	piiModeRedact = "redact"
+)
+
+// piiDetector finds one kind of personal data in a string value. field is
+// the name of the object field holding the value, if any.
+type piiDetector interface {
+	name() string
+	detect(field, value string) []string
+}
+
+// patternDetector matches values against a regular expression, with an
+// optional check to weed out false positives.
+type patternDetector struct {
+	kind    string
+	pattern *regexp.Regexp
+	valid   func(match string) bool
+}
+
+func (d patternDetector) name() string { return d.kind }
+
+func (d patternDetector) detect(_, value string) []string {
+	var found []string
+	for _, match := range d.pattern.FindAllString(value, -1) {
+		if d.valid == nil || d.valid(match) {
+			found = append(found, match)
+		}
+	}
+	return found
+}
+
+// fieldNameDetector flags any non-empty value held in a field whose name
+// suggests personal data, whatever the value looks like.
+type fieldNameDetector struct {
+	fields map[string]bool
+}
+
+func (d fieldNameDetector) name() string { return "field_name" }
+
+func (d fieldNameDetector) detect(field, value string) []string {
+	if value != "" && d.fields[normaliseFieldName(field)] {
+		return []string{value}
+	}
+	return nil
+}
+
+// defaultSensitiveFields are used when PII_SENSITIVE_FIELDS is not set.
+var defaultSensitiveFields = []string{"email", "emailaddress", "phone", "phonenumber", "mobile", "nhsnumber", "nhsno", "dateofbirth", "dob"}
+
+// piiPatterns are run over every string in the payload, along with the
+// PII_SENSITIVE_FIELDS field name check.
+var piiPatterns = []piiDetector{
+	patternDetector{
+		kind:    "nhs_number",
+		pattern: regexp.MustCompile(`\b\d{3}[ -]?\d{3}[ -]?\d{4}\b`),
+		valid:   validNHSNumber,
+	},
+	patternDetector{
+		kind:    "email",
+		pattern: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+	},
+	patternDetector{
+		kind:    "phone",
+		pattern: regexp.MustCompile(`(?:\+44\s?|\b0)7\d{3}\s?\d{6}\b|(?:\+44\s?|\b0)[12]\d{2,3}\s?\d{3}\s?\d{3,4}\b`),
+	},
+}
+
+// piiDetectors are the detectors CheckPII runs, configured by getenv.
+func piiDetectors(getenv func(string) string) []piiDetector {
+	detectors := append([]piiDetector{}, piiPatterns...)
+	return append(detectors, fieldNameDetector{fields: sensitiveFields(getenv)})
+}
+
+// piiFinding is a piece of personal data found in the payload.
+type piiFinding struct {
+	pointer  string
+	detector string
+}
+
+// piiMode is PII_MODE: "reject", "redact" or unset to skip scanning.
+func piiMode(getenv func(string) string) (string, error) {
+	mode := strings.ToLower(getenv("PII_MODE"))
+	switch mode {
+	case piiModeOff, piiModeReject, piiModeRedact:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid PII_MODE %q", mode)
+	}
+}
+
+// SensitiveField reports whether a field with this name holds personal data,
+// going by PII_SENSITIVE_FIELDS.
+func SensitiveField(getenv func(string) string, name string) bool {
+	return sensitiveFields(getenv)[normaliseFieldName(name)]
+}
+
+func sensitiveFields(getenv func(string) string) map[string]bool {
+	names := defaultSensitiveFields
+	if raw := getenv("PII_SENSITIVE_FIELDS"); raw != "" {
+		names = strings.Split(raw, ",")
+	}
+
+	fields := make(map[string]bool, len(names))
+	for _, name := range names {
+		fields[normaliseFieldName(name)] = true
+	}
+	return fields
+}
+
+// normaliseFieldName lets "nhs_number", "nhsNumber" and "NHS-Number" match.
+func normaliseFieldName(name string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "", " ", "").Replace(name))
+}
+
+// validNHSNumber applies the NHS number modulus 11 check digit.
+func validNHSNumber(candidate string) bool {
+	digits := strings.NewReplacer(" ", "", "-", "").Replace(candidate)
+	if len(digits) != 10 {
+		return false
+	}
+
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += int(digits[i]-'0') * (10 - i)
+	}
+	check := 11 - sum%11
+	if check == 11 {
+		check = 0
+	}
+
+	return check != 10 && check == int(digits[9]-'0')
+}
+
+// scanPII walks the document, returning every finding and, when redact is
+// set, a copy of the document with the offending text masked.
+func scanPII(detectors []piiDetector, value interface{}, field string, tokens []string, redact bool) (interface{}, []piiFinding) {
+	var findings []piiFinding
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			redacted, found := scanPII(detectors, child, key, append(tokens, key), redact)
+			v[key] = redacted
+			findings = append(findings, found...)
+		}
+	case []interface{}:
+		for i, child := range v {
+			redacted, found := scanPII(detectors, child, field, append(tokens, strconv.Itoa(i)), redact)
+			v[i] = redacted
+			findings = append(findings, found...)
+		}
+	case string:
+		for _, detector := range detectors {
+			matches := detector.detect(field, v)
+			if len(matches) == 0 {
+				continue
+			}
+			findings = append(findings, piiFinding{pointer: Pointer(tokens...), detector: detector.name()})
+			if redact {
+				for _, match := range matches {
+					v = strings.ReplaceAll(v, match, "[REDACTED:"+detector.name()+"]")
+				}
+			}
+		}
+		return v, findings
+	}
+
+	return value, findings
+}
+
+// CheckPII scans the payload according to PII_MODE. In reject mode any
+// findings are returned as validation errors; in redact mode the returned
+// body has them masked.
+func CheckPII(getenv func(string) string, jsonData string) (string, Errors, error) {
+	mode, err := piiMode(getenv)
+	if err != nil || mode == piiModeOff {
+		return jsonData, nil, err
+	}
+
+	// decode numbers as json.Number so masking never rounds them
+	var temp interface{}
+	decoder := json.NewDecoder(strings.NewReader(jsonData))
+	decoder.UseNumber()
+	if err := decoder.Decode(&temp); err != nil {
+		return jsonData, nil, err
+	}
+
+	redacted, findings := scanPII(piiDetectors(getenv), temp, "", nil, mode == piiModeRedact)
+	if len(findings) == 0 {
+		return jsonData, nil, nil
+	}
+
+	if mode == piiModeReject {
+		errs := make(Errors, len(findings))
+		for i, finding := range findings {
+			errs[i] = Error{
+				Pointer: finding.pointer,
+				Rule:    "pii:" + finding.detector,
+				Message: fmt.Sprintf("possible %s found", strings.ReplaceAll(finding.detector, "_", " ")),
+			}
+		}
+		return jsonData, errs, nil
+	}
+
+	body, err := json.Marshal(redacted)
+	if err != nil {
+		return jsonData, nil, err
+	}
+	return string(body), nil, nil
+}
@@ -0,0 +1,133 @@
+// Package validation checks uploaded payloads and describes every problem
+// found with a JSON Pointer to where it is.
+package validation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MaxValueLength bounds how much of an offending value is echoed back.
+const MaxValueLength = 64
+
+// Error pinpoints a single problem with an uploaded payload.
+type Error struct {
+	// Pointer is an RFC 6901 JSON Pointer to the offending location; the
+	// empty string refers to the whole document.
+	Pointer string `json:"pointer"`
+	Rule    string `json:"rule"`
+	Value   string `json:"value,omitempty"`
+	Message string `json:"message"`
+}
+
+// Errors collects every problem found in a payload.
+type Errors []Error
+
+func (v Errors) Error() string {
+	messages := make([]string, len(v))
+	for i, e := range v {
+		messages[i] = e.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Pointer builds a JSON Pointer from reference tokens, escaping "~" and
+// "/" as RFC 6901 requires.
+func Pointer(tokens ...string) string {
+	var b strings.Builder
+	for _, token := range tokens {
+		b.WriteString("/")
+		b.WriteString(strings.NewReplacer("~", "~0", "/", "~1").Replace(token))
+	}
+	return b.String()
+}
+
+// Value renders an offending value for the response, truncated so large
+// or sensitive documents are not echoed back in full.
+func Value(value interface{}) string {
+	raw, ok := value.(string)
+	if !ok {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return ""
+		}
+		raw = string(encoded)
+	}
+	return truncate(raw, MaxValueLength)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// ValidateJSON checks the payload is well-formed JSON with an object or
+// array at the top level. It reads the payload a token at a time rather than
+// building the whole document in memory.
+func ValidateJSON(jsonData string) Errors {
+	decoder := json.NewDecoder(strings.NewReader(jsonData))
+
+	first, err := decoder.Token()
+	if err != nil {
+		return syntaxErrors(jsonData, err, decoder.InputOffset())
+	}
+
+	// Walk the rest of the top-level object or array to check its syntax
+	if _, ok := first.(json.Delim); ok {
+		for depth := 1; depth > 0; {
+			token, err := decoder.Token()
+			if err != nil {
+				return syntaxErrors(jsonData, err, decoder.InputOffset())
+			}
+			switch token {
+			case json.Delim('{'), json.Delim('['):
+				depth++
+			case json.Delim('}'), json.Delim(']'):
+				depth--
+			}
+		}
+	}
+
+	// Nothing but whitespace may follow the top-level value
+	offset := decoder.InputOffset()
+	if rest := strings.TrimLeft(jsonData[offset:], " \t\r\n"); rest != "" {
+		err := fmt.Errorf("invalid character %q after top-level value", rest[0])
+		return syntaxErrors(jsonData, err, offset+int64(len(jsonData[offset:])-len(rest)))
+	}
+
+	// Ensure the top-level structure is either a JSON object or array
+	if _, ok := first.(json.Delim); !ok {
+		return Errors{{
+			Rule:    "type",
+			Value:   Value(first),
+			Message: "invalid JSON: must be an object or array",
+		}}
+	}
+
+	return nil
+}
+
+// syntaxErrors reports a syntax error found at offset into the payload,
+// echoing the payload from just before it.
+func syntaxErrors(jsonData string, err error, offset int64) Errors {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = errors.New("unexpected end of JSON input")
+		offset = int64(len(jsonData))
+	}
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		offset = syntaxErr.Offset
+	}
+
+	start := max(0, int(offset)-MaxValueLength/2)
+	return Errors{{
+		Rule:    "syntax",
+		Value:   truncate(jsonData[min(start, len(jsonData)):], MaxValueLength),
+		Message: fmt.Sprintf("invalid JSON format: %v", err),
+	}}
+}
@@ -0,0 +1,194 @@
+package validation
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// benchmarkPayload is an array of 20,000 small objects, about 1.9 MB.
+func benchmarkPayload() string {
+	var b strings.Builder
+	b.WriteString("[")
+	for i := 0; i < 20000; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, `{"id":%d,"type":"step_count","value":%d.5,"recorded":"2026-01-02T03:04:05Z","tags":["a","b"],"ok":true}`, i, i*7)
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
+func BenchmarkValidateJSON(b *testing.B) {
+	payload := benchmarkPayload()
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if errs := ValidateJSON(payload); errs != nil {
+			b.Fatal(errs)
+		}
+	}
+}
+
+// env is a getenv reading from a map.
+func env(values map[string]string) func(string) string {
+	return func(key string) string { return values[key] }
+}
+
+func TestValidateJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		wantRule string
+	}{
+		{name: "object", data: `{"steps":1,"tags":["a",{"b":null}]}`},
+		{name: "array", data: `[1,2,3]`},
+		{name: "trailing whitespace", data: "{}\n\t "},
+		{name: "top-level string", data: `"steps"`, wantRule: "type"},
+		{name: "top-level number", data: `12`, wantRule: "type"},
+		{name: "top-level null", data: `null`, wantRule: "type"},
+		{name: "empty", data: ``, wantRule: "syntax"},
+		{name: "truncated", data: `{"steps":`, wantRule: "syntax"},
+		{name: "missing colon", data: `{"steps" 1}`, wantRule: "syntax"},
+		{name: "unbalanced", data: `[1,2}`, wantRule: "syntax"},
+		{name: "second value", data: `{} {}`, wantRule: "syntax"},
+		{name: "trailing garbage", data: `[1] x`, wantRule: "syntax"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := ValidateJSON(tt.data)
+			if tt.wantRule == "" {
+				if errs != nil {
+					t.Fatalf("ValidateJSON() = %v, want nil", errs)
+				}
+				return
+			}
+			if len(errs) != 1 || errs[0].Rule != tt.wantRule {
+				t.Fatalf("ValidateJSON() = %+v, want one %s error", errs, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestValidateJSONEchoesTheError(t *testing.T) {
+	data := `{"steps":1,` + strings.Repeat(" ", 100) + `"end" 2}`
+	errs := ValidateJSON(data)
+	if len(errs) != 1 {
+		t.Fatalf("ValidateJSON() = %+v, want one error", errs)
+	}
+	if len(errs[0].Value) > MaxValueLength+len("...") || !strings.Contains(errs[0].Value, `"end"`) {
+		t.Errorf("Value = %q, want at most %d bytes from around the error", errs[0].Value, MaxValueLength)
+	}
+}
+
+func TestHarden(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		data        string
+		wantRule    string
+		wantPointer string
+	}{
+		{name: "clean", data: `{"steps":1,"tags":["a","b"],"nested":{"ok":true}}`},
+		{name: "top-level scalar left to ValidateJSON", data: `"steps"`},
+		{name: "malformed left to ValidateJSON", data: `{"steps":`},
+		{name: "duplicate key", data: `{"steps":1,"steps":2}`, wantRule: "duplicate_key", wantPointer: "/steps"},
+		{name: "duplicate nested key", data: `{"days":[{"steps":1},{"steps":1,"steps":2}]}`, wantRule: "duplicate_key", wantPointer: "/days/1/steps"},
+		{name: "same key in sibling objects", data: `[{"steps":1},{"steps":2}]`},
+		{name: "within depth", env: map[string]string{"JSON_MAX_DEPTH": "2"}, data: `{"a":{"b":1}}`},
+		{name: "too deep", env: map[string]string{"JSON_MAX_DEPTH": "2"}, data: `{"a":{"b":[1]}}`, wantRule: "depth", wantPointer: "/a/b"},
+		{name: "default depth", data: strings.Repeat("[", defaultMaxDepth+1) + strings.Repeat("]", defaultMaxDepth+1), wantRule: "depth"},
+		{name: "long string", env: map[string]string{"JSON_MAX_STRING_BYTES": "4"}, data: `{"a":[1,{"b":"hello"}]}`, wantRule: "string_length", wantPointer: "/a/1/b"},
+		{name: "long key", env: map[string]string{"JSON_MAX_STRING_BYTES": "4"}, data: `{"hello":1}`, wantRule: "string_length", wantPointer: "/hello"},
+		{name: "largest safe integer", data: `[9007199254740991,-9007199254740991,1.5e300]`},
+		{name: "unsafe integer", data: `[1,9007199254740993]`, wantRule: "unsafe_number", wantPointer: "/1"},
+		{name: "float out of range", data: `{"x":1e400}`, wantRule: "unsafe_number", wantPointer: "/x"},
+		{name: "unsafe integer preserved", env: map[string]string{"JSON_UNSAFE_NUMBERS": "preserve"}, data: `[9007199254740993]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs, err := Harden(env(tt.env), tt.data)
+			if err != nil {
+				t.Fatalf("Harden() error = %v", err)
+			}
+			if tt.wantRule == "" {
+				if len(errs) != 0 {
+					t.Fatalf("Harden() = %+v, want none", errs)
+				}
+				return
+			}
+			if len(errs) != 1 || errs[0].Rule != tt.wantRule {
+				t.Fatalf("Harden() = %+v, want one %s error", errs, tt.wantRule)
+			}
+			if tt.wantPointer != "" && errs[0].Pointer != tt.wantPointer {
+				t.Errorf("Pointer = %q, want %q", errs[0].Pointer, tt.wantPointer)
+			}
+		})
+	}
+}
+
+func TestHardenRejectsInvalidLimits(t *testing.T) {
+	for _, values := range []map[string]string{
+		{"JSON_MAX_DEPTH": "0"},
+		{"JSON_MAX_DEPTH": "deep"},
+		{"JSON_MAX_STRING_BYTES": "-1"},
+		{"JSON_UNSAFE_NUMBERS": "round"},
+	} {
+		if _, err := Harden(env(values), `{}`); err == nil {
+			t.Errorf("Harden() with %v: error = nil, want an error", values)
+		}
+	}
+}
+
+func TestCheckPII(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		data     string
+		wantBody string
+		wantRule string
+	}{
+		{name: "off", data: `{"email":"jo@example.com"}`, wantBody: `{"email":"jo@example.com"}`},
+		{name: "nothing found", env: map[string]string{"PII_MODE": "reject"}, data: `{"steps":1}`, wantBody: `{"steps":1}`},
+		{name: "reject email", env: map[string]string{"PII_MODE": "reject"}, data: `{"note":"mail jo@example.com"}`, wantBody: `{"note":"mail jo@example.com"}`, wantRule: "pii:email"},
+		{name: "reject NHS number", env: map[string]string{"PII_MODE": "reject"}, data: `["943 476 5919"]`, wantBody: `["943 476 5919"]`, wantRule: "pii:nhs_number"},
+		{name: "NHS number failing its check digit", env: map[string]string{"PII_MODE": "reject"}, data: `["943 476 5918"]`, wantBody: `["943 476 5918"]`},
+		{name: "reject sensitive field", env: map[string]string{"PII_MODE": "reject"}, data: `{"Date_Of_Birth":"1 May"}`, wantBody: `{"Date_Of_Birth":"1 May"}`, wantRule: "pii:field_name"},
+		{name: "configured sensitive fields", env: map[string]string{"PII_MODE": "reject", "PII_SENSITIVE_FIELDS": "postcode"}, data: `{"dob":"1 May","post_code":"AB1 2CD"}`, wantBody: `{"dob":"1 May","post_code":"AB1 2CD"}`, wantRule: "pii:field_name"},
+		{name: "redact phone", env: map[string]string{"PII_MODE": "redact"}, data: `{"note":"call 07700 900123 today"}`, wantBody: `{"note":"call [REDACTED:phone] today"}`},
+		{name: "redact keeps numbers exact", env: map[string]string{"PII_MODE": "REDACT"}, data: `{"id":12345678901234567890,"nhs":"9434765919"}`, wantBody: `{"id":12345678901234567890,"nhs":"[REDACTED:nhs_number]"}`},
+		{name: "redact nested field", env: map[string]string{"PII_MODE": "redact"}, data: `{"contacts":[{"mobile":"private"}]}`, wantBody: `{"contacts":[{"mobile":"[REDACTED:field_name]"}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, errs, err := CheckPII(env(tt.env), tt.data)
+			if err != nil {
+				t.Fatalf("CheckPII() error = %v", err)
+			}
+			if body != tt.wantBody {
+				t.Errorf("body = %s, want %s", body, tt.wantBody)
+			}
+			if tt.wantRule == "" {
+				if len(errs) != 0 {
+					t.Fatalf("CheckPII() errors = %+v, want none", errs)
+				}
+				return
+			}
+			if len(errs) != 1 || errs[0].Rule != tt.wantRule {
+				t.Fatalf("CheckPII() errors = %+v, want one %s error", errs, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestCheckPIIRejectsInvalidMode(t *testing.T) {
+	if _, _, err := CheckPII(env(map[string]string{"PII_MODE": "mask"}), `{}`); err == nil {
+		t.Fatal("CheckPII() error = nil, want an error for PII_MODE=mask")
+	}
+}
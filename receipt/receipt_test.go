@@ -0,0 +1,170 @@
+package receipt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// fakeKMS signs with an in-memory ECDSA key, or returns signature as the
+// DER signature when it is set.
+type fakeKMS struct {
+	key       *ecdsa.PrivateKey
+	signature []byte
+}
+
+func newFakeKMS(t *testing.T) *fakeKMS {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeKMS{key: key}
+}
+
+func (f *fakeKMS) Sign(ctx context.Context, params *kms.SignInput, optFns ...func(*kms.Options)) (*kms.SignOutput, error) {
+	if f.signature != nil {
+		return &kms.SignOutput{Signature: f.signature}, nil
+	}
+	signature, err := ecdsa.SignASN1(rand.Reader, f.key, params.Message)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.SignOutput{Signature: signature}, nil
+}
+
+func (f *fakeKMS) GetPublicKey(ctx context.Context, params *kms.GetPublicKeyInput, optFns ...func(*kms.Options)) (*kms.GetPublicKeyOutput, error) {
+	der, err := x509.MarshalPKIXPublicKey(&f.key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.GetPublicKeyOutput{PublicKey: der}, nil
+}
+
+var testClaims = Claims{Key: "sleep/2026/1/2/03:04:05_7_sleep.json", SHA256: "abc123", UserID: 7, IssuedAt: 1767323045}
+
+// replaceSegment returns token with segment i replaced by the encoding of v.
+func replaceSegment(t *testing.T, token string, i int, v interface{}) string {
+	t.Helper()
+	segments := strings.Split(token, ".")
+	encoded, err := encodeSegment(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments[i] = encoded
+	return strings.Join(segments, ".")
+}
+
+// flipSignature returns token with a bit of its signature flipped.
+func flipSignature(t *testing.T, token string) string {
+	t.Helper()
+	i := strings.LastIndex(token, ".") + 1
+	raw, err := base64.RawURLEncoding.DecodeString(token[i:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[10] ^= 1
+	return token[:i] + base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func TestSignVerify(t *testing.T) {
+	client := newFakeKMS(t)
+	token, err := Sign(context.Background(), client, "alias/receipts", testClaims)
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	publicKey, err := PublicKey(context.Background(), client, "alias/receipts")
+	if err != nil {
+		t.Fatalf("PublicKey() error = %v", err)
+	}
+	otherKey := newFakeKMS(t).key.PublicKey
+
+	tests := []struct {
+		name      string
+		token     string
+		publicKey *ecdsa.PublicKey
+		wantErr   bool
+	}{
+		{name: "round trip", token: token, publicKey: publicKey},
+		{name: "tampered claims", token: replaceSegment(t, token, 1, Claims{Key: testClaims.Key, SHA256: testClaims.SHA256, UserID: 8, IssuedAt: testClaims.IssuedAt}), publicKey: publicKey, wantErr: true},
+		{name: "tampered signature", token: flipSignature(t, token), publicKey: publicKey, wantErr: true},
+		{name: "another key", token: token, publicKey: &otherKey, wantErr: true},
+		{name: "wrong algorithm", token: replaceSegment(t, token, 0, header{Algorithm: "none"}), publicKey: publicKey, wantErr: true},
+		{name: "HMAC algorithm", token: replaceSegment(t, token, 0, header{Algorithm: "HS256", KeyID: "alias/receipts"}), publicKey: publicKey, wantErr: true},
+		{name: "unsigned", token: strings.Join(strings.Split(token, ".")[:2], ".") + ".", publicKey: publicKey, wantErr: true},
+		{name: "not a JWS", token: "receipt", publicKey: publicKey, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := Verify(tt.token, tt.publicKey)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalid) {
+					t.Fatalf("Verify() error = %v, want ErrInvalid", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if claims != testClaims {
+				t.Errorf("Verify() = %+v, want %+v", claims, testClaims)
+			}
+		})
+	}
+}
+
+func TestSignConvertsDERSignature(t *testing.T) {
+	tests := []struct {
+		name string
+		r, s *big.Int
+	}{
+		{name: "full length", r: new(big.Int).Lsh(big.NewInt(1), 255), s: new(big.Int).Lsh(big.NewInt(3), 254)},
+		// DER drops leading zeros, which JWS keeps to 32 bytes each
+		{name: "short r and s", r: big.NewInt(1), s: big.NewInt(2)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			der, err := asn1.Marshal(struct{ R, S *big.Int }{tt.r, tt.s})
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := newFakeKMS(t)
+			client.signature = der
+
+			token, err := Sign(context.Background(), client, "alias/receipts", testClaims)
+			if err != nil {
+				t.Fatalf("Sign() error = %v", err)
+			}
+			raw, err := base64.RawURLEncoding.DecodeString(token[strings.LastIndex(token, ".")+1:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(raw) != 64 {
+				t.Fatalf("signature is %d bytes, want 64", len(raw))
+			}
+			if r, s := new(big.Int).SetBytes(raw[:32]), new(big.Int).SetBytes(raw[32:]); r.Cmp(tt.r) != 0 || s.Cmp(tt.s) != 0 {
+				t.Errorf("signature r, s = %v, %v, want %v, %v", r, s, tt.r, tt.s)
+			}
+		})
+	}
+}
+
+func TestSignRejectsMalformedDER(t *testing.T) {
+	client := newFakeKMS(t)
+	client.signature = []byte("not DER")
+	if _, err := Sign(context.Background(), client, "alias/receipts", testClaims); err == nil {
+		t.Fatal("Sign() error = nil, want the DER decoding error")
+	}
+}
@@ -0,0 +1,31 @@
+// Package upload holds the interfaces the upload handler depends on, so code
+// embedding it can substitute in-memory implementations in integration
+// tests. See the uploadtest package for ready-made ones.
+package upload
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrInvalidSession is returned by a SessionGetter for tokens without a
+// valid session; the handler answers 401 for it.
+var ErrInvalidSession = errors.New("session is invalid or has expired")
+
+// Session is the part of a caller's session the handler relies on.
+type Session struct {
+	UserID int64
+	// SystemCode is the client application the session was created for,
+	// when the store records it.
+	SystemCode string
+}
+
+// SessionGetter resolves a bearer token to the caller's session.
+type SessionGetter interface {
+	GetSession(ctx context.Context, token string) (Session, error)
+}
+
+// Uploader stores JSON documents under a key.
+type Uploader interface {
+	UploadJSON(ctx context.Context, key string, data string) error
+}
@@ -0,0 +1,91 @@
+// Package uploadtest provides in-memory implementations of the upload
+// interfaces for integration tests that should not touch S3 or Redis.
+package uploadtest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/bootsdigitalhealth/lambda-upload-s3/upload"
+)
+
+// Object is a document stored by MemoryUploader.
+type Object struct {
+	Data        string
+	ContentType string
+	Metadata    map[string]string
+}
+
+// MemoryUploader keeps uploaded objects in memory. Set Err to make every
+// upload fail. The zero value is ready to use.
+type MemoryUploader struct {
+	Err error
+
+	mu      sync.Mutex
+	objects map[string]Object
+}
+
+var _ upload.Uploader = (*MemoryUploader)(nil)
+
+// UploadJSON stores data as an application/json object.
+func (m *MemoryUploader) UploadJSON(_ context.Context, key string, data string) error {
+	return m.UploadObject(key, data, "application/json", nil)
+}
+
+// UploadObject stores data of any content type with its metadata.
+func (m *MemoryUploader) UploadObject(key string, data string, contentType string, metadata map[string]string) error {
+	if m.Err != nil {
+		return m.Err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.objects == nil {
+		m.objects = map[string]Object{}
+	}
+	m.objects[key] = Object{Data: data, ContentType: contentType, Metadata: metadata}
+	return nil
+}
+
+// ObjectExists reports whether an object has been stored under key.
+func (m *MemoryUploader) ObjectExists(key string) (bool, error) {
+	_, ok := m.Object(key)
+	return ok, nil
+}
+
+// Object returns the object stored under key.
+func (m *MemoryUploader) Object(key string) (Object, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	object, ok := m.objects[key]
+	return object, ok
+}
+
+// Keys returns the keys of every stored object.
+func (m *MemoryUploader) Keys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]string, 0, len(m.objects))
+	for key := range m.objects {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Sessions maps bearer tokens to sessions. Unknown tokens get
+// upload.ErrInvalidSession.
+type Sessions map[string]upload.Session
+
+var _ upload.SessionGetter = Sessions(nil)
+
+// GetSession looks the token up.
+func (s Sessions) GetSession(_ context.Context, token string) (upload.Session, error) {
+	session, ok := s[token]
+	if !ok {
+		return upload.Session{}, upload.ErrInvalidSession
+	}
+	return session, nil
+}